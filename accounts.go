@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Codes of errors sent to clients for account messages
+const (
+	errAccountsDisabled   = "accounts_disabled"
+	errInvalidCredentials = "invalid_credentials"
+	errUsernameTaken      = "username_taken"
+	errInvalidAccount     = "invalid_account"
+	errNotLoggedIn        = "not_logged_in"
+	errInvalidLinkCode    = "invalid_link_code"
+	errAlreadyLinked      = "already_linked"
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9._-]{3,64}$`)
+
+// Passwords are hashed with bcrypt, which ignores anything past 72 bytes
+const (
+	minPasswordLength = 8
+	maxPasswordBytes  = 72
+)
+
+var (
+	errUsernameExists = errors.New("username is taken")
+	errBadCredentials = errors.New("wrong username or password")
+	errNoDevice       = errors.New("no linked device with that ID")
+)
+
+// User - Account grouping the devices of one person
+type User struct {
+	ID           string         `json:"id"`
+	Username     string         `json:"username"`
+	PasswordHash string         `json:"passwordHash"`
+	Created      time.Time      `json:"created"`
+	Devices      []LinkedDevice `json:"devices"`
+}
+
+// LinkedDevice - Device signed in to a user account. The device reconnects with the token
+// it was given when linked, only a hash of which is kept.
+type LinkedDevice struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	TokenHash string    `json:"tokenHash"`
+	LinkedAt  time.Time `json:"linkedAt"`
+}
+
+// accountStore - User accounts, kept in memory and written to a json file when path is set
+type accountStore struct {
+	path string
+	// bcrypt cost of new password hashes, lowered in tests
+	hashCost int
+
+	mu    sync.Mutex
+	users map[string]*User
+	// Hash compared against when a username doesn't exist so logins take as long either way
+	dummyHash []byte
+}
+
+func newAccountStore(config *Config) (*accountStore, error) {
+	s := &accountStore{hashCost: bcrypt.DefaultCost, users: make(map[string]*User)}
+	if config.AccountsBackend == "file" {
+		s.path = config.AccountsPath
+		usersBytes, err := os.ReadFile(s.path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			users := []*User{}
+			if err := json.Unmarshal(usersBytes, &users); err != nil {
+				return nil, err
+			}
+			for _, user := range users {
+				s.users[user.ID] = user
+			}
+		}
+	}
+	return s, nil
+}
+
+// save - Writes every account to the file. Caller must hold s.mu.
+func (s *accountStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	users := make([]*User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	usersBytes, err := json.Marshal(users)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a failed save never loses accounts
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, usersBytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+// userByName - Caller must hold s.mu
+func (s *accountStore) userByName(username string) *User {
+	for _, user := range s.users {
+		if user.Username == username {
+			return user
+		}
+	}
+	return nil
+}
+
+// register - Creates a user. Usernames are case insensitive.
+func (s *accountStore) register(username string, password string) (User, error) {
+	username = strings.ToLower(username)
+	if !usernamePattern.MatchString(username) {
+		return User{}, errors.New("usernames must be 3 to 64 letters, digits, dots, dashes or underscores")
+	}
+	if len(password) < minPasswordLength || len(password) > maxPasswordBytes {
+		return User{}, errors.New("passwords must be 8 to 72 bytes")
+	}
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), s.hashCost)
+	if err != nil {
+		return User{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.userByName(username) != nil {
+		return User{}, errUsernameExists
+	}
+	user := &User{
+		ID:           newToken(),
+		Username:     username,
+		PasswordHash: string(passwordHash),
+		Created:      time.Now(),
+		Devices:      []LinkedDevice{},
+	}
+	s.users[user.ID] = user
+	return *user, s.save()
+}
+
+// authenticate - Returns the user if password is theirs
+func (s *accountStore) authenticate(username string, password string) (User, error) {
+	s.mu.Lock()
+	var user User
+	passwordHash := s.dummyPasswordHash()
+	found := s.userByName(strings.ToLower(username))
+	if found != nil {
+		user = *found
+		passwordHash = []byte(user.PasswordHash)
+	}
+	s.mu.Unlock()
+	if bcrypt.CompareHashAndPassword(passwordHash, []byte(password)) != nil || found == nil {
+		return User{}, errBadCredentials
+	}
+	return user, nil
+}
+
+// dummyPasswordHash - Caller must hold s.mu
+func (s *accountStore) dummyPasswordHash() []byte {
+	if s.dummyHash == nil {
+		s.dummyHash, _ = bcrypt.GenerateFromPassword([]byte(newToken()), s.hashCost)
+	}
+	return s.dummyHash
+}
+
+// linkDevice - Adds a device to a user, returning it and the token it reconnects with
+func (s *accountStore) linkDevice(userID string, name string) (LinkedDevice, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, exists := s.users[userID]
+	if !exists {
+		return LinkedDevice{}, "", errBadCredentials
+	}
+	token := newToken()
+	device := LinkedDevice{
+		ID:        newToken()[:12],
+		Name:      name,
+		TokenHash: hashDeviceToken(token),
+		LinkedAt:  time.Now(),
+	}
+	user.Devices = append(user.Devices, device)
+	return device, token, s.save()
+}
+
+// renewDevice - Gives a user's device a new token, so the old one no longer signs it in
+func (s *accountStore) renewDevice(userID string, deviceID string) (LinkedDevice, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, exists := s.users[userID]
+	if !exists {
+		return LinkedDevice{}, "", errNoDevice
+	}
+	for i, device := range user.Devices {
+		if device.ID == deviceID {
+			token := newToken()
+			user.Devices[i].TokenHash = hashDeviceToken(token)
+			return user.Devices[i], token, s.save()
+		}
+	}
+	return LinkedDevice{}, "", errNoDevice
+}
+
+// unlinkDevice - Removes a device so its token no longer signs it in
+func (s *accountStore) unlinkDevice(userID string, deviceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, exists := s.users[userID]
+	if !exists {
+		return errNoDevice
+	}
+	for i, device := range user.Devices {
+		if device.ID == deviceID {
+			user.Devices = append(user.Devices[:i], user.Devices[i+1:]...)
+			return s.save()
+		}
+	}
+	return errNoDevice
+}
+
+// deviceByToken - Finds the user and device a device token was issued to
+func (s *accountStore) deviceByToken(token string) (User, LinkedDevice, bool) {
+	tokenHash := hashDeviceToken(token)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, user := range s.users {
+		for _, device := range user.Devices {
+			if device.TokenHash == tokenHash {
+				return *user, device, true
+			}
+		}
+	}
+	return User{}, LinkedDevice{}, false
+}
+
+// user - Looks up a user by ID
+func (s *accountStore) user(userID string) (User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, exists := s.users[userID]
+	if !exists {
+		return User{}, false
+	}
+	userCopy := *user
+	userCopy.Devices = append([]LinkedDevice{}, user.Devices...)
+	return userCopy, true
+}
+
+// Device tokens are random so a fast hash is enough to keep them unusable if the file leaks
+func hashDeviceToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// accountsEnabled - Whether clients can register and link devices
+func (a *App) accountsEnabled() bool {
+	return a.accounts != nil
+}
+
+// signInDevice - Makes client a device of user when connecting with a device token.
+// Any bearer token identity is kept, accounts are separate from it. Caller must hold a.mu.
+func (a *App) signInDevice(client *Client, deviceToken string) {
+	if !a.accountsEnabled() || deviceToken == "" {
+		return
+	}
+	if user, device, ok := a.accounts.deviceByToken(deviceToken); ok {
+		client.userID = user.ID
+		client.deviceID = device.ID
+	}
+}
+
+// requireAccounts - Sends an error and returns false if accounts are disabled. Caller must hold a.mu.
+func (a *App) requireAccounts(ctx context.Context, client Client) bool {
+	if !a.accountsEnabled() {
+		a.sendErrorCode(ctx, client, errAccountsDisabled, "User accounts are not enabled on this server")
+	}
+	return a.accountsEnabled()
+}
+
+// requireUser - Sends an error and returns false if client isn't a linked device. Caller must hold a.mu.
+func (a *App) requireUser(ctx context.Context, client Client) bool {
+	if !a.requireAccounts(ctx, client) {
+		return false
+	}
+	if client.deviceID == "" {
+		a.sendErrorCode(ctx, client, errNotLoggedIn, "Log in or link this device to an account first")
+		return false
+	}
+	return true
+}
+
+func (a *App) onRegisterMsg(ctx context.Context, senderClient Client, msg RegisterMsg) {
+	if !a.requireAccounts(ctx, senderClient) {
+		return
+	}
+	a.withoutLock(ctx, "onRegisterMsg", senderClient.ID, func() (User, error) {
+		return a.accounts.register(msg.Username, msg.Password)
+	}, func(ctx context.Context, client Client, user User, err error) {
+		if errors.Is(err, errUsernameExists) {
+			a.sendErrorCode(ctx, client, errUsernameTaken, "Username is taken")
+			return
+		}
+		if err != nil {
+			a.sendErrorCode(ctx, client, errInvalidAccount, "Could not register: "+err.Error())
+			return
+		}
+		a.clientLogger(client).Info("User registered", "userId", user.ID)
+		a.linkClient(ctx, client, user, msg.DeviceName)
+	})
+}
+
+func (a *App) onLoginMsg(ctx context.Context, senderClient Client, msg LoginMsg) {
+	if !a.requireAccounts(ctx, senderClient) {
+		return
+	}
+	a.withoutLock(ctx, "onLoginMsg", senderClient.ID, func() (User, error) {
+		return a.accounts.authenticate(msg.Username, msg.Password)
+	}, func(ctx context.Context, client Client, user User, err error) {
+		if err != nil {
+			a.clientLogger(client).Warn("Login failed")
+			a.sendErrorCode(ctx, client, errInvalidCredentials, "Wrong username or password")
+			return
+		}
+		a.linkClient(ctx, client, user, msg.DeviceName)
+	})
+}
+
+// withoutLock - Runs work, which hashes passwords and is too slow to hold a.mu for, in the background
+// then calls done with a.mu held if the client is still connected
+func (a *App) withoutLock(ctx context.Context, spanName string, clientID string, work func() (User, error), done func(context.Context, Client, User, error)) {
+	go func() {
+		ctx, span := a.tracer.Start(ctx, spanName)
+		defer span.End()
+		user, err := work()
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if client, connected := a.ClientMap[clientID]; connected {
+			done(ctx, client, user, err)
+		}
+	}()
+}
+
+// onLinkDeviceMsg - Links the client whose QR code a signed in device scanned to the same user
+func (a *App) onLinkDeviceMsg(ctx context.Context, senderClient Client, msg LinkDeviceMsg) {
+	ctx, span := a.tracer.Start(ctx, "onLinkDeviceMsg")
+	defer span.End()
+	if !a.requireUser(ctx, senderClient) {
+		return
+	}
+	client, connected := a.ClientMap[msg.ClientID]
+	if !connected {
+		a.sendError(ctx, senderClient, "No client with ID "+msg.ClientID)
+		return
+	}
+	// Only a device that scanned the client's QR code knows its link code
+	if client.linkCode == "" || subtle.ConstantTimeCompare([]byte(client.linkCode), []byte(msg.LinkCode)) != 1 {
+		a.sendErrorCode(ctx, senderClient, errInvalidLinkCode, "Wrong link code for client "+msg.ClientID)
+		return
+	}
+	if client.deviceID != "" || (client.userID != "" && client.userID != senderClient.userID) {
+		a.sendErrorCode(ctx, senderClient, errAlreadyLinked, "Client "+msg.ClientID+" is already signed in")
+		return
+	}
+	user, exists := a.accounts.user(senderClient.userID)
+	if !exists {
+		a.sendErrorCode(ctx, senderClient, errNotLoggedIn, "Account no longer exists")
+		return
+	}
+	client.linkCode = ""
+	a.linkClient(ctx, client, user, msg.DeviceName)
+	a.sendUserDevices(ctx, senderClient)
+}
+
+// linkClient - Adds client to user as a new device and sends it the token to reconnect with.
+// A client that is already one of user's devices keeps its device with a new token, and one
+// signed in as another user's device is unlinked from it first. Caller must hold a.mu.
+func (a *App) linkClient(ctx context.Context, client Client, user User, deviceName string) {
+	if deviceName == "" {
+		deviceName = client.Name
+	}
+	device, token, err := LinkedDevice{}, "", errNoDevice
+	if client.deviceID != "" && client.userID == user.ID {
+		device, token, err = a.accounts.renewDevice(user.ID, client.deviceID)
+	} else if client.deviceID != "" {
+		if err := a.accounts.unlinkDevice(client.userID, client.deviceID); err != nil && !errors.Is(err, errNoDevice) {
+			a.clientLogger(client).Error("Could not unlink previous device", "userId", client.userID, "err", err)
+		}
+		a.signOutDevice(client.userID, client.deviceID)
+	}
+	// The device may have been unlinked since the client signed in with it
+	if errors.Is(err, errNoDevice) {
+		device, token, err = a.accounts.linkDevice(user.ID, deviceName)
+	}
+	if err != nil {
+		a.clientLogger(client).Error("Could not link device", "userId", user.ID, "err", err)
+		a.sendError(ctx, client, "Could not link device")
+		return
+	}
+	client.userID = user.ID
+	client.deviceID = device.ID
+	a.ClientMap[client.ID] = client
+	a.clientLogger(client).Info("Device linked", "userId", user.ID, "deviceId", device.ID)
+	client.transport.Send(ctx, DeviceLinkedMsg{
+		Type:        "DeviceLinked",
+		UserID:      user.ID,
+		Username:    user.Username,
+		DeviceID:    device.ID,
+		DeviceToken: token,
+	})
+}
+
+func (a *App) onUnlinkDeviceMsg(ctx context.Context, senderClient Client, msg UnlinkDeviceMsg) {
+	ctx, span := a.tracer.Start(ctx, "onUnlinkDeviceMsg")
+	defer span.End()
+	if !a.requireUser(ctx, senderClient) {
+		return
+	}
+	if err := a.accounts.unlinkDevice(senderClient.userID, msg.DeviceID); err != nil {
+		a.sendError(ctx, senderClient, "No linked device with ID "+msg.DeviceID)
+		return
+	}
+	a.signOutDevice(senderClient.userID, msg.DeviceID)
+	if msg.DeviceID != senderClient.deviceID {
+		a.sendUserDevices(ctx, senderClient)
+	}
+}
+
+// signOutDevice - Signs out the clients connected as an unlinked device. Caller must hold a.mu.
+func (a *App) signOutDevice(userID string, deviceID string) {
+	for _, client := range a.ClientMap {
+		if client.userID == userID && client.deviceID == deviceID {
+			client.userID = ""
+			client.deviceID = ""
+			a.ClientMap[client.ID] = client
+		}
+	}
+}
+
+func (a *App) onListDevicesMsg(ctx context.Context, senderClient Client, msg ListDevicesMsg) {
+	ctx, span := a.tracer.Start(ctx, "onListDevicesMsg")
+	defer span.End()
+	if a.requireUser(ctx, senderClient) {
+		a.sendUserDevices(ctx, senderClient)
+	}
+}
+
+// sendUserDevices - Sends client the devices of its user. Caller must hold a.mu.
+func (a *App) sendUserDevices(ctx context.Context, client Client) {
+	user, _ := a.accounts.user(client.userID)
+	online := a.onlineDevices(user.ID)
+	devicesMsg := UserDevicesMsg{Type: "UserDevices", UserID: user.ID, Devices: []UserDevice{}}
+	for _, device := range user.Devices {
+		devicesMsg.Devices = append(devicesMsg.Devices, UserDevice{
+			ID:       device.ID,
+			Name:     device.Name,
+			LinkedAt: device.LinkedAt,
+			ClientID: online[device.ID].ID,
+		})
+	}
+	client.transport.Send(ctx, devicesMsg)
+}
+
+// onlineDevices - Connected clients of userID keyed by device ID. Caller must hold a.mu.
+func (a *App) onlineDevices(userID string) map[string]Client {
+	online := map[string]Client{}
+	for _, client := range a.ClientMap {
+		if client.userID == userID && client.deviceID != "" {
+			online[client.deviceID] = client
+		}
+	}
+	return online
+}
+
+// onStartSessionWithDevicesMsg - Creates a session with the sender's other connected devices,
+// without scanning their QR codes
+func (a *App) onStartSessionWithDevicesMsg(ctx context.Context, senderClient Client, msg StartSessionWithDevicesMsg) {
+	ctx, span := a.tracer.Start(ctx, "onStartSessionWithDevicesMsg")
+	defer span.End()
+	if !a.requireUser(ctx, senderClient) {
+		return
+	}
+	clients := []Client{}
+	for deviceID, client := range a.onlineDevices(senderClient.userID) {
+		if client.ID != senderClient.ID && (len(msg.DeviceIDs) == 0 || contains(msg.DeviceIDs, deviceID)) {
+			clients = append(clients, client)
+		}
+	}
+	a.startSessionWith(ctx, senderClient, clients)
+}
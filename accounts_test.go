@@ -0,0 +1,205 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SetupAccountsWsServer - Serves an app keeping accounts in accountsPath, with passwords hashed
+// at the lowest cost so tests stay fast
+func SetupAccountsWsServer(t *testing.T, accountsPath string) string {
+	app := &App{}
+	_, wsUrl := StartTestApp(t, app, func(config *Config) {
+		config.AccountsBackend = "file"
+		config.AccountsPath = accountsPath
+	})
+	app.accounts.hashCost = bcrypt.MinCost
+	return wsUrl
+}
+
+func Test_linked_devices_can_start_a_session_without_scanning(t *testing.T) {
+	wsUrl := SetupAccountsWsServer(t, filepath.Join(t.TempDir(), "accounts.json"))
+
+	phone, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(phone)
+	phone.WriteJSON(RegisterMsg{Type: "Register", Username: "Ada", Password: "correct horse", DeviceName: "Phone"})
+	var phoneLinkedMsg DeviceLinkedMsg
+	phone.ReadJSON(&phoneLinkedMsg)
+	if phoneLinkedMsg.Type != "DeviceLinked" || phoneLinkedMsg.Username != "ada" || phoneLinkedMsg.DeviceToken == "" {
+		t.Fatalf("Expected phone to be linked to new user but got %v", phoneLinkedMsg)
+	}
+
+	// The phone scans the laptop's QR code to link it
+	laptop, laptopConnectMsg := ConnectClient(t, wsUrl)
+	phone.WriteJSON(LinkDeviceMsg{Type: "LinkDevice", ClientID: laptopConnectMsg.Client.ID, LinkCode: laptopConnectMsg.LinkCode, DeviceName: "Laptop"})
+	var laptopLinkedMsg DeviceLinkedMsg
+	laptop.ReadJSON(&laptopLinkedMsg)
+	if laptopLinkedMsg.UserID != phoneLinkedMsg.UserID {
+		t.Fatalf("Expected laptop to be linked to the phone's user but got %v", laptopLinkedMsg)
+	}
+	var devicesMsg UserDevicesMsg
+	phone.ReadJSON(&devicesMsg)
+	if len(devicesMsg.Devices) != 2 || devicesMsg.Devices[1].Name != "Laptop" || devicesMsg.Devices[1].ClientID != laptopConnectMsg.Client.ID {
+		t.Fatalf("Expected phone and laptop to be listed but got %v", devicesMsg)
+	}
+
+	// The laptop comes back later as a new client signed in with its device token
+	CloseWithCloseMessage(laptop)
+	laptop, laptopConnectMsg = ConnectClient(t, wsUrl+"?deviceToken="+laptopLinkedMsg.DeviceToken)
+	defer CloseWithCloseMessage(laptop)
+	if laptopConnectMsg.UserID != phoneLinkedMsg.UserID || laptopConnectMsg.DeviceID != laptopLinkedMsg.DeviceID {
+		t.Fatalf("Expected laptop to be signed in but got %v", laptopConnectMsg)
+	}
+
+	phone.WriteJSON(StartSessionWithDevicesMsg{Type: "StartSessionWithDevices"})
+	var phoneJoinMsg, laptopAddedMsg, laptopJoinMsg ClientJoinedSessionMsg
+	phone.ReadJSON(&phoneJoinMsg)
+	phone.ReadJSON(&laptopAddedMsg)
+	laptop.ReadJSON(&laptopJoinMsg)
+	if laptopAddedMsg.ClientID != laptopConnectMsg.Client.ID || laptopJoinMsg.SessionID != phoneJoinMsg.SessionID {
+		t.Fatalf("Expected laptop to join the phone's new session but got %v and %v", laptopAddedMsg, laptopJoinMsg)
+	}
+}
+
+func Test_devices_can_only_be_linked_with_their_link_code(t *testing.T) {
+	wsUrl := SetupAccountsWsServer(t, filepath.Join(t.TempDir(), "accounts.json"))
+	phone, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(phone)
+	phone.WriteJSON(RegisterMsg{Type: "Register", Username: "ada", Password: "correct horse"})
+	var linkedMsg DeviceLinkedMsg
+	phone.ReadJSON(&linkedMsg)
+	tablet, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(tablet)
+	tablet.WriteJSON(RegisterMsg{Type: "Register", Username: "grace", Password: "hunter2hunter2"})
+	tablet.ReadJSON(&linkedMsg)
+
+	laptop, laptopConnectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(laptop)
+	phone.WriteJSON(LinkDeviceMsg{Type: "LinkDevice", ClientID: laptopConnectMsg.Client.ID, LinkCode: "guessed"})
+	var errMsg ErrorMsg
+	phone.ReadJSON(&errMsg)
+	if errMsg.Code != errInvalidLinkCode {
+		t.Fatalf("Expected link without the code to be refused but got %v", errMsg)
+	}
+
+	// Each code links once, so the laptop can't be moved to another user with it
+	tablet.WriteJSON(LinkDeviceMsg{Type: "LinkDevice", ClientID: laptopConnectMsg.Client.ID, LinkCode: laptopConnectMsg.LinkCode})
+	var laptopLinkedMsg DeviceLinkedMsg
+	laptop.ReadJSON(&laptopLinkedMsg)
+	if laptopLinkedMsg.Type != "DeviceLinked" {
+		t.Fatalf("Expected laptop to be linked to grace but got %v", laptopLinkedMsg)
+	}
+	phone.WriteJSON(LinkDeviceMsg{Type: "LinkDevice", ClientID: laptopConnectMsg.Client.ID, LinkCode: laptopConnectMsg.LinkCode})
+	phone.ReadJSON(&errMsg)
+	if errMsg.Code != errInvalidLinkCode {
+		t.Fatalf("Expected used link code to be refused but got %v", errMsg)
+	}
+
+	// Signed in devices get a new code but can't be linked again
+	CloseWithCloseMessage(laptop)
+	laptop, laptopConnectMsg = ConnectClient(t, wsUrl+"?deviceToken="+laptopLinkedMsg.DeviceToken)
+	defer CloseWithCloseMessage(laptop)
+	phone.WriteJSON(LinkDeviceMsg{Type: "LinkDevice", ClientID: laptopConnectMsg.Client.ID, LinkCode: laptopConnectMsg.LinkCode})
+	phone.ReadJSON(&errMsg)
+	if errMsg.Code != errAlreadyLinked {
+		t.Fatalf("Expected device linked to another user to be refused but got %v", errMsg)
+	}
+}
+
+func Test_accounts_are_kept_across_restarts(t *testing.T) {
+	accountsPath := filepath.Join(t.TempDir(), "accounts.json")
+	wsUrl := SetupAccountsWsServer(t, accountsPath)
+	ws, _ := ConnectClient(t, wsUrl)
+	ws.WriteJSON(RegisterMsg{Type: "Register", Username: "grace", Password: "hunter2hunter2"})
+	var linkedMsg DeviceLinkedMsg
+	ws.ReadJSON(&linkedMsg)
+	ws.WriteJSON(RegisterMsg{Type: "Register", Username: "GRACE", Password: "hunter2hunter2"})
+	var errMsg ErrorMsg
+	ws.ReadJSON(&errMsg)
+	if errMsg.Code != errUsernameTaken {
+		t.Fatalf("Expected usernames to be case insensitive but got %v", errMsg)
+	}
+	CloseWithCloseMessage(ws)
+
+	wsUrl = SetupAccountsWsServer(t, accountsPath)
+	ws, connectMsg := ConnectClient(t, wsUrl+"?deviceToken="+linkedMsg.DeviceToken)
+	defer CloseWithCloseMessage(ws)
+	if connectMsg.UserID != linkedMsg.UserID {
+		t.Fatalf("Expected device token to still sign in after restart but got %v", connectMsg)
+	}
+	ws.WriteJSON(LoginMsg{Type: "Login", Username: "grace", Password: "wrong password"})
+	ws.ReadJSON(&errMsg)
+	if errMsg.Code != errInvalidCredentials {
+		t.Fatalf("Expected wrong password to be refused but got %v", errMsg)
+	}
+	ws.WriteJSON(LoginMsg{Type: "Login", Username: "grace", Password: "hunter2hunter2"})
+	ws.ReadJSON(&linkedMsg)
+	if linkedMsg.Type != "DeviceLinked" || linkedMsg.Username != "grace" {
+		t.Fatalf("Expected login after restart but got %v", linkedMsg)
+	}
+}
+
+func Test_logging_in_again_keeps_one_device(t *testing.T) {
+	wsUrl := SetupAccountsWsServer(t, filepath.Join(t.TempDir(), "accounts.json"))
+	other, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(other)
+	other.WriteJSON(RegisterMsg{Type: "Register", Username: "grace", Password: "hunter2hunter2"})
+	var graceLinkedMsg DeviceLinkedMsg
+	other.ReadJSON(&graceLinkedMsg)
+
+	ws, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+	ws.WriteJSON(RegisterMsg{Type: "Register", Username: "ada", Password: "correct horse", DeviceName: "Phone"})
+	var firstLinkedMsg, secondLinkedMsg DeviceLinkedMsg
+	ws.ReadJSON(&firstLinkedMsg)
+	ws.WriteJSON(LoginMsg{Type: "Login", Username: "ada", Password: "correct horse"})
+	ws.ReadJSON(&secondLinkedMsg)
+	if secondLinkedMsg.DeviceID != firstLinkedMsg.DeviceID || secondLinkedMsg.DeviceToken == firstLinkedMsg.DeviceToken {
+		t.Fatalf("Expected the same device with a new token but got %v after %v", secondLinkedMsg, firstLinkedMsg)
+	}
+	ws.WriteJSON(ListDevicesMsg{Type: "ListDevices"})
+	var devicesMsg UserDevicesMsg
+	ws.ReadJSON(&devicesMsg)
+	if len(devicesMsg.Devices) != 1 || devicesMsg.Devices[0].Name != "Phone" {
+		t.Fatalf("Expected one device after logging in twice but got %v", devicesMsg)
+	}
+
+	// Logging in as another user moves the device instead of leaving it linked to both
+	ws.WriteJSON(LoginMsg{Type: "Login", Username: "grace", Password: "hunter2hunter2"})
+	ws.ReadJSON(&secondLinkedMsg)
+	other.WriteJSON(ListDevicesMsg{Type: "ListDevices"})
+	other.ReadJSON(&devicesMsg)
+	if len(devicesMsg.Devices) != 2 {
+		t.Fatalf("Expected grace to have two devices but got %v", devicesMsg)
+	}
+	ws.WriteJSON(LoginMsg{Type: "Login", Username: "ada", Password: "correct horse"})
+	ws.ReadJSON(&secondLinkedMsg)
+	ws.WriteJSON(ListDevicesMsg{Type: "ListDevices"})
+	ws.ReadJSON(&devicesMsg)
+	if len(devicesMsg.Devices) != 1 || devicesMsg.Devices[0].ID == firstLinkedMsg.DeviceID {
+		t.Fatalf("Expected ada to only have the newly linked device but got %v", devicesMsg)
+	}
+}
+
+func Test_account_messages_need_accounts_enabled_and_a_signed_in_device(t *testing.T) {
+	testServer, wsUrl := SetupWsServer(t)
+	defer testServer.Close()
+	ws, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+	ws.WriteJSON(LoginMsg{Type: "Login", Username: "ada", Password: "correct horse"})
+	var errMsg ErrorMsg
+	ws.ReadJSON(&errMsg)
+	if errMsg.Code != errAccountsDisabled {
+		t.Fatalf("Expected accounts to be disabled by default but got %v", errMsg)
+	}
+
+	ws, _ = ConnectClient(t, SetupAccountsWsServer(t, filepath.Join(t.TempDir(), "accounts.json")))
+	defer CloseWithCloseMessage(ws)
+	ws.WriteJSON(ListDevicesMsg{Type: "ListDevices"})
+	ws.ReadJSON(&errMsg)
+	if errMsg.Code != errNotLoggedIn {
+		t.Fatalf("Expected anonymous client to be refused but got %v", errMsg)
+	}
+}
@@ -1,46 +1,163 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // App Stores the state of our web server
 type App struct {
 	QRIDCounter int
 	Router      *mux.Router
+	Config      *Config
 	// TODO: Potentially move to external data store
 	ClientMap  map[string]Client
 	SessionMap map[string]Session
-}
-
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	// Guards ClientMap, SessionMap and QRIDCounter
+	mu    sync.Mutex
+	store Store
+	// Snapshots taken under mu are saved in order after it is released, savedSeq is guarded by saveMu
+	saveMu   sync.Mutex
+	stateSeq int
+	savedSeq int
+	saves    sync.WaitGroup
+	server   *http.Server
+	metrics  *appMetrics
+	// Level can be changed at runtime through the admin API
+	logLevel *slog.LevelVar
+	logger   *slog.Logger
+	tracer   trace.Tracer
+	// Flushes spans to the trace exporter
+	stopTracing func(context.Context) error
+	webhooks    *webhookDispatcher
+	// Connects this node to the rest of the cluster, nil when running a single node
+	backplane Backplane
+	// Clients connected to other nodes of the cluster
+	remoteClients map[string]Client
+	// Live nodes and session owners, nil unless routing sessions by hash
+	membership *membership
+	// Connections and message rate limits per client IP
+	ipLimits map[string]*ipLimits
+	// Prefixed to client and session IDs so they are unique across the cluster
+	idPrefix string
+	// User accounts devices can sign in to, nil when accounts are disabled
+	accounts *accountStore
+	// Devices given long lived credentials when paired, keyed by ID, and the pairings between them
+	trustedDevices map[string]TrustedDevice
+	pairings       []DevicePairing
+	// Pairings offered by session owners that the added client hasn't accepted yet, by request ID
+	pairRequests map[string]pairRequest
+	// Verifies bearer tokens clients connect with, nil when no issuers are configured
+	jwt *jwtVerifier
+	// Browser origins allowed to use the API
+	origins  *originPolicy
+	upgrader websocket.Upgrader
+	// Set once shutdown has started, new websocket upgrades are refused
+	draining atomic.Bool
 }
 
 // Init - Initialises app
 func (a *App) Init() {
+	if a.Config == nil {
+		a.Config = DefaultConfig()
+	}
 	a.QRIDCounter = 0
 	a.Router = mux.NewRouter()
 	a.ClientMap = make(map[string]Client)
 	a.SessionMap = make(map[string]Session)
-	a.Router.HandleFunc("/api/v1/ws", a.serveWs)
+	a.remoteClients = make(map[string]Client)
+	a.ipLimits = make(map[string]*ipLimits)
+	a.trustedDevices = make(map[string]TrustedDevice)
+	a.pairRequests = make(map[string]pairRequest)
+	a.logLevel = new(slog.LevelVar)
+	a.logLevel.UnmarshalText([]byte(a.Config.LogLevel))
+	a.logger = newLogger(os.Stderr, a.logLevel, a.Config.LogFormat)
+	tracerProvider, stopTracing, err := newTracerProvider(a.Config)
+	if err != nil {
+		a.logger.Error("Could not start tracing", "err", err)
+		tracerProvider, stopTracing, _ = newTracerProvider(&Config{TraceExporter: "none"})
+	}
+	a.tracer = tracerProvider.Tracer(tracerName)
+	a.stopTracing = stopTracing
+	a.metrics = newAppMetrics(a)
+	if a.origins, err = newOriginPolicy(a.Config.CORSOrigins, a.Config.DevMode); err != nil {
+		a.logger.Error("Invalid origins, only allowing pages served by this host", "err", err)
+		a.origins, _ = newOriginPolicy(nil, false)
+	}
+	a.upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     a.originAllowed,
+	}
+	a.webhooks = newWebhookDispatcher(a.Config, a.logger, a.metrics)
+	if a.backplane == nil {
+		if a.backplane, err = newBackplane(a.Config, a.logger); err != nil {
+			a.logger.Error("Could not connect to backplane, running as a single node", "err", err)
+		}
+	}
+	if a.clustered() {
+		if a.Config.NodeID == "" {
+			a.Config.NodeID = newToken()[:8]
+		}
+		a.idPrefix = a.Config.NodeID + "-"
+		if err := a.joinCluster(); err != nil {
+			a.logger.Error("Could not subscribe to backplane", "err", err)
+		}
+		if a.Config.SessionRouting == "hash" {
+			if err := a.startHashRouting(); err != nil {
+				a.logger.Error("Could not join cluster membership", "err", err)
+			}
+		}
+	}
+	if a.Config.AccountsBackend != "none" {
+		if a.accounts, err = newAccountStore(a.Config); err != nil {
+			a.logger.Error("Could not load user accounts, accounts are disabled", "err", err)
+		}
+	}
+	if len(a.Config.OIDCIssuers) > 0 {
+		a.jwt = newJWTVerifier(a.Config.OIDCIssuers)
+	}
+	a.store = newStore(a.Config)
+	if state, err := a.store.Load(); err != nil {
+		a.logger.Error("Could not load stored state", "err", err)
+	} else if state != nil {
+		a.restoreState(state)
+	}
+	a.Router.HandleFunc("/api/v1/ws", a.routeSession(a.authenticateConnection(a.serveWs)))
+	a.Router.HandleFunc("/api/v1/events", a.routeSession(a.authenticateConnection(a.serveEvents))).Methods(http.MethodGet)
+	a.Router.HandleFunc("/api/v1/messages", a.routeClient(a.postMessage)).Methods(http.MethodPost)
+	a.Router.HandleFunc("/api/v1/poll/connect", a.routeSession(a.authenticateConnection(a.pollConnect))).Methods(http.MethodPost)
+	a.Router.HandleFunc("/api/v1/poll", a.routeClient(a.poll)).Methods(http.MethodGet)
 
 	// @TODO Secure with an admin password
 	a.Router.HandleFunc("/api/v1/clients", a.getClients)
 	a.Router.HandleFunc("/api/v1/sessions", a.getSessions)
+	a.Router.HandleFunc("/api/v1/sessions/{id}", a.routeSessionPath(a.integrationGetSession)).Methods(http.MethodGet)
+	a.Router.HandleFunc("/api/v1/sessions/{id}/broadcast", a.routeSessionPath(a.integrationBroadcast)).Methods(http.MethodPost)
+	a.Router.HandleFunc("/api/v1/clients/{id}/messages", a.routeClientPath(a.integrationSendToClient)).Methods(http.MethodPost)
+	a.Router.Handle("/metrics", a.metrics.handler())
+	a.Router.HandleFunc("/healthz", a.getHealthz)
+	a.Router.HandleFunc("/readyz", a.getReadyz)
+	a.Router.HandleFunc("/version", a.getVersion)
+	a.Router.HandleFunc("/api/v1/admin/log-level", a.requireAdmin(a.adminLogLevel)).Methods(http.MethodGet, http.MethodPut)
 }
 
 func (a *App) newClientId() int {
@@ -51,33 +168,67 @@ func (a *App) newClientId() int {
 	return a.QRIDCounter
 }
 
-func (a *App) createClient(r *http.Request, conn *websocket.Conn) Client {
-	newClientID := fmt.Sprint(a.newClientId())
+func (a *App) createClient(r *http.Request, transport Transport) Client {
+	newClientID := a.idPrefix + fmt.Sprint(a.newClientId())
 
-	/* Allow client to reconnect with old id */
+	/* Allow client to reconnect with old id if it proves it is the member of a session */
 	rejoinClientID := r.URL.Query().Get("clientId")
-	if len(rejoinClientID) > 0 {
-		if _, alreadyConnected := a.ClientMap[rejoinClientID]; !alreadyConnected {
-			newClientID = rejoinClientID
-		}
+	rejoinToken := r.URL.Query().Get("rejoinToken")
+	rejoinSession, canRejoin := a.rejoinSession(rejoinClientID, rejoinToken)
+	if canRejoin {
+		newClientID = rejoinClientID
 	}
 
-	fmt.Println("Connection from ", r.RemoteAddr)
-
 	client := Client{
-		ID:           newClientID,
-		conn:         conn,
-		LastJoinTime: time.Now(),
+		ID:             newClientID,
+		transport:      transport,
+		LastJoinTime:   time.Now(),
+		UserAgent:      truncate(r.UserAgent(), maxUserAgentLength),
+		Presence:       PresenceActive,
+		PresenceSince:  time.Now(),
+		LastActivity:   time.Now(),
+		ClipboardSync:  true,
+		transportToken: newToken(),
+		linkCode:       newToken(),
+		remoteIP:       a.clientIP(r),
+		limits:         newClientLimits(a.Config.Limits, time.Now()),
+	}
+
+	/* Rejoin the session the client was in before the server restarted */
+	if canRejoin {
+		client.activeSessionID = rejoinSession.ID
+		client.transportToken = rejoinToken
+	}
+
+	/* Clients that connected with a bearer token are the user it identifies */
+	if id, ok := identityFromContext(r.Context()); ok {
+		client.identity = id.ID()
+		client.Name = id.Name
+	}
+
+	/* Devices linked to a user sign in with the token they were given when linked */
+	a.signInDevice(&client, r.URL.Query().Get("deviceToken"))
+
+	/* Paired devices reconnect with the credential they were given when first trusted */
+	a.signInTrustedDevice(&client, r.URL.Query().Get("trustedDeviceToken"))
+
+	/* Clients using end to end encryption can publish their key when connecting */
+	if publicKey := r.URL.Query().Get("publicKey"); validatePublicKey(publicKey) == nil {
+		client.PublicKey = publicKey
 	}
 	return client
 }
 
 func (a *App) getClients(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	res, _ := json.MarshalIndent(a.ClientMap, "\n", "  ")
 	w.Write(res)
 }
 
 func (a *App) getSessions(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	res, _ := json.MarshalIndent(a.SessionMap, "\n", "  ")
 	w.Write(res)
 }
@@ -86,7 +237,9 @@ func (a *App) getSessionClientMap(sessionID string) map[string]Client {
 	if session, ok := a.SessionMap[sessionID]; ok {
 		sessionClientMap := make(map[string]Client, len(session.ClientIDs))
 		for _, clientID := range session.ClientIDs {
-			sessionClientMap[clientID] = a.ClientMap[clientID]
+			if client, connected := a.lookupClient(clientID); connected {
+				sessionClientMap[clientID] = client
+			}
 		}
 		return sessionClientMap
 	}
@@ -94,177 +247,658 @@ func (a *App) getSessionClientMap(sessionID string) map[string]Client {
 }
 
 func (a *App) MainHandler() http.Handler {
-	return handlers.CORS()(a.Router)
+	return a.refuseOrigins(handlers.CORS(
+		handlers.AllowedOriginValidator(a.origins.allows),
+		handlers.AllowedMethods([]string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut}),
+		handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}),
+	)(a.Router))
+}
+
+// Listen Starts the app listening on the configured address.
+// Returns http.ErrServerClosed once Shutdown has been called.
+func (a *App) Listen() error {
+	a.logger.Info("Starting server", "addr", a.Config.ListenAddr, "tls", a.Config.UseTLS())
+	a.server = &http.Server{
+		Addr:    a.Config.ListenAddr,
+		Handler: a.MainHandler(),
+	}
+	if a.Config.UseTLS() {
+		return a.server.ListenAndServeTLS(a.Config.TLSCertFile, a.Config.TLSKeyFile)
+	}
+	return a.server.ListenAndServe()
 }
 
-// ListenOnPort Starts the app listening on the provided port
-func (a *App) ListenOnPort(port int, useSSL bool) error {
-	fmt.Println("Starting server on port ", port, " use ssl ", useSSL)
-	if useSSL {
-		return http.ListenAndServeTLS(fmt.Sprint(":", port), "ssl/server.crt", "ssl/server.key", a.MainHandler())
+// Shutdown - Stops accepting websockets, tells connected clients to reconnect later,
+// flushes their queued messages and saves state. Gives up waiting for clients when ctx is done.
+func (a *App) Shutdown(ctx context.Context) error {
+	a.draining.Store(true)
+	if a.hashRouting() {
+		// Hands this node's sessions to the remaining nodes
+		a.membership.leave()
+	}
+
+	a.mu.Lock()
+	shuttingDownMsg := ServerShuttingDownMsg{
+		Type:             "ServerShuttingDown",
+		Message:          "Server is restarting",
+		ReconnectAfterMs: a.Config.ReconnectAfter.Milliseconds(),
+	}
+	transports := make([]Transport, 0, len(a.ClientMap))
+	for _, client := range a.ClientMap {
+		client.transport.Send(ctx, shuttingDownMsg)
+		client.transport.CloseWithReason(websocket.CloseGoingAway, "Server shutting down")
+		transports = append(transports, client.transport)
+	}
+	a.mu.Unlock()
+
+	for _, transport := range transports {
+		select {
+		case <-transport.Done():
+		case <-ctx.Done():
+		}
+	}
+
+	a.mu.Lock()
+	state, seq := a.snapshotState()
+	a.mu.Unlock()
+	a.saves.Wait()
+	err := a.saveState(state, seq)
+	if err != nil {
+		a.logger.Error("Could not save state", "err", err)
+	}
+
+	a.webhooks.Close(ctx)
+	if a.clustered() {
+		a.backplane.Close()
 	}
-	return http.ListenAndServe(fmt.Sprint(":", port), a.MainHandler())
+	a.stopTracing(ctx)
+
+	if a.server != nil {
+		if shutdownErr := a.server.Shutdown(ctx); shutdownErr != nil {
+			return shutdownErr
+		}
+	}
+	return err
 }
 
 func (a *App) serveWs(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Connection from ", r.RemoteAddr)
-	conn, err := upgrader.Upgrade(w, r, nil)
+	a.logger.Info("Websocket connecting", "remoteAddr", r.RemoteAddr)
+	if a.draining.Load() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if a.refuseConnection(w, r) {
+		return
+	}
+	ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, upgradeSpan := a.tracer.Start(ctx, "websocket.upgrade")
+	ws, err := a.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
+		a.metrics.upgradeFailures.Inc()
+		a.logger.Warn("Websocket upgrade failed", "remoteAddr", r.RemoteAddr, "err", err)
+		upgradeSpan.RecordError(err)
+		upgradeSpan.SetStatus(codes.Error, "upgrade failed")
+		upgradeSpan.End()
+		a.cancelConnection(r)
 		return
 	}
 
+	ws.SetReadLimit(a.Config.MaxMessageBytes)
+	conn := newClientConn(&wsWriter{ws: ws}, a.metrics, a.tracer)
+	client := a.connectClient(ctx, r, conn)
+	upgradeSpan.SetAttributes(attribute.String("qrsync.client_id", client.ID))
+	upgradeSpan.End()
+	logger := a.logger.With("clientId", client.ID, "remoteAddr", r.RemoteAddr, "transport", "websocket")
+	logger.Info("Client connected")
+	defer a.disconnectClient(ctx, logger, client.ID)
+
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			logger.Debug("Read failed", "err", err)
+			break
+		}
+		a.handleMessage(logger, client.ID, message)
+	}
+}
+
+// connectClient - Registers a new client using transport and sends it the ClientConnect message
+func (a *App) connectClient(ctx context.Context, r *http.Request, transport Transport) Client {
+	a.mu.Lock()
 	a.removeOldClients()
+	a.removeOldSessions()
+	a.removeIdleIPs()
 
-	client := a.createClient(r, conn)
+	client := a.createClient(r, transport)
 
 	a.ClientMap[client.ID] = client
-	conn.SetCloseHandler(func(_ int, _ string) error {
-		fmt.Println("Connection closed ", r.RemoteAddr)
-		fmt.Println("Informing session that client left, id ", client.ID)
-		for _, otherClient := range a.getSessionClientMap(client.activeSessionID) {
-			if otherClient.ID != client.ID {
-				sessionOwnerID := ""
-				if session, ok := a.SessionMap[sessionOwnerID]; ok {
-					sessionOwnerID = session.OwnerID
-					session.ClientIDs = filter(session.ClientIDs, func(ID string) bool {
-						return client.ID == ID
-					})
-					a.SessionMap[session.ID] = session
-				}
-				clientLeftMsg := ClientLeftSessionMsg{
-					Type:           "ClientLeftSession",
-					ClientID:       client.ID,
-					SessionID:      client.activeSessionID,
-					SessionOwnerID: sessionOwnerID,
-					ClientMap:      a.getSessionClientMap(client.activeSessionID),
-				}
-				otherClient.conn.WriteJSON(clientLeftMsg)
-			}
-		}
-		delete(a.ClientMap, client.ID)
-		return nil
-	})
+	a.announceClient(client)
 	connectMsg := ClientConnectMsg{
-		Type:   "ClientConnect",
-		Client: client,
+		Type:            "ClientConnect",
+		Client:          client,
+		TransportToken:  client.transportToken,
+		Identity:        client.identity,
+		UserID:          client.userID,
+		DeviceID:        client.deviceID,
+		TrustedDeviceID: client.trustedDeviceID,
+		LinkCode:        client.linkCode,
 	}
-	conn.WriteJSON(connectMsg)
-	for {
-		_, message, err := conn.ReadMessage()
-		if err != nil {
-			fmt.Println(err)
-			break
+	transport.Send(ctx, connectMsg)
+	// Clients rejoining a session, e.g. after it moved to another node, are sent its state again
+	if session, rejoined := a.SessionMap[client.activeSessionID]; rejoined {
+		a.welcomeToSession(ctx, session, client, a.newClientJoinedSessionMsg(session, client.ID))
+	}
+	a.mu.Unlock()
+	return client
+}
+
+// disconnectClient - Removes a client whose connection has ended
+func (a *App) disconnectClient(ctx context.Context, logger *slog.Logger, clientID string) {
+	a.mu.Lock()
+	client, connected := a.ClientMap[clientID]
+	if !connected {
+		a.mu.Unlock()
+		return
+	}
+	logger.Info("Connection closed", "sessionId", client.activeSessionID)
+	// Keep session membership while draining so clients can rejoin after the restart
+	if _, inSession := a.SessionMap[client.activeSessionID]; inSession && !a.draining.Load() {
+		a.webhooks.Publish(WebhookEvent{Type: WebhookClientLeft, SessionID: client.activeSessionID, ClientID: client.ID})
+	}
+	if !a.draining.Load() {
+		logger.Debug("Informing session that client left")
+		a.removeClientFromSession(ctx, client)
+	}
+	delete(a.ClientMap, clientID)
+	a.removeConnection(client.remoteIP)
+	a.announceClientGone(clientID)
+	a.mu.Unlock()
+	client.transport.Close()
+}
+
+// handleMessage - Decodes a message from a client and passes it to the handler for its type.
+// Used by every transport.
+func (a *App) handleMessage(logger *slog.Logger, clientID string, message []byte) {
+	a.metrics.bytesIn.Add(float64(len(message)))
+	msgType := gjson.GetBytes(message, "type").String()
+	a.metrics.messagesIn.WithLabelValues(msgTypeLabel(msgType)).Inc()
+	// Clients can send trace context in the message to link their traces to ours
+	ctx := tracePropagator.Extract(context.Background(), messageCarrier{
+		"traceparent": gjson.GetBytes(message, "traceparent").String(),
+		"tracestate":  gjson.GetBytes(message, "tracestate").String(),
+	})
+	ctx, span := a.tracer.Start(ctx, "message "+msgType, trace.WithAttributes(
+		attribute.String("qrsync.client_id", clientID),
+		attribute.String("qrsync.message_type", msgType),
+		attribute.Int("qrsync.message_bytes", len(message)),
+	))
+	defer span.End()
+	a.mu.Lock()
+	senderClient, connected := a.ClientMap[clientID]
+	if !connected {
+		a.mu.Unlock()
+		return
+	}
+	// Bodies contain user content so are only logged at debug level
+	if credentialMsgTypes[msgType] {
+		a.clientLogger(senderClient).Debug("Message received", "type", msgType)
+	} else {
+		a.clientLogger(senderClient).Debug("Message received", "type", msgType, "body", string(message))
+	}
+	if !a.allowMessage(ctx, senderClient, msgType) {
+		a.mu.Unlock()
+		return
+	}
+	if ingressErr := a.checkInbound(msgType, message); ingressErr != nil {
+		a.rejectMessage(ctx, senderClient, ingressErr)
+		a.mu.Unlock()
+		return
+	}
+	senderClient = a.recordActivity(senderClient)
+	handleStart := time.Now()
+	var err error
+	switch msgType {
+	case "UpdateClient":
+		msg := UpdateClientMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onUpdateClientMsg(ctx, senderClient, msg)
 		}
-		fmt.Println("We got a message!")
-		fmt.Println(string(message))
-		typeJSONValue := gjson.GetBytes(message, "type")
-		if !typeJSONValue.Exists() {
-			fmt.Println("No message type")
-		} else {
-			senderClient := a.ClientMap[client.ID]
-			msgType := typeJSONValue.String()
-			fmt.Println("Message type =", msgType)
-			switch msgType {
-			case "UpdateClient":
-				msg := UpdateClientMsg{}
-				json.Unmarshal(message, &msg)
-				a.onUpdateClientMsg(senderClient, msg)
-			case "CreateSession":
-				msg := CreateSessionMsg{}
-				json.Unmarshal(message, &msg)
-				a.onCreateSessionMsg(client, msg)
-			case "AddClientToSession":
-				msg := AddClientToSessionMsg{}
-				json.Unmarshal(message, &msg)
-				a.onAddClientToSessionMsg(senderClient, msg, true)
-			case "BroadcastToSession":
-				msg := BroadcastToSessionMsg{}
-				json.Unmarshal(message, &msg)
-				a.onBroadcastToSessionMsg(senderClient, msg)
-			}
+	case "CreateSession":
+		msg := CreateSessionMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onCreateSessionMsg(ctx, senderClient, msg)
+		}
+	case "AddClientToSession":
+		msg := AddClientToSessionMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onAddClientToSessionMsg(ctx, senderClient, msg, true)
+		}
+	case "BroadcastToSession":
+		msg := BroadcastToSessionMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onBroadcastToSessionMsg(ctx, senderClient, msg)
+		}
+	case "UpdateNote":
+		msg := UpdateNoteMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onUpdateNoteMsg(ctx, senderClient, msg)
+		}
+	case "SetClipboard":
+		msg := SetClipboardMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onSetClipboardMsg(ctx, senderClient, msg)
 		}
+	case "RtcOffer":
+		msg := RtcOfferMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onRtcOfferMsg(ctx, senderClient, msg)
+		}
+	case "RtcAnswer":
+		msg := RtcAnswerMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onRtcAnswerMsg(ctx, senderClient, msg)
+		}
+	case "RtcIceCandidate":
+		msg := RtcIceCandidateMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onRtcIceCandidateMsg(ctx, senderClient, msg)
+		}
+	case "PublishKey":
+		msg := PublishKeyMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onPublishKeyMsg(ctx, senderClient, msg)
+		}
+	case "SendEncrypted":
+		msg := SendEncryptedMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onSendEncryptedMsg(ctx, senderClient, msg)
+		}
+	case "Register":
+		msg := RegisterMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onRegisterMsg(ctx, senderClient, msg)
+		}
+	case "Login":
+		msg := LoginMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onLoginMsg(ctx, senderClient, msg)
+		}
+	case "LinkDevice":
+		msg := LinkDeviceMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onLinkDeviceMsg(ctx, senderClient, msg)
+		}
+	case "UnlinkDevice":
+		msg := UnlinkDeviceMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onUnlinkDeviceMsg(ctx, senderClient, msg)
+		}
+	case "ListDevices":
+		msg := ListDevicesMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onListDevicesMsg(ctx, senderClient, msg)
+		}
+	case "StartSessionWithDevices":
+		msg := StartSessionWithDevicesMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onStartSessionWithDevicesMsg(ctx, senderClient, msg)
+		}
+	case "InviteTrustedDevice":
+		msg := InviteTrustedDeviceMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onInviteTrustedDeviceMsg(ctx, senderClient, msg)
+		}
+	case "ListTrustedDevices":
+		msg := ListTrustedDevicesMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onListTrustedDevicesMsg(ctx, senderClient, msg)
+		}
+	case "RevokeTrustedDevice":
+		msg := RevokeTrustedDeviceMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onRevokeTrustedDeviceMsg(ctx, senderClient, msg)
+		}
+	case "PairAccept":
+		msg := PairAcceptMsg{}
+		if err = a.decodeMsg(ctx, message, &msg); err == nil {
+			a.onPairAcceptMsg(ctx, senderClient, msg)
+		}
+	}
+	// The schema should catch anything encoding/json rejects, but never pass a half decoded message on
+	if err != nil {
+		a.rejectMessage(ctx, senderClient, &ingressError{Code: errInvalidMessage, Message: "Invalid " + msgType + ": " + err.Error()})
+	}
+	a.mu.Unlock()
+	a.metrics.handlerDuration.WithLabelValues(msgTypeLabel(msgType)).Observe(time.Since(handleStart).Seconds())
+}
+
+// rejectMessage - Tells client why its message was not handled. Caller must hold a.mu.
+func (a *App) rejectMessage(ctx context.Context, client Client, ingressErr *ingressError) {
+	a.metrics.rejectedMessages.WithLabelValues(ingressErr.Code).Inc()
+	trace.SpanFromContext(ctx).SetStatus(codes.Error, ingressErr.Code)
+	a.clientLogger(client).Warn("Message rejected", "code", ingressErr.Code, "reason", ingressErr.Message)
+	client.transport.Send(ctx, ErrorMsg{
+		Type:    "error",
+		Code:    ingressErr.Code,
+		Message: ingressErr.Message,
+	})
+}
+
+// decodeMsg - Unmarshals a message from a client, recording failures on the trace
+func (a *App) decodeMsg(ctx context.Context, message []byte, msg interface{}) error {
+	_, span := a.tracer.Start(ctx, "decode")
+	defer span.End()
+	err := json.Unmarshal(message, msg)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "invalid json")
+	}
+	return err
+}
+
+// removeClientFromSession - Removes client from its active session and informs the remaining members
+func (a *App) removeClientFromSession(ctx context.Context, client Client) {
+	session, ok := a.SessionMap[client.activeSessionID]
+	if !ok {
+		return
+	}
+	session.ClientIDs = filter(session.ClientIDs, func(ID string) bool {
+		return client.ID != ID
+	})
+	delete(session.members, client.ID)
+	a.SessionMap[session.ID] = session
+	a.announceMembership(clusterMemberRemoved, session, client.ID)
+	clientLeftMsg := ClientLeftSessionMsg{
+		Type:           "ClientLeftSession",
+		ClientID:       client.ID,
+		SessionID:      session.ID,
+		SessionOwnerID: session.OwnerID,
+		ClientMap:      a.getSessionClientMap(session.ID),
+	}
+	for _, otherClient := range clientLeftMsg.ClientMap {
+		otherClient.transport.Send(ctx, clientLeftMsg)
+	}
+	a.rotateSessionKeys(ctx, session.ID, "")
+}
 
+// rejoinSession - Session clientID was a member of, if token is the one it was welcomed with.
+// Caller must hold a.mu.
+func (a *App) rejoinSession(clientID string, token string) (Session, bool) {
+	if clientID == "" || token == "" {
+		return Session{}, false
+	}
+	if _, alreadyConnected := a.ClientMap[clientID]; alreadyConnected {
+		return Session{}, false
+	}
+	tokenHash := hashDeviceToken(token)
+	for _, session := range a.SessionMap {
+		member, ok := session.members[clientID]
+		if ok && contains(session.ClientIDs, clientID) && subtle.ConstantTimeCompare([]byte(member.TokenHash), []byte(tokenHash)) == 1 {
+			return session, true
+		}
 	}
+	return Session{}, false
 }
 
 /*
-Removes clients that connected over 2 hours ago
+Removes clients that haven't sent a message for longer than the configured client TTL
 */
 func (a *App) removeOldClients() {
-	maxClientDuration, err := time.ParseDuration("2h")
-	if err != nil {
-		expiryTime := time.Now().Add(maxClientDuration)
-		for id, client := range a.ClientMap {
-			if client.LastJoinTime.After(expiryTime) {
-				delete(a.ClientMap, id)
-				client.conn.Close()
+	expiryTime := time.Now().Add(-a.Config.ClientTTL)
+	for id, client := range a.ClientMap {
+		if client.LastActivity.Before(expiryTime) {
+			if _, inSession := a.SessionMap[client.activeSessionID]; inSession {
+				a.webhooks.Publish(WebhookEvent{Type: WebhookClientLeft, SessionID: client.activeSessionID, ClientID: client.ID})
 			}
+			a.removeClientFromSession(context.Background(), client)
+			delete(a.ClientMap, id)
+			a.removeConnection(client.remoteIP)
+			a.announceClientGone(id)
+			client.transport.Close()
 		}
 	}
+	// Other nodes may have stopped without saying their clients left
+	for id, client := range a.remoteClients {
+		if client.LastJoinTime.Before(expiryTime) {
+			delete(a.remoteClients, id)
+		}
+	}
+	// Members kept across a restart that never came back
+	for _, session := range a.SessionMap {
+		session.ClientIDs = filter(session.ClientIDs, func(ID string) bool {
+			if _, ok := a.lookupClient(ID); ok {
+				return true
+			}
+			member, ok := session.members[ID]
+			if !ok || member.JoinedAt.Before(expiryTime) {
+				delete(session.members, ID)
+				a.webhooks.Publish(WebhookEvent{Type: WebhookClientLeft, SessionID: session.ID, ClientID: ID})
+				return false
+			}
+			return true
+		})
+		a.SessionMap[session.ID] = session
+	}
+}
 
+/*
+Removes sessions created longer ago than the configured session TTL that have no members left.
+Members that disconnected are kept until the client TTL so sessions in use are never removed.
+*/
+func (a *App) removeOldSessions() {
+	expiryTime := time.Now().Add(-a.Config.SessionTTL)
+	for id, session := range a.SessionMap {
+		if session.createdDate.Before(expiryTime) && len(session.ClientIDs) == 0 {
+			a.endSession(context.Background(), id)
+			a.replicateSession(clusterEnvelope{Kind: clusterSessionEnded, SessionID: id})
+			a.webhooks.Publish(WebhookEvent{Type: WebhookSessionEnded, SessionID: id})
+			a.logger.Info("Session expired", "sessionId", id)
+		}
+	}
 }
 
-func (a *App) onUpdateClientMsg(senderClient Client, msg UpdateClientMsg) {
-	senderClient.Name = msg.Name
-	a.ClientMap[senderClient.ID] = senderClient
+// endSession - Removes a session and tells local clients still using it. Caller must hold a.mu.
+func (a *App) endSession(ctx context.Context, sessionID string) {
+	delete(a.SessionMap, sessionID)
 	for _, client := range a.ClientMap {
-		client.conn.WriteJSON(msg)
+		if client.activeSessionID == sessionID {
+			client.activeSessionID = ""
+			a.ClientMap[client.ID] = client
+			client.transport.Send(ctx, SessionEndedMsg{Type: "SessionEnded", SessionID: sessionID})
+		}
 	}
 }
 
-func (a *App) onCreateSessionMsg(senderClient Client, msg CreateSessionMsg) {
-	a.QRIDCounter++
+func (a *App) onUpdateClientMsg(ctx context.Context, senderClient Client, msg UpdateClientMsg) {
+	ctx, span := a.tracer.Start(ctx, "onUpdateClientMsg")
+	defer span.End()
+	before := senderClient
+	if msg.Name != nil {
+		senderClient.Name = *msg.Name
+	}
+	if msg.ClipboardSync != nil {
+		senderClient.ClipboardSync = *msg.ClipboardSync
+	}
+	if msg.DeviceType != "" {
+		senderClient.DeviceType = msg.DeviceType
+	}
+	if msg.Platform != "" {
+		senderClient.Platform = msg.Platform
+	}
+	if msg.UserAgent != "" {
+		senderClient.UserAgent = truncate(msg.UserAgent, maxUserAgentLength)
+	}
+	if msg.AppVersion != "" {
+		senderClient.AppVersion = msg.AppVersion
+	}
+	a.ClientMap[senderClient.ID] = senderClient
+	if updatedMsg, changed := clientChanges(before, senderClient); changed {
+		a.sendToPeers(ctx, senderClient, updatedMsg)
+	}
+	senderClient = a.setPresence(ctx, senderClient, msg.Presence)
+	a.announceClient(senderClient)
+}
+
+// clientChanges - ClientUpdated message with the fields that differ between before and after
+func clientChanges(before Client, after Client) (ClientUpdatedMsg, bool) {
+	updatedMsg := ClientUpdatedMsg{Type: "ClientUpdated", ClientID: after.ID}
+	changed := false
+	if after.Name != before.Name {
+		updatedMsg.Name = &after.Name
+		changed = true
+	}
+	if after.ClipboardSync != before.ClipboardSync {
+		updatedMsg.ClipboardSync = &after.ClipboardSync
+		changed = true
+	}
+	if after.DeviceType != before.DeviceType {
+		updatedMsg.DeviceType = after.DeviceType
+		changed = true
+	}
+	if after.Platform != before.Platform {
+		updatedMsg.Platform = after.Platform
+		changed = true
+	}
+	if after.UserAgent != before.UserAgent {
+		updatedMsg.UserAgent = after.UserAgent
+		changed = true
+	}
+	if after.AppVersion != before.AppVersion {
+		updatedMsg.AppVersion = after.AppVersion
+		changed = true
+	}
+	return updatedMsg, changed
+}
+
+func (a *App) onCreateSessionMsg(ctx context.Context, senderClient Client, msg CreateSessionMsg) {
+	ctx, span := a.tracer.Start(ctx, "onCreateSessionMsg")
+	defer span.End()
+	if maxSessions := a.Config.Limits.MaxSessionsPerClient; maxSessions > 0 && a.ownedSessionCount(senderClient.ID) >= maxSessions {
+		a.limitExceeded(ctx, senderClient, errTooManySessions, fmt.Sprintf("Clients can own at most %d sessions", maxSessions), 0)
+		return
+	}
+	// Clients could otherwise reconnect with a new ID to create more sessions
+	if maxSessions := a.Config.Limits.MaxSessionsPerIP; maxSessions > 0 && a.ipSessionCount(senderClient.remoteIP) >= maxSessions {
+		a.limitExceeded(ctx, senderClient, errTooManySessions, fmt.Sprintf("At most %d sessions can be created from one IP", maxSessions), 0)
+		return
+	}
 	session := Session{
-		ID:          fmt.Sprint(a.QRIDCounter),
+		ID:          a.newSessionID(),
 		OwnerID:     senderClient.ID,
 		ClientIDs:   []string{},
 		createdDate: time.Now(),
+		notes:       make(map[string]*NoteDoc),
+		members:     make(map[string]SessionMember),
+		ownerIP:     senderClient.remoteIP,
 	}
 	a.SessionMap[session.ID] = session
+	a.webhooks.Publish(WebhookEvent{Type: WebhookSessionCreated, SessionID: session.ID, ClientID: senderClient.ID})
 	// Add client who created session to session
 	AddClientToSessionMsg := AddClientToSessionMsg{
 		Type:        "AddClientToSession",
 		SessionID:   session.ID,
 		AddClientID: senderClient.ID,
 	}
-	a.onAddClientToSessionMsg(senderClient, AddClientToSessionMsg, false)
+	a.onAddClientToSessionMsg(ctx, senderClient, AddClientToSessionMsg, false)
 }
 
-func (a *App) onAddClientToSessionMsg(senderClient Client, msg AddClientToSessionMsg, replyToSender bool) {
+// startSessionWith - Creates a session owned by senderClient and adds clients to it without a QR scan
+func (a *App) startSessionWith(ctx context.Context, senderClient Client, clients []Client) {
+	sessionsBefore := a.ownedSessionCount(senderClient.ID)
+	a.onCreateSessionMsg(ctx, senderClient, CreateSessionMsg{Type: "CreateSession"})
+	if a.ownedSessionCount(senderClient.ID) == sessionsBefore {
+		return
+	}
+	senderClient = a.ClientMap[senderClient.ID]
+	for _, client := range clients {
+		a.onAddClientToSessionMsg(ctx, senderClient, AddClientToSessionMsg{
+			Type:        "AddClientToSession",
+			SessionID:   senderClient.activeSessionID,
+			AddClientID: client.ID,
+		}, true)
+	}
+}
+
+func (a *App) onAddClientToSessionMsg(ctx context.Context, senderClient Client, msg AddClientToSessionMsg, replyToSender bool) {
+	ctx, span := a.tracer.Start(ctx, "onAddClientToSessionMsg")
+	defer span.End()
 	session, sessionExists := a.SessionMap[msg.SessionID]
+	if maxClients := a.Config.Limits.MaxClientsPerSession; sessionExists && maxClients > 0 && len(session.ClientIDs) >= maxClients {
+		a.limitExceeded(ctx, senderClient, errSessionFull, fmt.Sprintf("Sessions can have at most %d clients", maxClients), 0)
+		return
+	}
 	if sessionExists {
-		if client, ok := a.ClientMap[msg.AddClientID]; ok {
+		if client, ok := a.lookupClient(msg.AddClientID); ok {
 			session.ClientIDs = append(session.ClientIDs, msg.AddClientID)
 			a.SessionMap[session.ID] = session
-			client.activeSessionID = session.ID
-			a.ClientMap[client.ID] = client
-			joinMsg := ClientJoinedSessionMsg{
-				Type:           "ClientJoinedSession",
-				ClientID:       msg.AddClientID,
-				SessionID:      session.ID,
-				SessionOwnerID: session.OwnerID,
-				ClientMap:      a.getSessionClientMap(session.ID),
-			}
+			session = a.rotateSessionKeys(ctx, session.ID, client.ID)
+			a.announceMembership(clusterMemberAdded, session, client.ID)
+			a.webhooks.Publish(WebhookEvent{Type: WebhookClientJoined, SessionID: session.ID, ClientID: client.ID})
+			joinMsg := a.newClientJoinedSessionMsg(session, client.ID)
 			if replyToSender {
-				senderClient.conn.WriteJSON(joinMsg)
+				senderClient.transport.Send(ctx, joinMsg)
 			}
-			client.conn.WriteJSON(joinMsg)
-		} else {
-			errMsg := ErrorMsg{
-				Type:    "error",
-				Message: "No client with ID " + msg.AddClientID,
+			// Clients on other nodes are welcomed by their own node when it sees the new member,
+			// or when routing by hash reconnect to this node which owns the session
+			if _, local := a.ClientMap[client.ID]; local {
+				a.welcomeToSession(ctx, session, client, joinMsg)
+			} else if a.hashRouting() {
+				// The client's transport token never left its node, so it rejoins with one made here
+				rejoinToken := newToken()
+				session.members[client.ID] = SessionMember{TokenHash: hashDeviceToken(rejoinToken), JoinedAt: time.Now()}
+				client.transport.Send(ctx, SessionMovedMsg{Type: "SessionMoved", SessionID: session.ID, RejoinToken: rejoinToken})
 			}
-			senderClient.conn.WriteJSON(errMsg)
+			if msg.Trust {
+				if session.OwnerID == senderClient.ID {
+					a.requestPairing(ctx, senderClient, client)
+				} else {
+					a.sendErrorCode(ctx, senderClient, errNotTrusted, "Only the session owner can trust devices")
+				}
+			}
+			a.clientLogger(senderClient).Info("Added client to session", "addClientId", client.ID, "targetSessionId", session.ID)
+		} else {
+			a.sendError(ctx, senderClient, "No client with ID "+msg.AddClientID)
 		}
 	} else {
-		errMsg := ErrorMsg{
-			Type:    "error",
-			Message: "No session with ID " + msg.SessionID,
+		a.sendError(ctx, senderClient, "No session with ID "+msg.SessionID)
+	}
+}
+
+func (a *App) newClientJoinedSessionMsg(session Session, clientID string) ClientJoinedSessionMsg {
+	return ClientJoinedSessionMsg{
+		Type:           "ClientJoinedSession",
+		ClientID:       clientID,
+		SessionID:      session.ID,
+		SessionOwnerID: session.OwnerID,
+		ClientMap:      a.getSessionClientMap(session.ID),
+		KeyEpoch:       session.keyEpoch,
+		KeyDirectory:   a.getSessionKeyDirectory(session.ID),
+	}
+}
+
+// welcomeToSession - Makes session the active session of a local client and sends it the session state
+func (a *App) welcomeToSession(ctx context.Context, session Session, client Client, joinMsg ClientJoinedSessionMsg) {
+	client.activeSessionID = session.ID
+	a.ClientMap[client.ID] = client
+	session.members[client.ID] = SessionMember{TokenHash: hashDeviceToken(client.transportToken), JoinedAt: time.Now()}
+	client.transport.Send(ctx, joinMsg)
+	for noteID, note := range session.notes {
+		snapshotMsg := NoteSnapshotMsg{
+			Type:     "NoteSnapshot",
+			NoteID:   noteID,
+			Elements: note.Snapshot(),
+		}
+		client.transport.Send(ctx, snapshotMsg)
+	}
+	// Sessions restored from before the history was shortened may have more entries
+	history := lastClipboardEntries(session.clipboard, a.Config.ClipboardHistoryLength)
+	if client.ClipboardSync && len(history) > 0 {
+		historyMsg := ClipboardHistoryMsg{
+			Type:    "ClipboardHistory",
+			Entries: history,
 		}
-		senderClient.conn.WriteJSON(errMsg)
+		client.transport.Send(ctx, historyMsg)
 	}
-	fmt.Println("Created session", session)
 }
 
 // Map - Apply function to all elements of a slice
@@ -285,18 +919,319 @@ func filter(ss []string, test func(string) bool) (ret []string) {
 	return
 }
 
-func (a *App) onBroadcastToSessionMsg(senderClient Client, inboundMsg BroadcastToSessionMsg) {
+func (a *App) onBroadcastToSessionMsg(ctx context.Context, senderClient Client, inboundMsg BroadcastToSessionMsg) {
+	ctx, span := a.tracer.Start(ctx, "onBroadcastToSessionMsg")
+	defer span.End()
 	session, sessionExists := a.SessionMap[senderClient.activeSessionID]
 	if sessionExists {
-		outboundMsg := BroadcastFromSessionMsg{
-			Type:             "BroadcastFromSession",
-			FromSessionOwner: session.OwnerID == senderClient.ID,
-			SenderID:         senderClient.ID,
-			Payload:          inboundMsg.Payload,
+		if err := a.broadcastToSession(ctx, session, senderClient.ID, inboundMsg); err != nil {
+			a.sendError(ctx, senderClient, "Invalid content: "+err.Error())
 		}
-		for _, clientID := range session.ClientIDs {
-			client := a.ClientMap[clientID]
-			client.conn.WriteJSON(outboundMsg)
+	}
+}
+
+// broadcastToSession - Sends a broadcast from senderID to every client in session.
+// Returns an error without sending if the content is invalid. Caller must hold a.mu.
+func (a *App) broadcastToSession(ctx context.Context, session Session, senderID string, inboundMsg BroadcastToSessionMsg) error {
+	if inboundMsg.Content != nil {
+		if err := validateContent(*inboundMsg.Content); err != nil {
+			return err
+		}
+	}
+	outboundMsg := BroadcastFromSessionMsg{
+		Type:             "BroadcastFromSession",
+		FromSessionOwner: session.OwnerID == senderID,
+		SenderID:         senderID,
+		Payload:          inboundMsg.Payload,
+		Content:          inboundMsg.Content,
+	}
+	a.sendToSession(ctx, session, outboundMsg, nil)
+	if inboundMsg.Content != nil && inboundMsg.Content.Kind == ContentKindFileRef {
+		a.webhooks.Publish(WebhookEvent{Type: WebhookFileShared, SessionID: session.ID, ClientID: senderID, File: inboundMsg.Content.FileRef})
+	}
+	return nil
+}
+
+func (a *App) onUpdateNoteMsg(ctx context.Context, senderClient Client, inboundMsg UpdateNoteMsg) {
+	ctx, span := a.tracer.Start(ctx, "onUpdateNoteMsg")
+	defer span.End()
+	session, sessionExists := a.SessionMap[senderClient.activeSessionID]
+	if !sessionExists {
+		a.sendError(ctx, senderClient, "Client is not in a session")
+		return
+	}
+	limits := a.Config.Limits
+	note, ok := session.notes[inboundMsg.NoteID]
+	if !ok {
+		if limits.MaxNotesPerSession > 0 && len(session.notes) >= limits.MaxNotesPerSession {
+			a.limitExceeded(ctx, senderClient, errTooManyNotes, fmt.Sprintf("Sessions can have at most %d notes", limits.MaxNotesPerSession), 0)
+			return
+		}
+		note = newNoteDoc()
+		session.notes[inboundMsg.NoteID] = note
+	}
+	appliedOps, err := note.Apply(inboundMsg.Ops, limits.MaxNoteLength, limits.MaxNoteElements)
+	if err == errNoteFull {
+		a.limitExceeded(ctx, senderClient, errNoteTooLong, fmt.Sprintf("Notes can have at most %d characters", limits.MaxNoteLength), 0)
+	} else if err == errNoteHistoryFull {
+		a.limitExceeded(ctx, senderClient, errNoteHistoryTooLong, fmt.Sprintf("Notes can have at most %d characters including deleted ones", limits.MaxNoteElements), 0)
+	} else if err != nil {
+		a.sendError(ctx, senderClient, "Could not update note "+inboundMsg.NoteID+": "+err.Error())
+	}
+	if len(appliedOps) == 0 {
+		return
+	}
+	a.replicateSession(clusterEnvelope{Kind: clusterNoteUpdated, SessionID: session.ID, NoteID: inboundMsg.NoteID, Ops: appliedOps})
+	outboundMsg := NoteUpdatedMsg{
+		Type:     "NoteUpdated",
+		NoteID:   inboundMsg.NoteID,
+		SenderID: senderClient.ID,
+		Ops:      appliedOps,
+	}
+	a.sendToSession(ctx, session, outboundMsg, nil)
+}
+
+func (a *App) onSetClipboardMsg(ctx context.Context, senderClient Client, inboundMsg SetClipboardMsg) {
+	ctx, span := a.tracer.Start(ctx, "onSetClipboardMsg")
+	defer span.End()
+	session, sessionExists := a.SessionMap[senderClient.activeSessionID]
+	if !sessionExists {
+		a.sendError(ctx, senderClient, "Client is not in a session")
+		return
+	}
+	err := validateContent(SharedContent{
+		Kind: ContentKindClipboard,
+		Clipboard: &ClipboardContent{
+			MimeType: inboundMsg.MimeType,
+			Content:  inboundMsg.Content,
+		},
+	})
+	if err != nil {
+		a.sendError(ctx, senderClient, "Invalid clipboard: "+err.Error())
+		return
+	}
+	entry := ClipboardEntry{
+		SenderID: senderClient.ID,
+		MimeType: inboundMsg.MimeType,
+		Content:  inboundMsg.Content,
+		SetTime:  time.Now(),
+	}
+	session = a.addClipboardEntry(session, entry)
+	a.SessionMap[session.ID] = session
+	a.replicateSession(clusterEnvelope{Kind: clusterClipboardSet, SessionID: session.ID, Clipboard: &entry})
+	outboundMsg := ClipboardUpdatedMsg{
+		Type:  "ClipboardUpdated",
+		Entry: entry,
+	}
+	a.sendToSession(ctx, session, outboundMsg, func(client Client) bool {
+		return client.ClipboardSync
+	})
+}
+
+// addClipboardEntry - Adds entry to the session's clipboard history, dropping the oldest entries
+func (a *App) addClipboardEntry(session Session, entry ClipboardEntry) Session {
+	session.clipboard = lastClipboardEntries(append(session.clipboard, entry), a.Config.ClipboardHistoryLength)
+	return session
+}
+
+// lastClipboardEntries - The most recent n entries
+func lastClipboardEntries(entries []ClipboardEntry, n int) []ClipboardEntry {
+	if len(entries) > n {
+		return entries[len(entries)-n:]
+	}
+	return entries
+}
+
+// Largest SDP or ICE candidate the server will relay
+const maxRtcSignalBytes = 16 * 1024
+
+func (a *App) onRtcOfferMsg(ctx context.Context, senderClient Client, msg RtcOfferMsg) {
+	ctx, span := a.tracer.Start(ctx, "onRtcOfferMsg")
+	defer span.End()
+	if !strings.HasPrefix(msg.SDP, "v=0") || len(msg.SDP) > maxRtcSignalBytes {
+		a.sendError(ctx, senderClient, "Invalid RtcOffer sdp")
+		return
+	}
+	msg.FromClientID = senderClient.ID
+	a.relayRtcMsg(ctx, senderClient, msg.ToClientID, msg)
+}
+
+func (a *App) onRtcAnswerMsg(ctx context.Context, senderClient Client, msg RtcAnswerMsg) {
+	ctx, span := a.tracer.Start(ctx, "onRtcAnswerMsg")
+	defer span.End()
+	if !strings.HasPrefix(msg.SDP, "v=0") || len(msg.SDP) > maxRtcSignalBytes {
+		a.sendError(ctx, senderClient, "Invalid RtcAnswer sdp")
+		return
+	}
+	msg.FromClientID = senderClient.ID
+	a.relayRtcMsg(ctx, senderClient, msg.ToClientID, msg)
+}
+
+func (a *App) onRtcIceCandidateMsg(ctx context.Context, senderClient Client, msg RtcIceCandidateMsg) {
+	ctx, span := a.tracer.Start(ctx, "onRtcIceCandidateMsg")
+	defer span.End()
+	if len(msg.Candidate) > maxRtcSignalBytes || msg.SDPMLineIndex < 0 {
+		a.sendError(ctx, senderClient, "Invalid RtcIceCandidate")
+		return
+	}
+	msg.FromClientID = senderClient.ID
+	a.relayRtcMsg(ctx, senderClient, msg.ToClientID, msg)
+}
+
+// relayRtcMsg - Sends a signalling message to another client only if both are members of the same session
+func (a *App) relayRtcMsg(ctx context.Context, senderClient Client, toClientID string, msg interface{}) {
+	session, sessionExists := a.SessionMap[senderClient.activeSessionID]
+	if !sessionExists {
+		a.sendError(ctx, senderClient, "Client is not in a session")
+		return
+	}
+	if toClientID == senderClient.ID || !contains(session.ClientIDs, senderClient.ID) || !contains(session.ClientIDs, toClientID) {
+		a.sendError(ctx, senderClient, "No client with ID "+toClientID+" in session")
+		return
+	}
+	if toClient, ok := a.lookupClient(toClientID); ok {
+		toClient.transport.Send(ctx, msg)
+	}
+}
+
+// sendToSession - Queues msg for each connected client in the session that include accepts, or all if include is nil
+func (a *App) sendToSession(ctx context.Context, session Session, msg interface{}, include func(Client) bool) {
+	start := time.Now()
+	for _, clientID := range session.ClientIDs {
+		if client, connected := a.lookupClient(clientID); connected && (include == nil || include(client)) {
+			client.transport.Send(ctx, msg)
+		}
+	}
+	a.metrics.fanOutDuration.Observe(time.Since(start).Seconds())
+}
+
+// sendToPeers - Sends msg once to every other client sharing a session with client. Caller must hold a.mu.
+func (a *App) sendToPeers(ctx context.Context, client Client, msg interface{}) {
+	start := time.Now()
+	sent := map[string]bool{client.ID: true}
+	for _, session := range a.SessionMap {
+		if !contains(session.ClientIDs, client.ID) {
+			continue
+		}
+		for _, peerID := range session.ClientIDs {
+			if sent[peerID] {
+				continue
+			}
+			sent[peerID] = true
+			if peer, connected := a.lookupClient(peerID); connected {
+				peer.transport.Send(ctx, msg)
+			}
+		}
+	}
+	a.metrics.fanOutDuration.Observe(time.Since(start).Seconds())
+}
+
+func (a *App) sendError(ctx context.Context, client Client, message string) {
+	a.sendErrorCode(ctx, client, "", message)
+}
+
+// sendErrorCode - Sends an error with a machine readable code
+func (a *App) sendErrorCode(ctx context.Context, client Client, code string, message string) {
+	errMsg := ErrorMsg{
+		Type:    "error",
+		Code:    code,
+		Message: message,
+	}
+	client.transport.Send(ctx, errMsg)
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Largest encrypted envelope ciphertext the server will relay
+const maxEnvelopeBytes = 512 * 1024
+
+func (a *App) onPublishKeyMsg(ctx context.Context, senderClient Client, msg PublishKeyMsg) {
+	ctx, span := a.tracer.Start(ctx, "onPublishKeyMsg")
+	defer span.End()
+	if err := validatePublicKey(msg.PublicKey); err != nil {
+		a.sendError(ctx, senderClient, "Invalid public key: "+err.Error())
+		return
+	}
+	senderClient.PublicKey = msg.PublicKey
+	a.ClientMap[senderClient.ID] = senderClient
+	a.announceClient(senderClient)
+	// Existing members need the new key before they can encrypt for this client
+	a.rotateSessionKeys(ctx, senderClient.activeSessionID, "")
+}
+
+// rotateSessionKeys - Starts a new key epoch for the session and sends the key directory to members
+// that have published a key, except skipClientID. Returns the updated session.
+func (a *App) rotateSessionKeys(ctx context.Context, sessionID string, skipClientID string) Session {
+	session, ok := a.SessionMap[sessionID]
+	if !ok {
+		return session
+	}
+	session.keyEpoch++
+	a.SessionMap[session.ID] = session
+	a.replicateSession(clusterEnvelope{Kind: clusterKeysRotated, SessionID: session.ID, KeyEpoch: session.keyEpoch})
+	rotationMsg := SessionKeyRotationMsg{
+		Type:         "SessionKeyRotation",
+		SessionID:    session.ID,
+		KeyEpoch:     session.keyEpoch,
+		KeyDirectory: a.getSessionKeyDirectory(session.ID),
+	}
+	for _, client := range a.getSessionClientMap(session.ID) {
+		if client.ID != skipClientID && client.PublicKey != "" {
+			client.transport.Send(ctx, rotationMsg)
+		}
+	}
+	return session
+}
+
+// getSessionKeyDirectory - Public keys of session members, by client id
+func (a *App) getSessionKeyDirectory(sessionID string) map[string]string {
+	keyDirectory := map[string]string{}
+	for clientID, client := range a.getSessionClientMap(sessionID) {
+		if client.PublicKey != "" {
+			keyDirectory[clientID] = client.PublicKey
+		}
+	}
+	return keyDirectory
+}
+
+// onSendEncryptedMsg - Relays each envelope to its recipient. The server never decrypts envelopes.
+func (a *App) onSendEncryptedMsg(ctx context.Context, senderClient Client, msg SendEncryptedMsg) {
+	ctx, span := a.tracer.Start(ctx, "onSendEncryptedMsg")
+	defer span.End()
+	session, sessionExists := a.SessionMap[senderClient.activeSessionID]
+	if !sessionExists {
+		a.sendError(ctx, senderClient, "Client is not in a session")
+		return
+	}
+	if msg.KeyEpoch != session.keyEpoch {
+		a.sendError(ctx, senderClient, fmt.Sprint("Stale key epoch ", msg.KeyEpoch, ", current epoch is ", session.keyEpoch))
+		return
+	}
+	for _, envelope := range msg.Envelopes {
+		if !contains(session.ClientIDs, envelope.ToClientID) {
+			a.sendError(ctx, senderClient, "No client with ID "+envelope.ToClientID+" in session")
+			continue
+		}
+		if len(envelope.Ciphertext) > maxEnvelopeBytes {
+			a.sendError(ctx, senderClient, "Envelope for "+envelope.ToClientID+" is too large")
+			continue
+		}
+		outboundMsg := EncryptedFromSessionMsg{
+			Type:       "EncryptedFromSession",
+			SenderID:   senderClient.ID,
+			KeyEpoch:   msg.KeyEpoch,
+			Ciphertext: envelope.Ciphertext,
+			Nonce:      envelope.Nonce,
+		}
+		if toClient, connected := a.lookupClient(envelope.ToClientID); connected {
+			toClient.transport.Send(ctx, outboundMsg)
 		}
 	}
 }
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -27,10 +35,21 @@ func TestServerStarts(t *testing.T) {
 	log.Printf("%s", clientsUrl)
 }
 
-func SetupWsServer(t *testing.T) (*httptest.Server, string) {
-	app := App{}
+// StartTestApp - Serves app until the test ends, with its default config changed by configure.
+// The config advertises the server's own url so nodes of a test cluster can proxy to each other.
+func StartTestApp(t *testing.T, app *App, configure ...func(config *Config)) (*httptest.Server, string) {
+	testServer := httptest.NewUnstartedServer(nil)
+	if app.Config == nil {
+		app.Config = DefaultConfig()
+	}
+	app.Config.AdvertiseAddr = "http://" + testServer.Listener.Addr().String()
+	for _, change := range configure {
+		change(app.Config)
+	}
 	app.Init()
-	testServer := httptest.NewServer(app.MainHandler())
+	testServer.Config.Handler = app.MainHandler()
+	testServer.Start()
+	t.Cleanup(testServer.Close)
 
 	// Convert http://127.0.0.1 to ws://127.0.0/api/v1/ws
 	wsUrl := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/api/v1/ws"
@@ -38,6 +57,10 @@ func SetupWsServer(t *testing.T) (*httptest.Server, string) {
 	return testServer, wsUrl
 }
 
+func SetupWsServer(t *testing.T, configure ...func(config *Config)) (*httptest.Server, string) {
+	return StartTestApp(t, &App{}, configure...)
+}
+
 func CloseWithCloseMessage(conn *websocket.Conn) {
 	conn.WriteMessage(
 		websocket.CloseMessage,
@@ -467,3 +490,411 @@ func Test_session_owner_can_broadcast_to_another_client(t *testing.T) {
 	}
 
 }
+
+func ConnectClient(t *testing.T, wsUrl string) (*websocket.Conn, ClientConnectMsg) {
+	ws, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to websocket server: %v", err)
+	}
+	var connectMsg ClientConnectMsg
+	err = ws.ReadJSON(&connectMsg)
+	if err != nil {
+		t.Fatalf("Error parsing message json as ClientConnectMsg: %v", err)
+	}
+	return ws, connectMsg
+}
+
+func Test_clipboard_is_sent_to_client_joining_session(t *testing.T) {
+	testServer, wsUrl := SetupWsServer(t)
+	defer testServer.Close()
+
+	ws, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+	ws2, client2ConnectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws2)
+
+	// Client 1 creates session and sets the clipboard
+	ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var client1AddedToSessionMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&client1AddedToSessionMsg)
+
+	ws.WriteJSON(SetClipboardMsg{Type: "SetClipboard", MimeType: "text/plain", Content: "copied on phone"})
+	var clipboardUpdatedMsg ClipboardUpdatedMsg
+	err := ws.ReadJSON(&clipboardUpdatedMsg)
+	if err != nil || clipboardUpdatedMsg.Type != "ClipboardUpdated" {
+		t.Fatalf("Expected client 1 to receive ClipboardUpdated but got %v %v", clipboardUpdatedMsg, err)
+	}
+
+	// Client 2 joins and should receive the latest clipboard value
+	ws.WriteJSON(AddClientToSessionMsg{
+		Type:        "AddClientToSession",
+		SessionID:   client1AddedToSessionMsg.SessionID,
+		AddClientID: client2ConnectMsg.Client.ID,
+	})
+	var client2AddedToSessionMsg ClientJoinedSessionMsg
+	ws2.ReadJSON(&client2AddedToSessionMsg)
+	var clipboardHistoryMsg ClipboardHistoryMsg
+	err = ws2.ReadJSON(&clipboardHistoryMsg)
+	if err != nil {
+		t.Fatalf("Error parsing ClipboardHistoryMsg %v", err)
+	}
+	if len(clipboardHistoryMsg.Entries) != 1 || clipboardHistoryMsg.Entries[0].Content != "copied on phone" {
+		t.Fatalf("Expected client 2 to receive clipboard history but got %v", clipboardHistoryMsg)
+	}
+}
+
+func Test_clipboard_history_keeps_the_configured_number_of_entries(t *testing.T) {
+	app := App{Config: DefaultConfig()}
+	app.Config.ClipboardHistoryLength = 2
+	session := Session{}
+	for _, content := range []string{"a", "b", "c"} {
+		session = app.addClipboardEntry(session, ClipboardEntry{Content: content})
+	}
+	if len(session.clipboard) != 2 || session.clipboard[0].Content != "b" || session.clipboard[1].Content != "c" {
+		t.Fatalf("Expected the 2 latest entries to be kept but got %v", session.clipboard)
+	}
+
+	// No history is kept when it is turned off
+	app.Config.ClipboardHistoryLength = 0
+	session = app.addClipboardEntry(Session{}, ClipboardEntry{Content: "a"})
+	if len(session.clipboard) != 0 {
+		t.Fatalf("Expected no history to be kept but got %v", session.clipboard)
+	}
+}
+
+func Test_rtc_offer_is_relayed_only_within_session(t *testing.T) {
+	testServer, wsUrl := SetupWsServer(t)
+	defer testServer.Close()
+
+	ws, client1ConnectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+	ws2, client2ConnectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws2)
+	ws3, client3ConnectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws3)
+
+	ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var client1AddedToSessionMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&client1AddedToSessionMsg)
+	ws.WriteJSON(AddClientToSessionMsg{
+		Type:        "AddClientToSession",
+		SessionID:   client1AddedToSessionMsg.SessionID,
+		AddClientID: client2ConnectMsg.Client.ID,
+	})
+	var joinMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&joinMsg)
+	ws2.ReadJSON(&joinMsg)
+
+	// Client 3 is not in the session so the offer should be rejected
+	ws.WriteJSON(RtcOfferMsg{Type: "RtcOffer", ToClientID: client3ConnectMsg.Client.ID, SDP: "v=0\r\n"})
+	var errMsg ErrorMsg
+	ws.ReadJSON(&errMsg)
+	if errMsg.Type != "error" {
+		t.Fatalf("Expected error relaying offer outside session but got %v", errMsg)
+	}
+
+	ws.WriteJSON(RtcOfferMsg{Type: "RtcOffer", ToClientID: client2ConnectMsg.Client.ID, SDP: "v=0\r\n"})
+	var offerMsg RtcOfferMsg
+	err := ws2.ReadJSON(&offerMsg)
+	if err != nil {
+		t.Fatalf("Error parsing RtcOfferMsg %v", err)
+	}
+	if offerMsg.FromClientID != client1ConnectMsg.Client.ID {
+		t.Fatalf("Expected offer from %s but was from %s", client1ConnectMsg.Client.ID, offerMsg.FromClientID)
+	}
+}
+
+func Test_encrypted_envelopes_are_relayed_unchanged(t *testing.T) {
+	testServer, wsUrl := SetupWsServer(t)
+	defer testServer.Close()
+
+	phoneKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	laptopKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	ws, _ := ConnectClient(t, wsUrl+"?publicKey="+url.QueryEscape(base64.StdEncoding.EncodeToString(phoneKey.PublicKey().Bytes())))
+	defer CloseWithCloseMessage(ws)
+	ws2, client2ConnectMsg := ConnectClient(t, wsUrl+"?publicKey="+url.QueryEscape(base64.StdEncoding.EncodeToString(laptopKey.PublicKey().Bytes())))
+	defer CloseWithCloseMessage(ws2)
+
+	ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var client1AddedToSessionMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&client1AddedToSessionMsg)
+	ws.WriteJSON(AddClientToSessionMsg{
+		Type:        "AddClientToSession",
+		SessionID:   client1AddedToSessionMsg.SessionID,
+		AddClientID: client2ConnectMsg.Client.ID,
+	})
+
+	// Client 1 gets a key rotation for client 2 joining, then the join message
+	var rotationMsg SessionKeyRotationMsg
+	ws.ReadJSON(&rotationMsg)
+	if len(rotationMsg.KeyDirectory) != 2 {
+		t.Fatalf("Expected key directory with 2 keys but got %v", rotationMsg)
+	}
+	var joinMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&joinMsg)
+	ws2.ReadJSON(&joinMsg)
+	if joinMsg.KeyEpoch != rotationMsg.KeyEpoch || len(joinMsg.KeyDirectory) != 2 {
+		t.Fatalf("Expected client 2 to receive key directory for epoch %d but got %v", rotationMsg.KeyEpoch, joinMsg)
+	}
+
+	ciphertext := base64.StdEncoding.EncodeToString([]byte("opaque encrypted bytes"))
+	ws.WriteJSON(SendEncryptedMsg{
+		Type:     "SendEncrypted",
+		KeyEpoch: joinMsg.KeyEpoch,
+		Envelopes: []EncryptedEnvelope{
+			{ToClientID: client2ConnectMsg.Client.ID, Ciphertext: ciphertext, Nonce: "bm9uY2U="},
+		},
+	})
+	var encryptedMsg EncryptedFromSessionMsg
+	err := ws2.ReadJSON(&encryptedMsg)
+	if err != nil {
+		t.Fatalf("Error parsing EncryptedFromSessionMsg %v", err)
+	}
+	if encryptedMsg.Ciphertext != ciphertext {
+		t.Fatalf("Expected ciphertext to be relayed unchanged but got %s", encryptedMsg.Ciphertext)
+	}
+}
+
+func Test_shutdown_tells_clients_and_saves_sessions(t *testing.T) {
+	config := DefaultConfig()
+	config.StoreBackend = "file"
+	config.StorePath = filepath.Join(t.TempDir(), "state.json")
+	app := App{Config: config}
+	app.Init()
+	testServer := httptest.NewServer(app.MainHandler())
+	defer testServer.Close()
+	wsUrl := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/api/v1/ws"
+
+	ws, connectMsg := ConnectClient(t, wsUrl)
+	defer ws.Close()
+	ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var joinMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&joinMsg)
+
+	res, err := http.Get(testServer.URL + "/readyz")
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected server to be ready before shutdown but got %v %v", res, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := app.Shutdown(ctx); err != nil {
+		t.Fatalf("Unexpected error shutting down %v", err)
+	}
+
+	var shuttingDownMsg ServerShuttingDownMsg
+	ws.ReadJSON(&shuttingDownMsg)
+	if shuttingDownMsg.Type != "ServerShuttingDown" || shuttingDownMsg.ReconnectAfterMs <= 0 {
+		t.Fatalf("Expected ServerShuttingDown with reconnect hint but got %v", shuttingDownMsg)
+	}
+	_, _, err = ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("Expected going away close frame but got %v", err)
+	}
+
+	_, res, err = websocket.DefaultDialer.Dial(wsUrl, nil)
+	if err == nil || res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected new connections to be refused while draining")
+	}
+	res, err = http.Get(testServer.URL + "/readyz")
+	if err != nil || res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected server not to be ready while draining")
+	}
+
+	// A new server using the same store has the session
+	restarted := App{Config: config}
+	restarted.Init()
+	if _, ok := restarted.SessionMap[joinMsg.SessionID]; !ok {
+		t.Fatalf("Expected session %s to be restored after restart", joinMsg.SessionID)
+	}
+	restartedServer := httptest.NewServer(restarted.MainHandler())
+	defer restartedServer.Close()
+	wsUrl = "ws" + strings.TrimPrefix(restartedServer.URL, "http") + "/api/v1/ws"
+
+	// Knowing the client ID isn't enough to take its place in the session
+	guesser, guesserConnectMsg := ConnectClient(t, wsUrl+"?clientId="+connectMsg.Client.ID)
+	defer CloseWithCloseMessage(guesser)
+	if guesserConnectMsg.Client.ID == connectMsg.Client.ID {
+		t.Fatalf("Expected client without the rejoin token to get a new ID")
+	}
+	if msgTypes := ReadUntilQuiet(guesser, 200*time.Millisecond); len(msgTypes) != 0 {
+		t.Fatalf("Expected client without the rejoin token not to join the session but got %v", msgTypes)
+	}
+
+	ws, rejoinMsg := ConnectClient(t, wsUrl+"?clientId="+connectMsg.Client.ID+"&rejoinToken="+connectMsg.TransportToken)
+	defer CloseWithCloseMessage(ws)
+	var rejoinedMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&rejoinedMsg)
+	if rejoinMsg.Client.ID != connectMsg.Client.ID || rejoinedMsg.SessionID != joinMsg.SessionID {
+		t.Fatalf("Expected client to rejoin session %s but got %v and %v", joinMsg.SessionID, rejoinMsg, rejoinedMsg)
+	}
+}
+
+func Test_expired_clients_are_removed_from_their_sessions(t *testing.T) {
+	config := DefaultConfig()
+	app := App{Config: config}
+	app.Init()
+	app.SessionMap["session1"] = Session{
+		ID:        "session1",
+		ClientIDs: []string{"gone", "rejoining"},
+		members: map[string]SessionMember{
+			"gone":      {TokenHash: hashDeviceToken("a"), JoinedAt: time.Now().Add(-2 * config.ClientTTL)},
+			"rejoining": {TokenHash: hashDeviceToken("b"), JoinedAt: time.Now()},
+		},
+	}
+	app.removeOldClients()
+	if session := app.SessionMap["session1"]; len(session.ClientIDs) != 1 || session.ClientIDs[0] != "rejoining" {
+		t.Fatalf("Expected expired member to be removed but got %v", session.ClientIDs)
+	}
+	if _, ok := app.rejoinSession("gone", "a"); ok {
+		t.Fatalf("Expected expired member not to be able to rejoin")
+	}
+	if _, ok := app.rejoinSession("rejoining", "a"); ok {
+		t.Fatalf("Expected wrong rejoin token to be refused")
+	}
+}
+
+func Test_clients_active_after_the_ttl_are_kept(t *testing.T) {
+	app := &App{}
+	_, wsUrl := StartTestApp(t, app)
+	ws, connectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+	ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var joinMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&joinMsg)
+
+	// Connected long ago but still sending messages
+	app.mu.Lock()
+	client := app.ClientMap[connectMsg.Client.ID]
+	client.LastJoinTime = time.Now().Add(-2 * app.Config.ClientTTL)
+	app.ClientMap[client.ID] = client
+	app.mu.Unlock()
+	ws2, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws2)
+
+	ws.WriteJSON(BroadcastToSessionMsg{Type: "BroadcastToSession", Payload: "still here"})
+	var broadcastMsg BroadcastFromSessionMsg
+	ws.ReadJSON(&broadcastMsg)
+	if broadcastMsg.Payload != "still here" {
+		t.Fatalf("Expected active client to stay connected and in its session but got %v", broadcastMsg)
+	}
+}
+
+func Test_only_old_sessions_without_members_expire(t *testing.T) {
+	app := &App{}
+	_, wsUrl := StartTestApp(t, app)
+	ws, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+	ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var joinMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&joinMsg)
+	ws2, client2ConnectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws2)
+
+	app.mu.Lock()
+	expired := time.Now().Add(-2 * app.Config.SessionTTL)
+	session := app.SessionMap[joinMsg.SessionID]
+	session.createdDate = expired
+	app.SessionMap[session.ID] = session
+	// A session whose members have all gone, which client 2 still thinks it is in
+	app.SessionMap["empty"] = Session{ID: "empty", ClientIDs: []string{}, createdDate: expired}
+	client2 := app.ClientMap[client2ConnectMsg.Client.ID]
+	client2.activeSessionID = "empty"
+	app.ClientMap[client2.ID] = client2
+	app.removeOldSessions()
+	_, inUseKept := app.SessionMap[joinMsg.SessionID]
+	_, emptyKept := app.SessionMap["empty"]
+	activeSessionID := app.ClientMap[client2.ID].activeSessionID
+	app.mu.Unlock()
+
+	if !inUseKept || emptyKept {
+		t.Fatalf("Expected only the session without members to expire but in use was kept %v and empty %v", inUseKept, emptyKept)
+	}
+	var endedMsg SessionEndedMsg
+	ws2.ReadJSON(&endedMsg)
+	if endedMsg.Type != "SessionEnded" || endedMsg.SessionID != "empty" || activeSessionID != "" {
+		t.Fatalf("Expected client 2 to be told its session ended but got %v with active session %q", endedMsg, activeSessionID)
+	}
+}
+
+func Test_metrics_count_messages_by_type(t *testing.T) {
+	testServer, wsUrl := SetupWsServer(t)
+	defer testServer.Close()
+
+	ws, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+	ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var joinMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&joinMsg)
+	ws.WriteJSON(map[string]string{"type": "MadeUp"})
+	var errMsg ErrorMsg
+	ws.ReadJSON(&errMsg)
+
+	res, err := http.Get(testServer.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to get metrics %v", err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	for _, expected := range []string{
+		`qrsync_messages_in_total{type="CreateSession"} 1`,
+		`qrsync_messages_in_total{type="unknown"} 1`,
+		`qrsync_messages_out_total{type="ClientJoinedSession"} 1`,
+		`qrsync_connected_clients 1`,
+		`qrsync_active_sessions 1`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("Expected metrics to contain %s but got\n%s", expected, body)
+		}
+	}
+	if strings.Contains(string(body), "MadeUp") {
+		t.Fatalf("Expected unknown message types not to be used as labels but got\n%s", body)
+	}
+}
+
+func Test_client_updates_are_sent_as_deltas_to_session_members_only(t *testing.T) {
+	testServer, wsUrl := SetupWsServer(t)
+	defer testServer.Close()
+	ws1, client1ConnectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws1)
+	ws2, client2ConnectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws2)
+	outsider, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(outsider)
+
+	ws1.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var joinMsg ClientJoinedSessionMsg
+	ws1.ReadJSON(&joinMsg)
+	ws1.WriteJSON(AddClientToSessionMsg{Type: "AddClientToSession", SessionID: joinMsg.SessionID, AddClientID: client2ConnectMsg.Client.ID})
+	ws1.ReadJSON(&joinMsg)
+	ws2.ReadJSON(&joinMsg)
+
+	name := "Ada's phone"
+	ws1.WriteJSON(UpdateClientMsg{Type: "UpdateClient", Name: &name, Platform: "android"})
+	var updatedMsg ClientUpdatedMsg
+	ws2.ReadJSON(&updatedMsg)
+	if updatedMsg.Type != "ClientUpdated" || updatedMsg.ClientID != client1ConnectMsg.Client.ID ||
+		updatedMsg.Name == nil || *updatedMsg.Name != "Ada's phone" || updatedMsg.Platform != "android" {
+		t.Fatalf("Expected name and platform changes but got %v", updatedMsg)
+	}
+	if updatedMsg.ClipboardSync != nil || updatedMsg.DeviceType != "" || updatedMsg.AppVersion != "" {
+		t.Fatalf("Expected only changed fields to be sent but got %v", updatedMsg)
+	}
+	if msgTypes := ReadUntilQuiet(outsider, 200*time.Millisecond); len(msgTypes) > 0 {
+		t.Fatalf("Expected client outside the session not to be sent updates but got %v", msgTypes)
+	}
+
+	// Presence only updates leave the name alone
+	ws1.WriteJSON(UpdateClientMsg{Type: "UpdateClient", Presence: PresenceAway})
+	var presenceMsg PresenceChangedMsg
+	ws2.ReadJSON(&presenceMsg)
+	if presenceMsg.Type != "PresenceChanged" || presenceMsg.Presence != PresenceAway {
+		t.Fatalf("Expected only a presence change but got %v", presenceMsg)
+	}
+
+	// Updates that don't change anything aren't sent, so the name is still set
+	ws1.WriteJSON(UpdateClientMsg{Type: "UpdateClient", Name: &name})
+	if msgTypes := ReadUntilQuiet(ws2, 200*time.Millisecond); len(msgTypes) > 0 {
+		t.Fatalf("Expected no update when nothing changed but got %v", msgTypes)
+	}
+}
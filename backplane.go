@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Backplane - Pub/sub channel connecting the nodes of a cluster
+type Backplane interface {
+	// Publish - Sends data to every subscriber of channel on any node, including this one
+	Publish(channel string, data []byte) error
+	// Subscribe - Calls handler with the data of every message published to channel.
+	// Handlers are called one at a time in the order messages were published.
+	Subscribe(channel string, handler func(data []byte)) error
+	Close() error
+}
+
+// How long a dial to the backplane may take
+const backplaneDialTimeout = 5 * time.Second
+
+// Delay between attempts to reconnect a lost subscription or publishing connection
+const backplaneReconnectDelay = time.Second
+
+// Messages waiting to be published before Publish starts refusing them
+const backplanePublishQueueSize = 4096
+
+var errBackplaneClosed = errors.New("backplane closed")
+var errBackplaneQueueFull = errors.New("backplane publish queue full")
+
+// respError - Error reply from the server, as opposed to a connection failure
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+func newBackplane(config *Config, logger *slog.Logger) (Backplane, error) {
+	switch config.Backplane {
+	case "none":
+		return nil, nil
+	case "redis":
+		return newRedisBackplane(config.BackplaneAddr, logger)
+	}
+	return nil, fmt.Errorf("unknown backplane %q", config.Backplane)
+}
+
+// memoryBackplane - In process backplane connecting Apps in the same process, used by tests
+type memoryBackplane struct {
+	mu    sync.Mutex
+	nodes []*memoryBackplaneNode
+}
+
+type memoryBackplaneMsg struct {
+	channel string
+	data    []byte
+}
+
+// memoryBackplaneNode - Connection of one App to a memoryBackplane.
+// Messages are queued and handled on the node's own goroutine like they would be from a network.
+type memoryBackplaneNode struct {
+	hub      *memoryBackplane
+	mu       sync.Mutex
+	handlers map[string][]func([]byte)
+	queue    []memoryBackplaneMsg
+	wake     chan struct{}
+	closed   bool
+}
+
+func newMemoryBackplane() *memoryBackplane {
+	return &memoryBackplane{}
+}
+
+// node - Connects a new node to the backplane
+func (b *memoryBackplane) node() *memoryBackplaneNode {
+	n := &memoryBackplaneNode{
+		hub:      b,
+		handlers: make(map[string][]func([]byte)),
+		wake:     make(chan struct{}, 1),
+	}
+	b.mu.Lock()
+	b.nodes = append(b.nodes, n)
+	b.mu.Unlock()
+	go n.run()
+	return n
+}
+
+func (n *memoryBackplaneNode) Publish(channel string, data []byte) error {
+	n.hub.mu.Lock()
+	defer n.hub.mu.Unlock()
+	for _, node := range n.hub.nodes {
+		node.deliver(memoryBackplaneMsg{channel: channel, data: data})
+	}
+	return nil
+}
+
+func (n *memoryBackplaneNode) Subscribe(channel string, handler func(data []byte)) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.handlers[channel] = append(n.handlers[channel], handler)
+	return nil
+}
+
+func (n *memoryBackplaneNode) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.closed {
+		n.closed = true
+		close(n.wake)
+	}
+	return nil
+}
+
+func (n *memoryBackplaneNode) deliver(msg memoryBackplaneMsg) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	n.queue = append(n.queue, msg)
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (n *memoryBackplaneNode) run() {
+	for range n.wake {
+		for {
+			n.mu.Lock()
+			if len(n.queue) == 0 {
+				n.mu.Unlock()
+				break
+			}
+			msg := n.queue[0]
+			n.queue = n.queue[1:]
+			handlers := n.handlers[msg.channel]
+			n.mu.Unlock()
+			for _, handler := range handlers {
+				handler(msg.data)
+			}
+		}
+	}
+}
+
+// redisBackplane - Backplane using Redis PUBLISH and SUBSCRIBE.
+// Publishing and subscribing use separate connections as Redis requires. Published messages are
+// queued and written by a single goroutine so callers never wait on the network.
+type redisBackplane struct {
+	addr   string
+	logger *slog.Logger
+
+	pubQueue chan redisPublish
+	// Connection messages are published on, only used by the publishing goroutine
+	pubConn   net.Conn
+	pubReader *bufio.Reader
+	// Closed by Close to stop the publishing goroutine
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Guards subConn, handlers and closed
+	subMu    sync.Mutex
+	subConn  net.Conn
+	handlers map[string][]func([]byte)
+	closed   bool
+}
+
+type redisPublish struct {
+	channel string
+	data    []byte
+}
+
+func newRedisBackplane(addr string, logger *slog.Logger) (*redisBackplane, error) {
+	b := &redisBackplane{
+		addr:     addr,
+		logger:   logger,
+		pubQueue: make(chan redisPublish, backplanePublishQueueSize),
+		done:     make(chan struct{}),
+		handlers: make(map[string][]func([]byte)),
+	}
+	subConn, err := net.DialTimeout("tcp", addr, backplaneDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	b.subConn = subConn
+	go b.readLoop(subConn)
+	go b.writeLoop()
+	return b, nil
+}
+
+// Publish - Queues data to be published, failing only if the backplane is closed or too far behind
+func (b *redisBackplane) Publish(channel string, data []byte) error {
+	select {
+	case <-b.done:
+		return errBackplaneClosed
+	default:
+	}
+	select {
+	case b.pubQueue <- redisPublish{channel: channel, data: data}:
+		return nil
+	default:
+		return errBackplaneQueueFull
+	}
+}
+
+// writeLoop - Publishes queued messages in order over one connection, reconnecting when it is
+// lost. Messages still queued when the backplane is closed are flushed without reconnecting.
+func (b *redisBackplane) writeLoop() {
+	defer func() {
+		if b.pubConn != nil {
+			b.pubConn.Close()
+		}
+	}()
+	for {
+		select {
+		case msg := <-b.pubQueue:
+			for !b.publish(msg) {
+				select {
+				case <-b.done:
+					return
+				case <-time.After(backplaneReconnectDelay):
+				}
+			}
+		case <-b.done:
+			for {
+				select {
+				case msg := <-b.pubQueue:
+					if !b.publish(msg) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// publish - Sends msg, dialing if there is no connection. Returns false if it should be sent
+// again once the server can be reached.
+func (b *redisBackplane) publish(msg redisPublish) bool {
+	if b.pubConn == nil {
+		conn, err := net.DialTimeout("tcp", b.addr, backplaneDialTimeout)
+		if err != nil {
+			b.logger.Warn("Backplane publishing connection lost, reconnecting", "addr", b.addr, "err", err)
+			return false
+		}
+		b.pubConn = conn
+		b.pubReader = bufio.NewReader(conn)
+	}
+	err := writeRESPCommand(b.pubConn, "PUBLISH", msg.channel, string(msg.data))
+	if err == nil {
+		_, err = readRESP(b.pubReader)
+	}
+	var replyErr respError
+	if errors.As(err, &replyErr) {
+		b.logger.Error("Backplane refused message", "channel", msg.channel, "err", err)
+		return true
+	}
+	if err != nil {
+		b.pubConn.Close()
+		b.pubConn = nil
+		return false
+	}
+	return true
+}
+
+func (b *redisBackplane) Subscribe(channel string, handler func(data []byte)) error {
+	b.subMu.Lock()
+	defer b.subMu.Unlock()
+	if b.closed {
+		return errBackplaneClosed
+	}
+	b.handlers[channel] = append(b.handlers[channel], handler)
+	if len(b.handlers[channel]) > 1 {
+		return nil
+	}
+	return writeRESPCommand(b.subConn, "SUBSCRIBE", channel)
+}
+
+func (b *redisBackplane) Close() error {
+	b.subMu.Lock()
+	b.closed = true
+	b.subConn.Close()
+	b.subMu.Unlock()
+	b.closeOnce.Do(func() { close(b.done) })
+	return nil
+}
+
+// readLoop - Passes published messages to handlers, reconnecting and subscribing again if the connection is lost
+func (b *redisBackplane) readLoop(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		reply, err := readRESP(reader)
+		if err != nil {
+			if conn = b.reconnect(err); conn == nil {
+				return
+			}
+			reader = bufio.NewReader(conn)
+			continue
+		}
+		// Pushed messages are ["message", channel, data], other replies confirm subscriptions
+		fields, ok := reply.([]interface{})
+		if !ok || len(fields) != 3 || fields[0] != "message" {
+			continue
+		}
+		channel, _ := fields[1].(string)
+		data, _ := fields[2].(string)
+		b.subMu.Lock()
+		handlers := b.handlers[channel]
+		b.subMu.Unlock()
+		for _, handler := range handlers {
+			handler([]byte(data))
+		}
+	}
+}
+
+// reconnect - Dials until the subscription connection is restored. Returns nil once the backplane is closed.
+func (b *redisBackplane) reconnect(cause error) net.Conn {
+	for {
+		b.subMu.Lock()
+		if b.closed {
+			b.subMu.Unlock()
+			return nil
+		}
+		b.subMu.Unlock()
+		b.logger.Warn("Backplane subscription lost, reconnecting", "addr", b.addr, "err", cause)
+		time.Sleep(backplaneReconnectDelay)
+		conn, err := net.DialTimeout("tcp", b.addr, backplaneDialTimeout)
+		if err != nil {
+			cause = err
+			continue
+		}
+		b.subMu.Lock()
+		if b.closed {
+			b.subMu.Unlock()
+			conn.Close()
+			return nil
+		}
+		b.subConn = conn
+		for channel := range b.handlers {
+			if err = writeRESPCommand(conn, "SUBSCRIBE", channel); err != nil {
+				break
+			}
+		}
+		b.subMu.Unlock()
+		if err != nil {
+			conn.Close()
+			cause = err
+			continue
+		}
+		return conn
+	}
+}
+
+// writeRESPCommand - Writes a command as a RESP array of bulk strings
+func writeRESPCommand(w io.Writer, args ...string) error {
+	command := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(w, command)
+	return err
+}
+
+// readRESP - Reads a RESP value. Strings are returned as string, integers as int64,
+// arrays as []interface{} and null as nil. Error replies are returned as an error.
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed RESP line %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, respError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(body)
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		value := make([]byte, length+2)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, err
+		}
+		return string(value[:length]), nil
+	case '*':
+		length, err := strconv.Atoi(body)
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, length)
+		for i := range values {
+			if values[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unknown RESP type %q", kind)
+}
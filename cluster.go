@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Channel every node subscribes to for client and session membership changes
+const clusterChannel = "qrsync:cluster"
+
+// nodeChannel - Channel a node subscribes to for messages to its own clients
+func nodeChannel(nodeID string) string {
+	return "qrsync:node:" + nodeID
+}
+
+// Kinds of clusterEnvelope
+const (
+	clusterClientConnected    = "clientConnected"
+	clusterClientDisconnected = "clientDisconnected"
+	clusterMemberAdded        = "memberAdded"
+	clusterMemberRemoved      = "memberRemoved"
+	clusterDeliver            = "deliver"
+	clusterSessionHandoff     = "sessionHandoff"
+	clusterSessionEnded       = "sessionEnded"
+	clusterKeysRotated        = "keysRotated"
+	clusterClipboardSet       = "clipboardSet"
+	clusterNoteUpdated        = "noteUpdated"
+)
+
+// clusterEnvelope - Message passed between nodes over the backplane.
+// With fanout routing sessions are replicated to every node: membership, key epochs, clipboard
+// entries and note ops are applied by each node, and the node that handled the change sends it on
+// to the session's clients.
+type clusterEnvelope struct {
+	Kind   string `json:"kind"`
+	NodeID string `json:"nodeId"`
+	// Client that connected, disconnected, joined or left a session
+	Client    *Client   `json:"client,omitempty"`
+	ClientID  string    `json:"clientId,omitempty"`
+	SessionID string    `json:"sessionId,omitempty"`
+	OwnerID   string    `json:"ownerId,omitempty"`
+	ClientIDs []string  `json:"clientIds,omitempty"`
+	Created   time.Time `json:"created,omitempty"`
+	// Session handed to a new owner when routing by hash, or joined on another node
+	Session  *StoredSession `json:"session,omitempty"`
+	KeyEpoch int            `json:"keyEpoch,omitempty"`
+	// Clipboard entry set or note ops applied in SessionID
+	Clipboard *ClipboardEntry `json:"clipboard,omitempty"`
+	NoteID    string          `json:"noteId,omitempty"`
+	Ops       []NoteOp        `json:"ops,omitempty"`
+	// Encoded server to client message to deliver to ClientID
+	Message json.RawMessage `json:"message,omitempty"`
+	Trace   messageCarrier  `json:"trace,omitempty"`
+}
+
+// remoteTransport - Transport for a client connected to another node, messages are
+// forwarded to that node over the backplane
+type remoteTransport struct {
+	app      *App
+	nodeID   string
+	clientID string
+}
+
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+func (t *remoteTransport) Send(ctx context.Context, v interface{}) error {
+	msgBytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	carrier := messageCarrier{}
+	tracePropagator.Inject(ctx, carrier)
+	return t.app.publishCluster(nodeChannel(t.nodeID), clusterEnvelope{
+		Kind:     clusterDeliver,
+		ClientID: t.clientID,
+		Message:  msgBytes,
+		Trace:    carrier,
+	})
+}
+
+// Close - The connection belongs to the other node
+func (t *remoteTransport) Close() error {
+	return nil
+}
+
+func (t *remoteTransport) CloseWithReason(code int, text string) error {
+	return nil
+}
+
+func (t *remoteTransport) Done() <-chan struct{} {
+	return closedChan
+}
+
+// clustered - Whether this node shares clients and sessions with other nodes
+func (a *App) clustered() bool {
+	return a.backplane != nil
+}
+
+// joinCluster - Subscribes to membership changes from other nodes and messages for local clients
+func (a *App) joinCluster() error {
+	if err := a.backplane.Subscribe(clusterChannel, a.onClusterMessage); err != nil {
+		return err
+	}
+	return a.backplane.Subscribe(nodeChannel(a.Config.NodeID), a.onClusterMessage)
+}
+
+// publishCluster - Sends an envelope from this node to channel
+func (a *App) publishCluster(channel string, envelope clusterEnvelope) error {
+	envelope.NodeID = a.Config.NodeID
+	envelopeBytes, err := json.Marshal(envelope)
+	if err == nil {
+		err = a.backplane.Publish(channel, envelopeBytes)
+	}
+	if err != nil {
+		a.logger.Error("Could not publish to backplane", "kind", envelope.Kind, "err", err)
+	}
+	return err
+}
+
+// announceClient - Tells other nodes a local client connected or changed
+func (a *App) announceClient(client Client) {
+	if a.clustered() {
+		a.publishCluster(clusterChannel, clusterEnvelope{Kind: clusterClientConnected, Client: &client})
+	}
+}
+
+// announceClientGone - Tells other nodes a local client disconnected
+func (a *App) announceClientGone(clientID string) {
+	if a.clustered() {
+		a.publishCluster(clusterChannel, clusterEnvelope{Kind: clusterClientDisconnected, ClientID: clientID})
+	}
+}
+
+// announceMembership - Tells other nodes clientID joined or left session. Nodes that
+// haven't seen the session before start from the snapshot sent with a join.
+func (a *App) announceMembership(kind string, session Session, clientID string) {
+	envelope := clusterEnvelope{
+		Kind:      kind,
+		ClientID:  clientID,
+		SessionID: session.ID,
+		OwnerID:   session.OwnerID,
+		ClientIDs: session.ClientIDs,
+		Created:   session.createdDate,
+		KeyEpoch:  session.keyEpoch,
+	}
+	if kind == clusterMemberAdded {
+		stored := storedSession(session)
+		envelope.Session = &stored
+	}
+	a.replicateSession(envelope)
+}
+
+// replicateSession - Sends a change to a session to the other nodes.
+// Sessions only live on their owner when routing by hash so aren't shared.
+func (a *App) replicateSession(envelope clusterEnvelope) {
+	if a.clustered() && !a.hashRouting() {
+		a.publishCluster(clusterChannel, envelope)
+	}
+}
+
+// lookupClient - Finds a client connected to this or, in a cluster, any other node
+func (a *App) lookupClient(clientID string) (Client, bool) {
+	if client, connected := a.ClientMap[clientID]; connected {
+		return client, true
+	}
+	client, connected := a.remoteClients[clientID]
+	return client, connected
+}
+
+// onClusterMessage - Applies a change made on another node
+func (a *App) onClusterMessage(data []byte) {
+	var envelope clusterEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		a.logger.Warn("Invalid backplane message", "err", err)
+		return
+	}
+	if envelope.NodeID == a.Config.NodeID {
+		return
+	}
+	ctx := tracePropagator.Extract(context.Background(), envelope.Trace)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch envelope.Kind {
+	case clusterClientConnected:
+		if envelope.Client == nil {
+			a.logger.Warn("Backplane message missing client", "kind", envelope.Kind, "nodeId", envelope.NodeID)
+			return
+		}
+		client := *envelope.Client
+		client.transport = &remoteTransport{app: a, nodeID: envelope.NodeID, clientID: client.ID}
+		a.remoteClients[client.ID] = client
+	case clusterClientDisconnected:
+		// The client may already have reconnected to another node
+		if client, known := a.remoteClients[envelope.ClientID]; known && client.transport.(*remoteTransport).nodeID == envelope.NodeID {
+			delete(a.remoteClients, envelope.ClientID)
+		}
+	case clusterMemberAdded:
+		session, sessionExists := a.SessionMap[envelope.SessionID]
+		if !sessionExists && envelope.Session != nil {
+			session = restoredSession(*envelope.Session)
+		} else if !sessionExists {
+			session = Session{
+				ID:          envelope.SessionID,
+				OwnerID:     envelope.OwnerID,
+				ClientIDs:   []string{},
+				createdDate: envelope.Created,
+				notes:       make(map[string]*NoteDoc),
+				members:     make(map[string]SessionMember),
+			}
+		}
+		session.keyEpoch = max(session.keyEpoch, envelope.KeyEpoch)
+		for _, clientID := range envelope.ClientIDs {
+			if !contains(session.ClientIDs, clientID) {
+				session.ClientIDs = append(session.ClientIDs, clientID)
+			}
+		}
+		a.SessionMap[session.ID] = session
+		// The client was added by another node so this node sends it the session
+		if client, connected := a.ClientMap[envelope.ClientID]; connected {
+			a.welcomeToSession(ctx, session, client, a.newClientJoinedSessionMsg(session, client.ID))
+		}
+	case clusterMemberRemoved:
+		if session, sessionExists := a.SessionMap[envelope.SessionID]; sessionExists {
+			session.ClientIDs = filter(session.ClientIDs, func(ID string) bool {
+				return envelope.ClientID != ID
+			})
+			a.SessionMap[session.ID] = session
+		}
+	case clusterKeysRotated:
+		if session, sessionExists := a.SessionMap[envelope.SessionID]; sessionExists {
+			session.keyEpoch = max(session.keyEpoch, envelope.KeyEpoch)
+			a.SessionMap[session.ID] = session
+		}
+	case clusterClipboardSet:
+		if session, sessionExists := a.SessionMap[envelope.SessionID]; sessionExists && envelope.Clipboard != nil {
+			a.SessionMap[session.ID] = a.addClipboardEntry(session, *envelope.Clipboard)
+		}
+	case clusterNoteUpdated:
+		if session, sessionExists := a.SessionMap[envelope.SessionID]; sessionExists {
+			note, ok := session.notes[envelope.NoteID]
+			if !ok {
+				note = newNoteDoc()
+				session.notes[envelope.NoteID] = note
+			}
+			// The node the ops were sent to already checked them against the limits
+			if _, err := note.Apply(envelope.Ops, 0, 0); err != nil {
+				a.logger.Warn("Could not apply note ops from another node", "sessionId", session.ID, "noteId", envelope.NoteID, "err", err)
+			}
+		}
+	case clusterSessionEnded:
+		a.endSession(ctx, envelope.SessionID)
+	case clusterSessionHandoff:
+		if envelope.Session == nil {
+			a.logger.Warn("Backplane message missing session", "kind", envelope.Kind, "nodeId", envelope.NodeID)
+			return
+		}
+		a.SessionMap[envelope.Session.ID] = restoredSession(*envelope.Session)
+		a.logger.Info("Session handed over", "sessionId", envelope.Session.ID, "fromNodeId", envelope.NodeID)
+	case clusterDeliver:
+		if client, connected := a.ClientMap[envelope.ClientID]; connected {
+			client.transport.Send(ctx, envelope.Message)
+		}
+	}
+}
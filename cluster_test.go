@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// StartRedisStandIn - Minimal server speaking the Redis PUBLISH and SUBSCRIBE protocol
+func StartRedisStandIn(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen %v", err)
+	}
+	var mu sync.Mutex
+	conns := []net.Conn{}
+	subscribers := map[string][]net.Conn{}
+	t.Cleanup(func() {
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go func() {
+				reader := bufio.NewReader(conn)
+				for {
+					command, err := readRESP(reader)
+					if err != nil {
+						return
+					}
+					args := command.([]interface{})
+					mu.Lock()
+					switch args[0] {
+					case "SUBSCRIBE":
+						channel := args[1].(string)
+						subscribers[channel] = append(subscribers[channel], conn)
+						writeRESPCommand(conn, "subscribe", channel)
+					case "PUBLISH":
+						channel := args[1].(string)
+						for _, subscriber := range subscribers[channel] {
+							writeRESPCommand(subscriber, "message", channel, args[2].(string))
+						}
+						conn.Write([]byte(":1\r\n"))
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func StartClusterNode(t *testing.T, nodeID string, backplane Backplane) (*App, string) {
+	app := &App{backplane: backplane}
+	_, wsUrl := StartTestApp(t, app, func(config *Config) { config.NodeID = nodeID })
+	return app, wsUrl
+}
+
+// WaitForRemoteClient - Waits until app has heard from the backplane that clientID connected to another node
+func WaitForRemoteClient(t *testing.T, app *App, clientID string) {
+	for attempt := 0; attempt < 100; attempt++ {
+		app.mu.Lock()
+		_, known := app.remoteClients[clientID]
+		app.mu.Unlock()
+		if known {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Node never heard of client %s", clientID)
+}
+
+func Test_broadcast_reaches_session_members_on_other_nodes(t *testing.T) {
+	redisAddr := StartRedisStandIn(t)
+	backplanes := map[string]func() (Backplane, Backplane){
+		"memory": func() (Backplane, Backplane) {
+			hub := newMemoryBackplane()
+			return hub.node(), hub.node()
+		},
+		"redis": func() (Backplane, Backplane) {
+			backplane1, err := newRedisBackplane(redisAddr, slog.Default())
+			if err != nil {
+				t.Fatalf("Failed to connect to redis stand-in %v", err)
+			}
+			backplane2, _ := newRedisBackplane(redisAddr, slog.Default())
+			return backplane1, backplane2
+		},
+	}
+	for name, newBackplanes := range backplanes {
+		t.Run(name, func(t *testing.T) {
+			backplane1, backplane2 := newBackplanes()
+			defer backplane1.Close()
+			defer backplane2.Close()
+			node1, wsUrl1 := StartClusterNode(t, "node1", backplane1)
+			_, wsUrl2 := StartClusterNode(t, "node2", backplane2)
+
+			ws1, client1ConnectMsg := ConnectClient(t, wsUrl1)
+			defer CloseWithCloseMessage(ws1)
+			ws2, client2ConnectMsg := ConnectClient(t, wsUrl2)
+			defer CloseWithCloseMessage(ws2)
+			if !strings.HasPrefix(client2ConnectMsg.Client.ID, "node2-") {
+				t.Fatalf("Expected client ID to be prefixed with its node but was %s", client2ConnectMsg.Client.ID)
+			}
+			WaitForRemoteClient(t, node1, client2ConnectMsg.Client.ID)
+
+			// Client 1 creates a session on node 1 and adds client 2 from node 2
+			ws1.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+			var client1JoinMsg ClientJoinedSessionMsg
+			ws1.ReadJSON(&client1JoinMsg)
+			ws1.WriteJSON(AddClientToSessionMsg{
+				Type:        "AddClientToSession",
+				SessionID:   client1JoinMsg.SessionID,
+				AddClientID: client2ConnectMsg.Client.ID,
+			})
+			ws1.ReadJSON(&client1JoinMsg)
+			var client2JoinMsg ClientJoinedSessionMsg
+			ws2.ReadJSON(&client2JoinMsg)
+			if client2JoinMsg.SessionID != client1JoinMsg.SessionID || len(client2JoinMsg.ClientMap) != 2 {
+				t.Fatalf("Expected client 2 to join session %s with both clients but got %v", client1JoinMsg.SessionID, client2JoinMsg)
+			}
+
+			ws2.WriteJSON(BroadcastToSessionMsg{Type: "BroadcastToSession", Payload: "from node 2"})
+			var broadcastMsg BroadcastFromSessionMsg
+			ws1.ReadJSON(&broadcastMsg)
+			if broadcastMsg.Payload != "from node 2" || broadcastMsg.SenderID != client2ConnectMsg.Client.ID {
+				t.Fatalf("Expected broadcast from client 2 but got %v", broadcastMsg)
+			}
+			ws2.ReadJSON(&broadcastMsg)
+
+			ws1.WriteJSON(BroadcastToSessionMsg{Type: "BroadcastToSession", Payload: "from node 1"})
+			ws2.ReadJSON(&broadcastMsg)
+			if broadcastMsg.Payload != "from node 1" || broadcastMsg.SenderID != client1ConnectMsg.Client.ID {
+				t.Fatalf("Expected broadcast from client 1 but got %v", broadcastMsg)
+			}
+		})
+	}
+}
+
+func Test_session_state_is_shared_between_fanout_nodes(t *testing.T) {
+	hub := newMemoryBackplane()
+	node1, wsUrl1 := StartClusterNode(t, "node1", hub.node())
+	_, wsUrl2 := StartClusterNode(t, "node2", hub.node())
+	ws1, client1ConnectMsg := ConnectClient(t, wsUrl1)
+	defer CloseWithCloseMessage(ws1)
+	ws2, client2ConnectMsg := ConnectClient(t, wsUrl2)
+	defer CloseWithCloseMessage(ws2)
+	WaitForRemoteClient(t, node1, client2ConnectMsg.Client.ID)
+
+	ws1.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var client1JoinMsg ClientJoinedSessionMsg
+	ws1.ReadJSON(&client1JoinMsg)
+	ws1.WriteJSON(UpdateNoteMsg{Type: "UpdateNote", NoteID: "note1", Ops: []NoteOp{
+		{Kind: noteOpInsert, ID: NoteOpID{ClientID: client1ConnectMsg.Client.ID, Counter: 1}, Value: "h"},
+	}})
+	var noteUpdatedMsg NoteUpdatedMsg
+	ws1.ReadJSON(&noteUpdatedMsg)
+	ws1.WriteJSON(SetClipboardMsg{Type: "SetClipboard", MimeType: "text/plain", Content: "copied on node 1"})
+	var clipboardMsg ClipboardUpdatedMsg
+	ws1.ReadJSON(&clipboardMsg)
+
+	// Client 2 is welcomed by node 2 with the notes and clipboard kept on node 1
+	ws1.WriteJSON(AddClientToSessionMsg{Type: "AddClientToSession", SessionID: client1JoinMsg.SessionID, AddClientID: client2ConnectMsg.Client.ID})
+	ws1.ReadJSON(&client1JoinMsg)
+	var client2JoinMsg ClientJoinedSessionMsg
+	ws2.ReadJSON(&client2JoinMsg)
+	var snapshotMsg NoteSnapshotMsg
+	ws2.ReadJSON(&snapshotMsg)
+	if snapshotMsg.NoteID != "note1" || len(snapshotMsg.Elements) != 1 {
+		t.Fatalf("Expected note from node 1 but got %v", snapshotMsg)
+	}
+	var historyMsg ClipboardHistoryMsg
+	ws2.ReadJSON(&historyMsg)
+	if len(historyMsg.Entries) != 1 || historyMsg.Entries[0].Content != "copied on node 1" {
+		t.Fatalf("Expected clipboard from node 1 but got %v", historyMsg)
+	}
+
+	// Node 2 knows the key epoch node 1 moved the session to
+	if client2JoinMsg.KeyEpoch != client1JoinMsg.KeyEpoch {
+		t.Fatalf("Expected both clients to be at key epoch %d but client 2 was at %d", client1JoinMsg.KeyEpoch, client2JoinMsg.KeyEpoch)
+	}
+	ws2.WriteJSON(SendEncryptedMsg{
+		Type:     "SendEncrypted",
+		KeyEpoch: client2JoinMsg.KeyEpoch,
+		Envelopes: []EncryptedEnvelope{
+			{ToClientID: client1ConnectMsg.Client.ID, Ciphertext: "b3BhcXVl", Nonce: "bm9uY2U="},
+		},
+	})
+	var encryptedMsg EncryptedFromSessionMsg
+	ws1.ReadJSON(&encryptedMsg)
+	if encryptedMsg.Type != "EncryptedFromSession" || encryptedMsg.SenderID != client2ConnectMsg.Client.ID {
+		t.Fatalf("Expected encrypted message relayed from node 2 but got %v", encryptedMsg)
+	}
+
+	// Edits on node 2 reach node 1's copy of the note
+	ws2.WriteJSON(UpdateNoteMsg{Type: "UpdateNote", NoteID: "note1", Ops: []NoteOp{
+		{Kind: noteOpInsert, ID: NoteOpID{ClientID: client2ConnectMsg.Client.ID, Counter: 2}, Origin: &NoteOpID{ClientID: client1ConnectMsg.Client.ID, Counter: 1}, Value: "i"},
+	}})
+	ws1.ReadJSON(&noteUpdatedMsg)
+	WaitFor(t, "note edit to reach node 1", func() bool {
+		node1.mu.Lock()
+		defer node1.mu.Unlock()
+		return node1.SessionMap[client1JoinMsg.SessionID].notes["note1"].Text() == "hi"
+	})
+}
+
+func Test_partial_backplane_messages_are_ignored(t *testing.T) {
+	hub := newMemoryBackplane()
+	node, _ := StartClusterNode(t, "node1", hub.node())
+	for _, kind := range []string{clusterClientConnected, clusterSessionHandoff} {
+		node.onClusterMessage([]byte(`{"kind":"` + kind + `","nodeId":"node2"}`))
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if len(node.remoteClients) != 0 || len(node.SessionMap) != 0 {
+		t.Fatalf("Expected messages without a client or session to change nothing")
+	}
+}
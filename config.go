@@ -0,0 +1,594 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config - Server settings. Values are read from defaults, then the config file,
+// then QRSYNC_* environment variables and finally command line flags.
+type Config struct {
+	ListenAddr  string `yaml:"listenAddr"`
+	TLSCertFile string `yaml:"tlsCertFile"`
+	TLSKeyFile  string `yaml:"tlsKeyFile"`
+	// Browser origins allowed to call the API and open websockets, besides pages served by this host.
+	// "*" allows any origin and https://*.example.com any subdomain of example.com.
+	CORSOrigins []string `yaml:"corsOrigins"`
+	// Allows localhost origins and should only be used for local development
+	DevMode         bool          `yaml:"devMode"`
+	ClientTTL       time.Duration `yaml:"clientTTL"`
+	SessionTTL      time.Duration `yaml:"sessionTTL"`
+	MaxMessageBytes int64         `yaml:"maxMessageBytes"`
+	// Largest message accepted of each client message type, others are limited by maxMessageBytes
+	MaxMessageBytesByType map[string]int64 `yaml:"maxMessageBytesByType"`
+	// Rate limits and maximums protecting the server from misbehaving clients
+	Limits LimitsConfig `yaml:"limits"`
+	// Clipboard entries kept per session and sent to clients that join, 0 keeps none
+	ClipboardHistoryLength int `yaml:"clipboardHistoryLength"`
+	// Where session state is kept, "memory" or "file"
+	StoreBackend string `yaml:"storeBackend"`
+	StorePath    string `yaml:"storePath"`
+	// How long to wait for clients to be flushed on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	// Reconnect delay suggested to clients when the server shuts down
+	ReconnectAfter time.Duration `yaml:"reconnectAfter"`
+	// debug, info, warn or error. Message bodies are only logged at debug.
+	LogLevel string `yaml:"logLevel"`
+	// json or text
+	LogFormat string `yaml:"logFormat"`
+	// Where user accounts are kept: none disables accounts, memory or file
+	AccountsBackend string `yaml:"accountsBackend"`
+	// File accounts and password hashes are written to by the file backend
+	AccountsPath string `yaml:"accountsPath"`
+	// Identity providers whose bearer JWTs clients may connect with
+	OIDCIssuers []OIDCIssuerConfig `yaml:"oidcIssuers"`
+	// Whether clients may connect without a bearer token, only disabled when oidcIssuers are configured
+	AllowAnonymous bool `yaml:"allowAnonymous"`
+	// Bearer token for the admin API, which is disabled when empty
+	AdminToken string `yaml:"adminToken"`
+	// Bearer tokens for the integration API keyed by integration name, which is disabled when empty
+	IntegrationTokens map[string]string `yaml:"integrationTokens"`
+	// Subscriptions POSTed session lifecycle events
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+	// Delay before the first webhook retry, doubled for each later attempt
+	WebhookRetryBackoff time.Duration `yaml:"webhookRetryBackoff"`
+	// File undeliverable webhook events are appended to, they are logged when empty
+	WebhookDeadLetterPath string `yaml:"webhookDeadLetterPath"`
+	// Pub/sub backplane shared with other nodes: none for a single node, or redis
+	Backplane string `yaml:"backplane"`
+	// host:port of the backplane server
+	BackplaneAddr string `yaml:"backplaneAddr"`
+	// Unique name of this node in a cluster, generated when empty
+	NodeID string `yaml:"nodeId"`
+	// How sessions are spread over a cluster: fanout lets members connect to any node,
+	// hash serves each session from one node and proxies its clients there
+	SessionRouting string `yaml:"sessionRouting"`
+	// URL other nodes proxy clients to, e.g. http://10.0.0.2:4010. Required for hash routing.
+	// Must not have a path, proxied requests are signed for the path they were sent to.
+	AdvertiseAddr string `yaml:"advertiseAddr"`
+	// Secret shared by the nodes of a cluster to sign requests they proxy to each other.
+	// Required for hash routing.
+	ClusterSecret string `yaml:"clusterSecret"`
+	// Where spans are sent: none, stdout, file or otlp
+	TraceExporter string `yaml:"traceExporter"`
+	// File written by the file trace exporter
+	TraceFile string `yaml:"traceFile"`
+	// OTLP http endpoint, defaults to the OTEL_EXPORTER_OTLP_* environment variables when empty
+	OTLPEndpoint string `yaml:"otlpEndpoint"`
+}
+
+// DefaultConfig - Settings used when nothing else is configured
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddr:      ":4010",
+		CORSOrigins:     []string{},
+		ClientTTL:       2 * time.Hour,
+		SessionTTL:      24 * time.Hour,
+		MaxMessageBytes: 1024 * 1024,
+		MaxMessageBytesByType: map[string]int64{
+			"UpdateClient":        4 * 1024,
+			"CreateSession":       1024,
+			"AddClientToSession":  1024,
+			"RtcOffer":            32 * 1024,
+			"RtcAnswer":           32 * 1024,
+			"RtcIceCandidate":     4 * 1024,
+			"PublishKey":          1024,
+			"Register":            1024,
+			"Login":               1024,
+			"LinkDevice":          1024,
+			"InviteTrustedDevice": 1024,
+			"RevokeTrustedDevice": 1024,
+			"PairAccept":          1024,
+		},
+		Limits:                 DefaultLimits(),
+		ClipboardHistoryLength: 10,
+		StoreBackend:           "memory",
+		AccountsBackend:        "none",
+		AllowAnonymous:         true,
+		ShutdownTimeout:        10 * time.Second,
+		ReconnectAfter:         5 * time.Second,
+		LogLevel:               "info",
+		LogFormat:              "json",
+		TraceExporter:          "none",
+		Backplane:              "none",
+		SessionRouting:         "fanout",
+		WebhookRetryBackoff:    time.Second,
+	}
+}
+
+// UseTLS - Whether the server should serve https and wss
+func (c *Config) UseTLS() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// Validate - Checks settings are usable
+func (c *Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		return fmt.Errorf("listenAddr %q: %v", c.ListenAddr, err)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("tlsCertFile and tlsKeyFile must be set together")
+	}
+	if _, err := newOriginPolicy(c.CORSOrigins, c.DevMode); err != nil {
+		return fmt.Errorf("corsOrigins: %v", err)
+	}
+	if c.ClientTTL <= 0 || c.SessionTTL <= 0 {
+		return errors.New("clientTTL and sessionTTL must be positive")
+	}
+	if c.ShutdownTimeout <= 0 || c.ReconnectAfter < 0 {
+		return errors.New("shutdownTimeout must be positive and reconnectAfter not negative")
+	}
+	if c.MaxMessageBytes <= 0 {
+		return errors.New("maxMessageBytes must be positive")
+	}
+	for msgType, maxBytes := range c.MaxMessageBytesByType {
+		if _, known := inboundMsgTypes[msgType]; !known {
+			return fmt.Errorf("maxMessageBytesByType: unknown message type %q", msgType)
+		}
+		if maxBytes <= 0 || maxBytes > c.MaxMessageBytes {
+			return fmt.Errorf("maxMessageBytesByType %s must be positive and at most maxMessageBytes", msgType)
+		}
+	}
+	if err := c.Limits.Validate(); err != nil {
+		return fmt.Errorf("limits: %v", err)
+	}
+	if c.ClipboardHistoryLength < 0 {
+		return errors.New("clipboardHistoryLength must not be negative")
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return fmt.Errorf("logLevel: %v", err)
+	}
+	if c.LogFormat != "json" && c.LogFormat != "text" {
+		return fmt.Errorf("unknown logFormat %q", c.LogFormat)
+	}
+	for name, token := range c.IntegrationTokens {
+		if name == "" || token == "" {
+			return errors.New("integrationTokens must have a name and token")
+		}
+	}
+	for _, webhook := range c.Webhooks {
+		if err := webhook.Validate(); err != nil {
+			return fmt.Errorf("webhooks: %v", err)
+		}
+	}
+	if c.WebhookRetryBackoff <= 0 {
+		return errors.New("webhookRetryBackoff must be positive")
+	}
+	switch c.TraceExporter {
+	case "none", "stdout", "otlp":
+	case "file":
+		if c.TraceFile == "" {
+			return errors.New("traceFile is required for the file trace exporter")
+		}
+	default:
+		return fmt.Errorf("unknown traceExporter %q", c.TraceExporter)
+	}
+	switch c.Backplane {
+	case "none":
+	case "redis":
+		if c.BackplaneAddr == "" {
+			return errors.New("backplaneAddr is required for the redis backplane")
+		}
+	default:
+		return fmt.Errorf("unknown backplane %q", c.Backplane)
+	}
+	switch c.SessionRouting {
+	case "fanout":
+	case "hash":
+		if c.Backplane == "none" {
+			return errors.New("hash session routing needs a backplane")
+		}
+		advertiseURL, err := url.Parse(c.AdvertiseAddr)
+		if err != nil || advertiseURL.Scheme == "" || advertiseURL.Host == "" {
+			return errors.New("advertiseAddr must be a url for hash session routing")
+		}
+		if strings.Trim(advertiseURL.Path, "/") != "" || advertiseURL.RawQuery != "" {
+			return errors.New("advertiseAddr must not have a path or query")
+		}
+		if c.ClusterSecret == "" {
+			return errors.New("clusterSecret is required for hash session routing")
+		}
+	default:
+		return fmt.Errorf("unknown sessionRouting %q", c.SessionRouting)
+	}
+	switch c.AccountsBackend {
+	case "none", "memory":
+	case "file":
+		if c.AccountsPath == "" {
+			return errors.New("accountsPath is required for the file accounts backend")
+		}
+	default:
+		return fmt.Errorf("unknown accountsBackend %q", c.AccountsBackend)
+	}
+	for _, issuer := range c.OIDCIssuers {
+		if err := issuer.Validate(); err != nil {
+			return fmt.Errorf("oidcIssuers: %v", err)
+		}
+	}
+	if !c.AllowAnonymous && len(c.OIDCIssuers) == 0 {
+		return errors.New("allowAnonymous can only be disabled when oidcIssuers are configured")
+	}
+	switch c.StoreBackend {
+	case "memory":
+	case "file":
+		if c.StorePath == "" {
+			return errors.New("storePath is required for the file store")
+		}
+	default:
+		return fmt.Errorf("unknown storeBackend %q", c.StoreBackend)
+	}
+	return nil
+}
+
+// decodeConfigFile - Reads settings from a TOML file when path ends in .toml, otherwise YAML.
+// TOML keys are matched to fields ignoring case so they are the same as the YAML keys.
+func decodeConfigFile(path string, config *Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if strings.HasSuffix(path, ".toml") {
+		meta, err := toml.NewDecoder(file).Decode(config)
+		if err != nil {
+			return err
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown field %q", undecoded[0].String())
+		}
+		return nil
+	}
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// LoadConfig - Builds config from the config file, environment and command line args
+func LoadConfig(args []string, getenv func(string) string) (*Config, error) {
+	config := DefaultConfig()
+
+	flags := flag.NewFlagSet("qrsync-server", flag.ContinueOnError)
+	configPath := flags.String("config", getenv("QRSYNC_CONFIG"), "path to yaml or toml config file")
+	listenAddr := flags.String("listen", "", "address to listen on, e.g. :4010")
+	tlsCertFile := flags.String("tls-cert", "", "tls certificate file")
+	tlsKeyFile := flags.String("tls-key", "", "tls key file")
+	corsOrigins := flags.String("cors-origins", "", "comma separated allowed origins")
+	devMode := flags.Bool("dev", false, "allow localhost origins for local development")
+	clientTTL := flags.Duration("client-ttl", 0, "how long clients are kept after their last message")
+	sessionTTL := flags.Duration("session-ttl", 0, "how long sessions are kept after being created")
+	maxMessageBytes := flags.Int64("max-message-bytes", 0, "largest websocket message accepted")
+	maxSessionsPerClient := flags.Int("max-sessions-per-client", 0, "sessions a client may own, 0 for no limit")
+	maxSessionsPerIP := flags.Int("max-sessions-per-ip", 0, "sessions clients from one ip may own, 0 for no limit")
+	maxClientsPerSession := flags.Int("max-clients-per-session", 0, "clients a session may have, 0 for no limit")
+	maxConnectionsPerIP := flags.Int("max-connections-per-ip", 0, "clients that may connect from one ip, 0 for no limit")
+	clipboardHistoryLength := flags.Int("clipboard-history", 0, "clipboard entries kept per session, 0 keeps none")
+	storeBackend := flags.String("store", "", "store backend, memory or file")
+	storePath := flags.String("store-path", "", "file used by the file store")
+	accountsBackend := flags.String("accounts", "", "user accounts backend, none, memory or file")
+	accountsPath := flags.String("accounts-path", "", "file used by the file accounts backend")
+	oidcIssuer := flags.String("oidc-issuer", "", "issuer of bearer tokens clients may connect with")
+	oidcAudience := flags.String("oidc-audience", "", "audience bearer tokens must be for")
+	oidcJWKSURL := flags.String("oidc-jwks-url", "", "url of the issuer's signing keys, discovered when empty")
+	allowAnonymous := flags.Bool("allow-anonymous", true, "allow clients to connect without a bearer token")
+	shutdownTimeout := flags.Duration("shutdown-timeout", 0, "how long to wait for clients on shutdown")
+	reconnectAfter := flags.Duration("reconnect-after", 0, "reconnect delay suggested to clients on shutdown")
+	logLevel := flags.String("log-level", "", "debug, info, warn or error")
+	logFormat := flags.String("log-format", "", "json or text")
+	traceExporter := flags.String("trace-exporter", "", "none, stdout, file or otlp")
+	traceFile := flags.String("trace-file", "", "file used by the file trace exporter")
+	webhookDeadLetterPath := flags.String("webhook-dead-letter-path", "", "file undeliverable webhook events are appended to")
+	backplane := flags.String("backplane", "", "cluster backplane, none or redis")
+	backplaneAddr := flags.String("backplane-addr", "", "backplane server host:port")
+	nodeID := flags.String("node-id", "", "unique name of this node in a cluster")
+	sessionRouting := flags.String("session-routing", "", "fanout or hash")
+	advertiseAddr := flags.String("advertise-addr", "", "url other nodes proxy clients to")
+	clusterSecret := flags.String("cluster-secret", "", "secret shared by cluster nodes to sign proxied requests")
+	otlpEndpoint := flags.String("otlp-endpoint", "", "otlp http endpoint url")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configPath != "" {
+		if err := decodeConfigFile(*configPath, config); err != nil {
+			return nil, fmt.Errorf("%s: %v", *configPath, err)
+		}
+	}
+
+	if err := applyConfigEnv(config, getenv); err != nil {
+		return nil, err
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			config.ListenAddr = *listenAddr
+		case "tls-cert":
+			config.TLSCertFile = *tlsCertFile
+		case "tls-key":
+			config.TLSKeyFile = *tlsKeyFile
+		case "cors-origins":
+			config.CORSOrigins = splitList(*corsOrigins)
+		case "dev":
+			config.DevMode = *devMode
+		case "client-ttl":
+			config.ClientTTL = *clientTTL
+		case "session-ttl":
+			config.SessionTTL = *sessionTTL
+		case "max-message-bytes":
+			config.MaxMessageBytes = *maxMessageBytes
+		case "max-sessions-per-client":
+			config.Limits.MaxSessionsPerClient = *maxSessionsPerClient
+		case "max-sessions-per-ip":
+			config.Limits.MaxSessionsPerIP = *maxSessionsPerIP
+		case "max-clients-per-session":
+			config.Limits.MaxClientsPerSession = *maxClientsPerSession
+		case "max-connections-per-ip":
+			config.Limits.MaxConnectionsPerIP = *maxConnectionsPerIP
+		case "clipboard-history":
+			config.ClipboardHistoryLength = *clipboardHistoryLength
+		case "store":
+			config.StoreBackend = *storeBackend
+		case "store-path":
+			config.StorePath = *storePath
+		case "accounts":
+			config.AccountsBackend = *accountsBackend
+		case "accounts-path":
+			config.AccountsPath = *accountsPath
+		case "oidc-issuer":
+			firstOIDCIssuer(config).Issuer = *oidcIssuer
+		case "oidc-audience":
+			firstOIDCIssuer(config).Audience = *oidcAudience
+		case "oidc-jwks-url":
+			firstOIDCIssuer(config).JWKSURL = *oidcJWKSURL
+		case "allow-anonymous":
+			config.AllowAnonymous = *allowAnonymous
+		case "shutdown-timeout":
+			config.ShutdownTimeout = *shutdownTimeout
+		case "reconnect-after":
+			config.ReconnectAfter = *reconnectAfter
+		case "log-level":
+			config.LogLevel = *logLevel
+		case "log-format":
+			config.LogFormat = *logFormat
+		case "trace-exporter":
+			config.TraceExporter = *traceExporter
+		case "trace-file":
+			config.TraceFile = *traceFile
+		case "webhook-dead-letter-path":
+			config.WebhookDeadLetterPath = *webhookDeadLetterPath
+		case "backplane":
+			config.Backplane = *backplane
+		case "backplane-addr":
+			config.BackplaneAddr = *backplaneAddr
+		case "node-id":
+			config.NodeID = *nodeID
+		case "session-routing":
+			config.SessionRouting = *sessionRouting
+		case "advertise-addr":
+			config.AdvertiseAddr = *advertiseAddr
+		case "cluster-secret":
+			config.ClusterSecret = *clusterSecret
+		case "otlp-endpoint":
+			config.OTLPEndpoint = *otlpEndpoint
+		}
+	})
+	config.capDefaultMessageLimits()
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// capDefaultMessageLimits - Lowers built in per type limits to maxMessageBytes when it is set
+// lower, so the global limit can be lowered without overriding every type. Limits the operator
+// changed are left for Validate to check.
+func (c *Config) capDefaultMessageLimits() {
+	for msgType, defaultBytes := range DefaultConfig().MaxMessageBytesByType {
+		if c.MaxMessageBytesByType[msgType] == defaultBytes && defaultBytes > c.MaxMessageBytes {
+			c.MaxMessageBytesByType[msgType] = c.MaxMessageBytes
+		}
+	}
+}
+
+func applyConfigEnv(config *Config, getenv func(string) string) error {
+	envString(getenv, "QRSYNC_LISTEN_ADDR", &config.ListenAddr)
+	envString(getenv, "QRSYNC_TLS_CERT_FILE", &config.TLSCertFile)
+	envString(getenv, "QRSYNC_TLS_KEY_FILE", &config.TLSKeyFile)
+	if v := getenv("QRSYNC_CORS_ORIGINS"); v != "" {
+		config.CORSOrigins = splitList(v)
+	}
+	envString(getenv, "QRSYNC_STORE", &config.StoreBackend)
+	envString(getenv, "QRSYNC_STORE_PATH", &config.StorePath)
+	envString(getenv, "QRSYNC_ACCOUNTS", &config.AccountsBackend)
+	envString(getenv, "QRSYNC_ACCOUNTS_PATH", &config.AccountsPath)
+	if v := getenv("QRSYNC_OIDC_ISSUER"); v != "" {
+		firstOIDCIssuer(config).Issuer = v
+	}
+	if v := getenv("QRSYNC_OIDC_AUDIENCE"); v != "" {
+		firstOIDCIssuer(config).Audience = v
+	}
+	if v := getenv("QRSYNC_OIDC_JWKS_URL"); v != "" {
+		firstOIDCIssuer(config).JWKSURL = v
+	}
+	envString(getenv, "QRSYNC_LOG_LEVEL", &config.LogLevel)
+	envString(getenv, "QRSYNC_LOG_FORMAT", &config.LogFormat)
+	envString(getenv, "QRSYNC_ADMIN_TOKEN", &config.AdminToken)
+	if v := getenv("QRSYNC_INTEGRATION_TOKENS"); v != "" {
+		config.IntegrationTokens = map[string]string{}
+		for _, pair := range splitList(v) {
+			name, token, _ := strings.Cut(pair, "=")
+			config.IntegrationTokens[name] = token
+		}
+	}
+	envString(getenv, "QRSYNC_WEBHOOK_DEAD_LETTER_PATH", &config.WebhookDeadLetterPath)
+	envString(getenv, "QRSYNC_BACKPLANE", &config.Backplane)
+	envString(getenv, "QRSYNC_BACKPLANE_ADDR", &config.BackplaneAddr)
+	envString(getenv, "QRSYNC_NODE_ID", &config.NodeID)
+	envString(getenv, "QRSYNC_SESSION_ROUTING", &config.SessionRouting)
+	envString(getenv, "QRSYNC_ADVERTISE_ADDR", &config.AdvertiseAddr)
+	envString(getenv, "QRSYNC_CLUSTER_SECRET", &config.ClusterSecret)
+	envString(getenv, "QRSYNC_TRACE_EXPORTER", &config.TraceExporter)
+	envString(getenv, "QRSYNC_TRACE_FILE", &config.TraceFile)
+	envString(getenv, "QRSYNC_OTLP_ENDPOINT", &config.OTLPEndpoint)
+	for _, err := range []error{
+		envBool(getenv, "QRSYNC_DEV_MODE", &config.DevMode),
+		envBool(getenv, "QRSYNC_ALLOW_ANONYMOUS", &config.AllowAnonymous),
+		envDuration(getenv, "QRSYNC_CLIENT_TTL", &config.ClientTTL),
+		envDuration(getenv, "QRSYNC_SESSION_TTL", &config.SessionTTL),
+		envInt64(getenv, "QRSYNC_MAX_MESSAGE_BYTES", &config.MaxMessageBytes),
+		envInt(getenv, "QRSYNC_MAX_SESSIONS_PER_CLIENT", &config.Limits.MaxSessionsPerClient),
+		envInt(getenv, "QRSYNC_MAX_SESSIONS_PER_IP", &config.Limits.MaxSessionsPerIP),
+		envInt(getenv, "QRSYNC_MAX_CLIENTS_PER_SESSION", &config.Limits.MaxClientsPerSession),
+		envInt(getenv, "QRSYNC_MAX_CONNECTIONS_PER_IP", &config.Limits.MaxConnectionsPerIP),
+		envInt(getenv, "QRSYNC_CLIPBOARD_HISTORY", &config.ClipboardHistoryLength),
+		envDuration(getenv, "QRSYNC_SHUTDOWN_TIMEOUT", &config.ShutdownTimeout),
+		envDuration(getenv, "QRSYNC_RECONNECT_AFTER", &config.ReconnectAfter),
+		envDuration(getenv, "QRSYNC_WEBHOOK_RETRY_BACKOFF", &config.WebhookRetryBackoff),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// firstOIDCIssuer - Issuer set by the oidc flags and environment variables, added if there are none
+func firstOIDCIssuer(config *Config) *OIDCIssuerConfig {
+	if len(config.OIDCIssuers) == 0 {
+		config.OIDCIssuers = []OIDCIssuerConfig{{}}
+	}
+	return &config.OIDCIssuers[0]
+}
+
+func envString(getenv func(string) string, key string, value *string) {
+	if v := getenv(key); v != "" {
+		*value = v
+	}
+}
+
+func envBool(getenv func(string) string, key string, value *bool) error {
+	if v := getenv(key); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		*value = b
+	}
+	return nil
+}
+
+func envDuration(getenv func(string) string, key string, value *time.Duration) error {
+	if v := getenv(key); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		*value = d
+	}
+	return nil
+}
+
+func envInt64(getenv func(string) string, key string, value *int64) error {
+	if v := getenv(key); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		*value = n
+	}
+	return nil
+}
+
+func envInt(getenv func(string) string, key string, value *int) error {
+	if v := getenv(key); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		*value = n
+	}
+	return nil
+}
+
+// Shown by PrintConfig in place of secrets that are set
+const redactedSecret = "<redacted>"
+
+// PrintConfig - Writes the effective config as yaml, with secrets redacted
+func PrintConfig(w io.Writer, config *Config) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	defer encoder.Close()
+	return encoder.Encode(config.redacted())
+}
+
+// redacted - Copy of the config with secrets replaced, so it can be shown to operators
+func (c *Config) redacted() *Config {
+	redacted := *c
+	redact := func(secret string) string {
+		if secret == "" {
+			return ""
+		}
+		return redactedSecret
+	}
+	redacted.AdminToken = redact(c.AdminToken)
+	redacted.ClusterSecret = redact(c.ClusterSecret)
+	if c.IntegrationTokens != nil {
+		redacted.IntegrationTokens = make(map[string]string, len(c.IntegrationTokens))
+		for name, token := range c.IntegrationTokens {
+			redacted.IntegrationTokens[name] = redact(token)
+		}
+	}
+	redacted.Webhooks = make([]WebhookConfig, len(c.Webhooks))
+	for i, webhook := range c.Webhooks {
+		webhook.Secret = redact(webhook.Secret)
+		redacted.Webhooks[i] = webhook
+	}
+	return &redacted
+}
+
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
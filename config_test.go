@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_config_flags_override_env_and_file(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(configPath, []byte("listenAddr: \":5000\"\nclientTTL: 1h\nsessionTTL: 1h\n"), 0644)
+	env := map[string]string{
+		"QRSYNC_CLIENT_TTL":  "30m",
+		"QRSYNC_SESSION_TTL": "45m",
+	}
+
+	config, err := LoadConfig(
+		[]string{"-config", configPath, "-session-ttl", "10m"},
+		func(key string) string { return env[key] },
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error loading config %v", err)
+	}
+	if config.ListenAddr != ":5000" {
+		t.Fatalf("Expected listen address from file but was %s", config.ListenAddr)
+	}
+	if config.ClientTTL != 30*time.Minute {
+		t.Fatalf("Expected client ttl from env but was %v", config.ClientTTL)
+	}
+	if config.SessionTTL != 10*time.Minute {
+		t.Fatalf("Expected session ttl from flag but was %v", config.SessionTTL)
+	}
+}
+
+func Test_config_requires_tls_cert_and_key_together(t *testing.T) {
+	_, err := LoadConfig([]string{"-tls-cert", "ssl/server.crt"}, func(string) string { return "" })
+	if err == nil {
+		t.Fatalf("Expected error when tls key is missing")
+	}
+}
+
+func Test_config_advertise_addr_must_not_have_a_path(t *testing.T) {
+	args := []string{"-backplane", "redis", "-backplane-addr", "localhost:6379", "-session-routing", "hash", "-cluster-secret", "secret"}
+	if _, err := LoadConfig(append(args, "-advertise-addr", "http://10.0.0.2:4010/"), func(string) string { return "" }); err != nil {
+		t.Fatalf("Unexpected error for advertise address without a path %v", err)
+	}
+	if _, err := LoadConfig(append(args, "-advertise-addr", "http://10.0.0.2:4010/qrsync"), func(string) string { return "" }); err == nil {
+		t.Fatalf("Expected error when advertise address has a path")
+	}
+}
+
+func Test_config_rejects_unknown_file_keys(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(configPath, []byte("listenPort: 4010\n"), 0644)
+	_, err := LoadConfig([]string{"-config", configPath}, func(string) string { return "" })
+	if err == nil {
+		t.Fatalf("Expected error for unknown config key")
+	}
+}
+
+func Test_config_reads_integration_tokens_from_env(t *testing.T) {
+	env := map[string]string{"QRSYNC_INTEGRATION_TOKENS": "boarding=secret1, billing=secret2"}
+	config, err := LoadConfig([]string{}, func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatalf("Unexpected error loading config %v", err)
+	}
+	if config.IntegrationTokens["boarding"] != "secret1" || config.IntegrationTokens["billing"] != "secret2" {
+		t.Fatalf("Expected integration tokens from env but was %v", config.IntegrationTokens)
+	}
+}
+
+func Test_config_limits_from_file_keep_other_defaults(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(configPath, []byte("limits:\n  clientMessages:\n    SetClipboard: {perSecond: 1, burst: 2}\n"), 0644)
+	env := map[string]string{"QRSYNC_MAX_CONNECTIONS_PER_IP": "5"}
+	config, err := LoadConfig([]string{"-config", configPath}, func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatalf("Unexpected error loading config %v", err)
+	}
+	if config.Limits.ClientMessages["SetClipboard"].Burst != 2 {
+		t.Fatalf("Expected clipboard limit from file but was %v", config.Limits.ClientMessages)
+	}
+	if _, kept := config.Limits.ClientMessages[allMessageTypes]; !kept || config.Limits.MaxSessionsPerClient != DefaultLimits().MaxSessionsPerClient {
+		t.Fatalf("Expected limits missing from the file to keep their defaults but were %v", config.Limits)
+	}
+	if config.Limits.MaxConnectionsPerIP != 5 {
+		t.Fatalf("Expected connection limit from env but was %d", config.Limits.MaxConnectionsPerIP)
+	}
+}
+
+func Test_config_is_read_from_toml_files(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(configPath, []byte(`listenAddr = ":8443"
+clientTTL = "30m"
+corsOrigins = ["https://app.example.com"]
+
+[limits]
+maxClientsPerSession = 3
+
+[limits.clientMessages.SetClipboard]
+perSecond = 1.0
+burst = 2
+`), 0644)
+	config, err := LoadConfig([]string{"-config", configPath}, func(string) string { return "" })
+	if err != nil {
+		t.Fatalf("Unexpected error loading config %v", err)
+	}
+	if config.ListenAddr != ":8443" || config.ClientTTL != 30*time.Minute || len(config.CORSOrigins) != 1 {
+		t.Fatalf("Expected settings from toml file but got %v", config)
+	}
+	if config.Limits.MaxClientsPerSession != 3 || config.Limits.ClientMessages["SetClipboard"].Burst != 2 || config.Limits.MaxSessionsPerClient != DefaultLimits().MaxSessionsPerClient {
+		t.Fatalf("Expected limits from toml file with other defaults kept but got %v", config.Limits)
+	}
+
+	os.WriteFile(configPath, []byte("listenAdress = \":8443\"\n"), 0644)
+	if _, err := LoadConfig([]string{"-config", configPath}, func(string) string { return "" }); err == nil {
+		t.Fatalf("Expected unknown toml key to be refused")
+	}
+}
+
+func Test_printed_config_redacts_secrets(t *testing.T) {
+	config := DefaultConfig()
+	config.AdminToken = "admin-secret"
+	config.ClusterSecret = "cluster-secret"
+	config.IntegrationTokens = map[string]string{"ci": "integration-secret"}
+	config.Webhooks = []WebhookConfig{{URL: "https://hooks.example.com", Secret: "webhook-secret"}}
+	var printed strings.Builder
+	if err := PrintConfig(&printed, config); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	for _, secret := range []string{"admin-secret", "cluster-secret", "integration-secret", "webhook-secret"} {
+		if strings.Contains(printed.String(), secret) {
+			t.Fatalf("Expected %s to be redacted but got\n%s", secret, printed.String())
+		}
+	}
+	if !strings.Contains(printed.String(), "ci: "+redactedSecret) || config.Webhooks[0].Secret != "webhook-secret" {
+		t.Fatalf("Expected secrets to be replaced in a copy of the config but got\n%s", printed.String())
+	}
+}
+
+func Test_config_max_message_bytes_can_be_lowered_below_type_defaults(t *testing.T) {
+	config, err := LoadConfig([]string{"-max-message-bytes", "16384"}, func(string) string { return "" })
+	if err != nil {
+		t.Fatalf("Unexpected error loading config %v", err)
+	}
+	if config.MaxMessageBytesByType["RtcOffer"] != 16384 || config.MaxMessageBytesByType["UpdateClient"] != DefaultConfig().MaxMessageBytesByType["UpdateClient"] {
+		t.Fatalf("Expected only type defaults above the global limit to be lowered but were %v", config.MaxMessageBytesByType)
+	}
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(configPath, []byte("maxMessageBytesByType:\n  RtcOffer: 20000\n"), 0644)
+	if _, err := LoadConfig([]string{"-config", configPath, "-max-message-bytes", "16384"}, func(string) string { return "" }); err == nil {
+		t.Fatalf("Expected a configured type limit above maxMessageBytes to be refused")
+	}
+}
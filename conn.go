@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Number of messages that can be waiting to be written to a client
+const sendQueueLength = 256
+
+// How long a single write to a client may take
+const writeTimeout = 10 * time.Second
+
+// How often idle connections are pinged to keep proxies from closing them
+const pingInterval = 25 * time.Second
+
+var errSendQueueFull = errors.New("send queue full")
+var errConnClosed = errors.New("connection closed")
+
+// queuedMsg - Message waiting to be written along with the context of the handler that sent it
+type queuedMsg struct {
+	ctx context.Context
+	msg interface{}
+}
+
+// Transport - Delivers server to client messages over a websocket, event stream or long polling.
+// The rest of the server only talks to clients through this interface.
+type Transport interface {
+	// Send - Queues a message for the client without blocking.
+	// The trace context in ctx is added to the message so clients can link their traces.
+	Send(ctx context.Context, v interface{}) error
+	// Close - Delivers any queued messages then ends the connection
+	Close() error
+	// CloseWithReason - Like Close but tells the client why, if the transport supports it
+	CloseWithReason(code int, text string) error
+	// Done - Closed once queued messages have been delivered and the connection has ended
+	Done() <-chan struct{}
+}
+
+// messageWriter - Writes encoded messages to a client over a particular transport.
+// Only ever called from the clientConn write goroutine.
+type messageWriter interface {
+	WriteMessage(msgBytes []byte) error
+	WritePing() error
+	// Close - Ends the connection, sending the close code if the transport supports one
+	Close(code int, text string)
+}
+
+// clientConn - Transport for connections the server pushes messages down, websockets and event streams.
+// Messages are written by a single goroutine, so Send is safe to call from any handler.
+type clientConn struct {
+	writer    messageWriter
+	metrics   *appMetrics
+	tracer    trace.Tracer
+	mu        sync.Mutex
+	queue     chan queuedMsg
+	closed    bool
+	closeCode int
+	closeText string
+	// Closed once queued messages have been written and the connection is closed
+	done chan struct{}
+}
+
+func newClientConn(writer messageWriter, metrics *appMetrics, tracer trace.Tracer) *clientConn {
+	c := &clientConn{
+		writer:    writer,
+		metrics:   metrics,
+		tracer:    tracer,
+		queue:     make(chan queuedMsg, sendQueueLength),
+		closeCode: websocket.CloseNormalClosure,
+		done:      make(chan struct{}),
+	}
+	go c.writeLoop()
+	return c
+}
+
+func (c *clientConn) Send(ctx context.Context, v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errConnClosed
+	}
+	select {
+	case c.queue <- queuedMsg{ctx: ctx, msg: v}:
+		return nil
+	default:
+		c.metrics.droppedMessages.WithLabelValues("queue_full").Inc()
+		return errSendQueueFull
+	}
+}
+
+func (c *clientConn) Close() error {
+	return c.CloseWithReason(websocket.CloseNormalClosure, "")
+}
+
+func (c *clientConn) CloseWithReason(code int, text string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		c.closeCode = code
+		c.closeText = text
+		close(c.queue)
+	}
+	return nil
+}
+
+func (c *clientConn) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *clientConn) writeLoop() {
+	defer close(c.done)
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for open := true; open; {
+		select {
+		case queued, ok := <-c.queue:
+			if !ok {
+				open = false
+			} else if err := c.write(queued); err != nil {
+				open = false
+			}
+		case <-ticker.C:
+			if err := c.writer.WritePing(); err != nil {
+				open = false
+			}
+		}
+	}
+	c.mu.Lock()
+	code, text := c.closeCode, c.closeText
+	c.mu.Unlock()
+	c.writer.Close(code, text)
+}
+
+func (c *clientConn) write(queued queuedMsg) error {
+	ctx, span := c.tracer.Start(queued.ctx, "write")
+	defer span.End()
+	msgBytes, err := encodeOutbound(ctx, span, c.metrics, queued.msg)
+	if err != nil {
+		return nil
+	}
+	if err := c.writer.WriteMessage(msgBytes); err != nil {
+		c.metrics.droppedMessages.WithLabelValues("write_error").Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "write failed")
+		return err
+	}
+	return nil
+}
+
+// encodeOutbound - Encodes a message for a client, adding trace context and counting it
+func encodeOutbound(ctx context.Context, span trace.Span, metrics *appMetrics, msg interface{}) ([]byte, error) {
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		metrics.droppedMessages.WithLabelValues("encode_error").Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "encode failed")
+		return nil, err
+	}
+	msgType := gjson.GetBytes(msgBytes, "type").String()
+	span.SetAttributes(attribute.String("qrsync.message_type", msgType))
+	msgBytes = injectTraceContext(ctx, msgBytes)
+	metrics.messagesOut.WithLabelValues(msgType).Inc()
+	metrics.bytesOut.Add(float64(len(msgBytes)))
+	return msgBytes, nil
+}
+
+// wsWriter - Writes messages to a websocket
+type wsWriter struct {
+	ws *websocket.Conn
+}
+
+func (w *wsWriter) WriteMessage(msgBytes []byte) error {
+	w.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return w.ws.WriteMessage(websocket.TextMessage, msgBytes)
+}
+
+func (w *wsWriter) WritePing() error {
+	return w.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+}
+
+func (w *wsWriter) Close(code int, text string) {
+	w.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(writeTimeout))
+	w.ws.Close()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"unicode/utf8"
+)
+
+// ContentKind - Kind of content that can be shared in a session
+type ContentKind string
+
+// Kinds of content that can be shared in a session
+const (
+	ContentKindTextNote  ContentKind = "textNote"
+	ContentKindURL       ContentKind = "url"
+	ContentKindClipboard ContentKind = "clipboard"
+	ContentKindFileRef   ContentKind = "fileRef"
+	ContentKindJSONData  ContentKind = "jsonData"
+)
+
+// All content kinds, used to generate the typescript enum
+var allContentKinds = []struct {
+	Value  ContentKind
+	TSName string
+}{
+	{ContentKindTextNote, "TextNote"},
+	{ContentKindURL, "URL"},
+	{ContentKindClipboard, "Clipboard"},
+	{ContentKindFileRef, "FileRef"},
+	{ContentKindJSONData, "JSONData"},
+}
+
+// Maximum size in bytes of each kind of content
+var contentKindMaxBytes = map[ContentKind]int{
+	ContentKindTextNote:  64 * 1024,
+	ContentKindURL:       2048,
+	ContentKindClipboard: 256 * 1024,
+	ContentKindFileRef:   4096,
+	ContentKindJSONData:  64 * 1024,
+}
+
+// SharedContent - Typed content shared with a session. Exactly one of the kind specific fields is set.
+type SharedContent struct {
+	Kind      ContentKind       `json:"kind" jsonschema:"required"`
+	TextNote  *TextNoteContent  `json:"textNote,omitempty"`
+	URL       *URLContent       `json:"url,omitempty"`
+	Clipboard *ClipboardContent `json:"clipboard,omitempty"`
+	FileRef   *FileRefContent   `json:"fileRef,omitempty"`
+	JSONData  *JSONDataContent  `json:"jsonData,omitempty"`
+}
+
+// TextNoteContent - A plain text note
+type TextNoteContent struct {
+	Title string `json:"title"`
+	Text  string `json:"text"`
+}
+
+// URLContent - A link to open on another device
+type URLContent struct {
+	URL   string `json:"url"`
+	Title string `json:"title"`
+}
+
+// ClipboardContent - A snippet copied from a device clipboard
+type ClipboardContent struct {
+	MimeType string `json:"mimeType"`
+	Content  string `json:"content"`
+}
+
+// FileRefContent - Reference to a file hosted elsewhere
+type FileRefContent struct {
+	Name     string `json:"name"`
+	MimeType string `json:"mimeType"`
+	Size     int64  `json:"size"`
+	URL      string `json:"url"`
+}
+
+// JSONDataContent - Arbitrary application data encoded as a JSON string
+type JSONDataContent struct {
+	Data string `json:"data"`
+}
+
+func validateContent(content SharedContent) error {
+	maxBytes, knownKind := contentKindMaxBytes[content.Kind]
+	if !knownKind {
+		return fmt.Errorf("unknown content kind %q", content.Kind)
+	}
+	setFields := 0
+	for _, isSet := range []bool{
+		content.TextNote != nil,
+		content.URL != nil,
+		content.Clipboard != nil,
+		content.FileRef != nil,
+		content.JSONData != nil,
+	} {
+		if isSet {
+			setFields++
+		}
+	}
+	if setFields != 1 {
+		return fmt.Errorf("content must have exactly one value but had %d", setFields)
+	}
+
+	var err error
+	size := 0
+	switch content.Kind {
+	case ContentKindTextNote:
+		if content.TextNote == nil {
+			return fmt.Errorf("missing %s value", content.Kind)
+		}
+		size = len(content.TextNote.Title) + len(content.TextNote.Text)
+		if !utf8.ValidString(content.TextNote.Text) {
+			err = fmt.Errorf("text note is not valid utf-8")
+		}
+	case ContentKindURL:
+		if content.URL == nil {
+			return fmt.Errorf("missing %s value", content.Kind)
+		}
+		size = len(content.URL.URL) + len(content.URL.Title)
+		err = validateContentURL(content.URL.URL)
+	case ContentKindClipboard:
+		if content.Clipboard == nil {
+			return fmt.Errorf("missing %s value", content.Kind)
+		}
+		size = len(content.Clipboard.Content)
+		if content.Clipboard.MimeType == "" {
+			err = fmt.Errorf("clipboard content needs a mime type")
+		}
+	case ContentKindFileRef:
+		if content.FileRef == nil {
+			return fmt.Errorf("missing %s value", content.Kind)
+		}
+		size = len(content.FileRef.Name) + len(content.FileRef.MimeType) + len(content.FileRef.URL)
+		if content.FileRef.Name == "" || content.FileRef.Size < 0 {
+			err = fmt.Errorf("file reference needs a name and non negative size")
+		} else {
+			err = validateContentURL(content.FileRef.URL)
+		}
+	case ContentKindJSONData:
+		if content.JSONData == nil {
+			return fmt.Errorf("missing %s value", content.Kind)
+		}
+		size = len(content.JSONData.Data)
+		if !json.Valid([]byte(content.JSONData.Data)) {
+			err = fmt.Errorf("json data is not valid json")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if size > maxBytes {
+		return fmt.Errorf("%s content is %d bytes, limit is %d", content.Kind, size, maxBytes)
+	}
+	return nil
+}
+
+func validateContentURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%q is not a valid http(s) url", rawURL)
+	}
+	return nil
+}
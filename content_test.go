@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_valid_url_content_is_accepted(t *testing.T) {
+	content := SharedContent{
+		Kind: ContentKindURL,
+		URL:  &URLContent{URL: "https://example.com/boarding-pass", Title: "Boarding pass"},
+	}
+	if err := validateContent(content); err != nil {
+		t.Fatalf("Expected url content to be valid but got %v", err)
+	}
+}
+
+func Test_content_kind_must_match_value(t *testing.T) {
+	content := SharedContent{
+		Kind:     ContentKindURL,
+		TextNote: &TextNoteContent{Text: "hello"},
+	}
+	if err := validateContent(content); err == nil {
+		t.Fatalf("Expected error when kind does not match value")
+	}
+}
+
+func Test_content_over_size_limit_is_rejected(t *testing.T) {
+	content := SharedContent{
+		Kind:     ContentKindTextNote,
+		TextNote: &TextNoteContent{Text: strings.Repeat("a", contentKindMaxBytes[ContentKindTextNote]+1)},
+	}
+	if err := validateContent(content); err == nil {
+		t.Fatalf("Expected error for oversized text note")
+	}
+}
+
+func Test_invalid_json_data_is_rejected(t *testing.T) {
+	content := SharedContent{
+		Kind:     ContentKindJSONData,
+		JSONData: &JSONDataContent{Data: "{not json"},
+	}
+	if err := validateContent(content); err == nil {
+		t.Fatalf("Expected error for invalid json data")
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// NoteOpID - Unique id of a single character in a note.
+// Counter is a Lamport clock, clients must use one more than the highest counter they have seen.
+type NoteOpID struct {
+	ClientID string `json:"clientId" jsonschema:"required"`
+	Counter  int    `json:"counter" jsonschema:"required"`
+}
+
+// NoteOp - A single insert or delete operation on a note
+type NoteOp struct {
+	Kind string   `json:"kind" jsonschema:"required"`
+	ID   NoteOpID `json:"id" jsonschema:"required"`
+	// Element the new character is inserted after, empty for start of note. Only used by inserts.
+	Origin *NoteOpID `json:"origin"`
+	Value  string    `json:"value"`
+}
+
+// NoteElement - A run of characters in a note snapshot. The characters were inserted one after
+// another by the same client, so their ids count up from ID and each one's origin is the one before.
+// Deleted runs are kept without a value so that concurrent ops referencing them can still be merged.
+type NoteElement struct {
+	ID     NoteOpID  `json:"id"`
+	Origin *NoteOpID `json:"origin"`
+	Value  string    `json:"value"`
+	// Number of characters in the run, read as one when missing
+	Length  int  `json:"length,omitempty"`
+	Deleted bool `json:"deleted"`
+}
+
+// noteNode - A character in a note, linked to the one after it
+type noteNode struct {
+	id      NoteOpID
+	origin  *NoteOpID
+	value   string
+	deleted bool
+	next    *noteNode
+}
+
+const (
+	noteOpInsert = "insert"
+	noteOpDelete = "delete"
+)
+
+var errUnknownNoteOrigin = errors.New("unknown origin element")
+var errUnknownNoteElement = errors.New("unknown element")
+var errInvalidNoteOp = errors.New("invalid note op")
+var errNoteFull = errors.New("note is full")
+var errNoteHistoryFull = errors.New("note history is full")
+
+// after - Ordering used to break ties between concurrent inserts at the same position
+func (id NoteOpID) after(other NoteOpID) bool {
+	if id.Counter != other.Counter {
+		return id.Counter > other.Counter
+	}
+	return id.ClientID > other.ClientID
+}
+
+// NoteDoc - Replicated growable array (RGA) holding the text of a collaborative note.
+// Characters are kept in a linked list so inserts don't move the ones after them.
+type NoteDoc struct {
+	mu sync.Mutex
+	// Sentinel before the first character
+	head  noteNode
+	index map[NoteOpID]*noteNode
+	// Characters that haven't been deleted
+	visible int
+}
+
+func newNoteDoc() *NoteDoc {
+	return &NoteDoc{index: make(map[NoteOpID]*noteNode)}
+}
+
+// Apply - Merges ops into the note, returning the ops that changed it.
+// Ops that have already been applied are skipped so updates can be redelivered safely.
+// Inserts are refused once the note shows maxLength characters, or holds maxElements including
+// deleted ones, which are kept so concurrent ops can still reference them. Zero is unlimited.
+func (d *NoteDoc) Apply(ops []NoteOp, maxLength int, maxElements int) ([]NoteOp, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	applied := []NoteOp{}
+	for _, op := range ops {
+		changed, err := d.apply(op, maxLength, maxElements)
+		if err != nil {
+			return applied, err
+		}
+		if changed {
+			applied = append(applied, op)
+		}
+	}
+	return applied, nil
+}
+
+func (d *NoteDoc) apply(op NoteOp, maxLength int, maxElements int) (bool, error) {
+	switch op.Kind {
+	case noteOpInsert:
+		if op.ID.ClientID == "" || len([]rune(op.Value)) != 1 {
+			return false, errInvalidNoteOp
+		}
+		if _, exists := d.index[op.ID]; exists {
+			return false, nil
+		}
+		if maxLength > 0 && d.visible >= maxLength {
+			return false, errNoteFull
+		}
+		if maxElements > 0 && len(d.index) >= maxElements {
+			return false, errNoteHistoryFull
+		}
+		prev := &d.head
+		if op.Origin != nil {
+			// Inserts sorting before their origin would move text that is already there
+			if op.ID.Counter <= op.Origin.Counter {
+				return false, errInvalidNoteOp
+			}
+			origin, ok := d.index[*op.Origin]
+			if !ok {
+				return false, errUnknownNoteOrigin
+			}
+			prev = origin
+		}
+		// Skip over concurrent inserts at the same position that win the tie break
+		for prev.next != nil && prev.next.id.after(op.ID) {
+			prev = prev.next
+		}
+		node := &noteNode{id: op.ID, origin: op.Origin, value: op.Value, next: prev.next}
+		prev.next = node
+		d.index[op.ID] = node
+		d.visible++
+		return true, nil
+	case noteOpDelete:
+		node, ok := d.index[op.ID]
+		if !ok {
+			return false, errUnknownNoteElement
+		}
+		if node.deleted {
+			return false, nil
+		}
+		node.deleted = true
+		// Tombstones only need their id, drop the content
+		node.value = ""
+		d.visible--
+		return true, nil
+	}
+	return false, errInvalidNoteOp
+}
+
+// Len - Number of characters in the note, including deleted ones
+func (d *NoteDoc) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.index)
+}
+
+// Text - Current visible text of the note
+func (d *NoteDoc) Text() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var sb strings.Builder
+	for node := d.head.next; node != nil; node = node.next {
+		if !node.deleted {
+			sb.WriteString(node.value)
+		}
+	}
+	return sb.String()
+}
+
+// Snapshot - Compacted state of the note for clients joining a session.
+// Characters typed or deleted together are merged into one run.
+func (d *NoteDoc) Snapshot() []NoteElement {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	snapshot := []NoteElement{}
+	var run *NoteElement
+	for node := d.head.next; node != nil; node = node.next {
+		if run != nil && node.continues(*run) {
+			run.Value += node.value
+			run.Length++
+			continue
+		}
+		snapshot = append(snapshot, NoteElement{ID: node.id, Origin: node.origin, Value: node.value, Length: 1, Deleted: node.deleted})
+		run = &snapshot[len(snapshot)-1]
+	}
+	return snapshot
+}
+
+// continues - Whether the node can be merged onto the end of run
+func (n *noteNode) continues(run NoteElement) bool {
+	last := NoteOpID{ClientID: run.ID.ClientID, Counter: run.ID.Counter + run.Length - 1}
+	return n.deleted == run.Deleted && n.origin != nil && *n.origin == last &&
+		n.id == NoteOpID{ClientID: last.ClientID, Counter: last.Counter + 1}
+}
+
+func newNoteDocFromSnapshot(elements []NoteElement) *NoteDoc {
+	d := newNoteDoc()
+	tail := &d.head
+	for _, element := range elements {
+		values := []rune(element.Value)
+		length := max(element.Length, 1)
+		if !element.Deleted {
+			length = len(values)
+		}
+		origin := element.Origin
+		for i := 0; i < length; i++ {
+			node := &noteNode{
+				id:      NoteOpID{ClientID: element.ID.ClientID, Counter: element.ID.Counter + i},
+				origin:  origin,
+				deleted: element.Deleted,
+			}
+			if !element.Deleted {
+				node.value = string(values[i])
+				d.visible++
+			}
+			tail.next = node
+			tail = node
+			d.index[node.id] = node
+			origin = &node.id
+		}
+	}
+	return d
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"testing"
+)
+
+func insertOp(clientID string, counter int, origin *NoteOpID, value string) NoteOp {
+	return NoteOp{
+		Kind:   noteOpInsert,
+		ID:     NoteOpID{ClientID: clientID, Counter: counter},
+		Origin: origin,
+		Value:  value,
+	}
+}
+
+func Test_note_inserts_in_order(t *testing.T) {
+	doc := newNoteDoc()
+	_, err := doc.Apply([]NoteOp{
+		insertOp("1", 1, nil, "h"),
+		insertOp("1", 2, &NoteOpID{"1", 1}, "i"),
+	}, 0, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error applying ops %v", err)
+	}
+	if doc.Text() != "hi" {
+		t.Fatalf("Expected text to be hi but was %s", doc.Text())
+	}
+}
+
+func Test_concurrent_note_edits_converge(t *testing.T) {
+	base := []NoteOp{
+		insertOp("1", 1, nil, "a"),
+		insertOp("1", 2, &NoteOpID{"1", 1}, "b"),
+	}
+	// Both clients insert after "a" without seeing each other's edit
+	phoneOps := []NoteOp{
+		insertOp("1", 3, &NoteOpID{"1", 1}, "x"),
+		insertOp("1", 4, &NoteOpID{"1", 3}, "y"),
+	}
+	laptopOps := []NoteOp{
+		insertOp("2", 3, &NoteOpID{"1", 1}, "z"),
+		{Kind: noteOpDelete, ID: NoteOpID{"1", 2}},
+	}
+
+	doc1 := newNoteDoc()
+	doc1.Apply(base, 0, 0)
+	doc1.Apply(phoneOps, 0, 0)
+	doc1.Apply(laptopOps, 0, 0)
+
+	doc2 := newNoteDoc()
+	doc2.Apply(base, 0, 0)
+	doc2.Apply(laptopOps, 0, 0)
+	doc2.Apply(phoneOps, 0, 0)
+
+	if doc1.Text() != doc2.Text() {
+		t.Fatalf("Expected notes to converge but got %s and %s", doc1.Text(), doc2.Text())
+	}
+	if doc1.Text() != "azxy" {
+		t.Fatalf("Expected text to be azxy but was %s", doc1.Text())
+	}
+}
+
+func Test_note_ops_are_idempotent(t *testing.T) {
+	doc := newNoteDoc()
+	op := insertOp("1", 1, nil, "a")
+	doc.Apply([]NoteOp{op}, 0, 0)
+	applied, err := doc.Apply([]NoteOp{op}, 0, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error applying duplicate op %v", err)
+	}
+	if len(applied) != 0 {
+		t.Fatalf("Expected duplicate op to be skipped")
+	}
+	if doc.Text() != "a" {
+		t.Fatalf("Expected text to be a but was %s", doc.Text())
+	}
+}
+
+func Test_note_rejects_unknown_origin(t *testing.T) {
+	doc := newNoteDoc()
+	_, err := doc.Apply([]NoteOp{insertOp("1", 2, &NoteOpID{"1", 1}, "a")}, 0, 0)
+	if err != errUnknownNoteOrigin {
+		t.Fatalf("Expected unknown origin error but got %v", err)
+	}
+}
+
+func Test_note_snapshot_drops_deleted_content(t *testing.T) {
+	doc := newNoteDoc()
+	doc.Apply([]NoteOp{
+		insertOp("1", 1, nil, "a"),
+		{Kind: noteOpDelete, ID: NoteOpID{"1", 1}},
+	}, 0, 0)
+	snapshot := doc.Snapshot()
+	if len(snapshot) != 1 || !snapshot[0].Deleted || snapshot[0].Value != "" {
+		t.Fatalf("Expected single tombstone in snapshot but got %v", snapshot)
+	}
+}
+
+func typeText(clientID string, text string) []NoteOp {
+	ops := []NoteOp{}
+	var origin *NoteOpID
+	for i, char := range []rune(text) {
+		op := insertOp(clientID, i+1, origin, string(char))
+		ops = append(ops, op)
+		origin = &op.ID
+	}
+	return ops
+}
+
+func Test_note_snapshot_merges_runs(t *testing.T) {
+	doc := newNoteDoc()
+	doc.Apply(typeText("1", "hello"), 0, 0)
+	doc.Apply([]NoteOp{
+		{Kind: noteOpDelete, ID: NoteOpID{"1", 2}},
+		{Kind: noteOpDelete, ID: NoteOpID{"1", 3}},
+		{Kind: noteOpDelete, ID: NoteOpID{"1", 4}},
+	}, 0, 0)
+	snapshot := doc.Snapshot()
+	if len(snapshot) != 3 || snapshot[0].Value != "h" || !snapshot[1].Deleted || snapshot[1].Length != 3 || snapshot[2].Value != "o" {
+		t.Fatalf("Expected h, a run of 3 tombstones and o in snapshot but got %v", snapshot)
+	}
+
+	restored := newNoteDocFromSnapshot(snapshot)
+	if restored.Text() != "ho" || restored.Len() != 5 {
+		t.Fatalf("Expected restored note to be ho with 5 characters but was %s with %d", restored.Text(), restored.Len())
+	}
+	// Concurrent edits can still reference characters inside a compacted run
+	_, err := restored.Apply([]NoteOp{insertOp("2", 6, &NoteOpID{"1", 3}, "i")}, 0, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error inserting after a compacted tombstone %v", err)
+	}
+	if restored.Text() != "hio" {
+		t.Fatalf("Expected text to be hio but was %s", restored.Text())
+	}
+}
+
+func Test_note_refuses_inserts_past_max_length(t *testing.T) {
+	doc := newNoteDoc()
+	applied, err := doc.Apply(typeText("1", "abc"), 2, 0)
+	if err != errNoteFull {
+		t.Fatalf("Expected note full error but got %v", err)
+	}
+	if len(applied) != 2 || doc.Text() != "ab" {
+		t.Fatalf("Expected the first 2 inserts to be applied but text was %s", doc.Text())
+	}
+	// Deletes don't add characters so are still allowed
+	if _, err := doc.Apply([]NoteOp{{Kind: noteOpDelete, ID: NoteOpID{"1", 1}}}, 2, 0); err != nil {
+		t.Fatalf("Unexpected error deleting from a full note %v", err)
+	}
+}
+
+func Test_note_max_length_only_counts_visible_characters(t *testing.T) {
+	doc := newNoteDoc()
+	doc.Apply(typeText("1", "ab"), 2, 0)
+	doc.Apply([]NoteOp{
+		{Kind: noteOpDelete, ID: NoteOpID{"1", 1}},
+		{Kind: noteOpDelete, ID: NoteOpID{"1", 2}},
+	}, 2, 0)
+	if _, err := doc.Apply([]NoteOp{insertOp("1", 3, &NoteOpID{"1", 2}, "c"), insertOp("1", 4, &NoteOpID{"1", 3}, "d")}, 2, 0); err != nil {
+		t.Fatalf("Unexpected error inserting after deleting every character %v", err)
+	}
+	if _, err := doc.Apply([]NoteOp{insertOp("1", 5, &NoteOpID{"1", 4}, "e")}, 2, 0); err != errNoteFull {
+		t.Fatalf("Expected note full error but got %v", err)
+	}
+
+	// Restored notes count the same characters
+	restored := newNoteDocFromSnapshot(doc.Snapshot())
+	if _, err := restored.Apply([]NoteOp{insertOp("1", 5, &NoteOpID{"1", 4}, "e")}, 2, 0); err != errNoteFull {
+		t.Fatalf("Expected restored note to be full but got %v", err)
+	}
+	if doc.Text() != "cd" || restored.Text() != "cd" {
+		t.Fatalf("Expected text to be cd but was %s and %s", doc.Text(), restored.Text())
+	}
+}
+
+func Test_note_churn_is_capped_by_max_elements(t *testing.T) {
+	doc := newNoteDoc()
+	var origin *NoteOpID
+	var err error
+	for counter := 1; counter <= 10; counter++ {
+		// Typing then deleting a character keeps the visible length at zero
+		_, err = doc.Apply([]NoteOp{insertOp("1", counter, origin, "x")}, 1, 4)
+		if err != nil {
+			break
+		}
+		doc.Apply([]NoteOp{{Kind: noteOpDelete, ID: NoteOpID{"1", counter}}}, 1, 4)
+		origin = &NoteOpID{"1", counter}
+	}
+	if err != errNoteHistoryFull {
+		t.Fatalf("Expected note history full error but got %v", err)
+	}
+	if len(doc.index) != 4 || doc.Text() != "" {
+		t.Fatalf("Expected 4 deleted characters but had %d and text %s", len(doc.index), doc.Text())
+	}
+
+	// Restored notes count the deleted characters they keep
+	restored := newNoteDocFromSnapshot(doc.Snapshot())
+	if _, err := restored.Apply([]NoteOp{insertOp("1", 5, origin, "x")}, 1, 4); err != errNoteHistoryFull {
+		t.Fatalf("Expected restored note history to be full but got %v", err)
+	}
+}
+
+func Test_note_rejects_inserts_not_after_their_origin(t *testing.T) {
+	doc := newNoteDoc()
+	doc.Apply(typeText("1", "ab"), 0, 0)
+	for _, counter := range []int{1, 2} {
+		_, err := doc.Apply([]NoteOp{insertOp("2", counter, &NoteOpID{"1", 2}, "x")}, 0, 0)
+		if err != errInvalidNoteOp {
+			t.Fatalf("Expected insert with counter %d after counter 2 to be refused but got %v", counter, err)
+		}
+	}
+	if doc.Text() != "ab" {
+		t.Fatalf("Expected text to be unchanged but was %s", doc.Text())
+	}
+}
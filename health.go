@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Build information, set with -ldflags "-X main.gitSHA=... -X main.buildTime=..."
+var (
+	gitSHA    = "unknown"
+	buildTime = "unknown"
+)
+
+// Versions of the websocket message protocol this server supports
+var protocolVersions = []string{"1"}
+
+// VersionInfo - Response body of /version
+type VersionInfo struct {
+	GitSHA           string   `json:"gitSha"`
+	BuildTime        string   `json:"buildTime"`
+	ProtocolVersions []string `json:"protocolVersions"`
+}
+
+// ReadyStatus - Response body of /readyz
+type ReadyStatus struct {
+	Ready    bool   `json:"ready"`
+	Draining bool   `json:"draining"`
+	Store    string `json:"store"`
+}
+
+// getHealthz - Process is alive and serving requests
+func (a *App) getHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// getReadyz - Server can take new connections. Fails once shutdown starts or if the store is unreachable.
+func (a *App) getReadyz(w http.ResponseWriter, r *http.Request) {
+	status := ReadyStatus{
+		Draining: a.draining.Load(),
+		Store:    "ok",
+	}
+	if err := a.store.Ping(); err != nil {
+		status.Store = err.Error()
+	}
+	status.Ready = !status.Draining && status.Store == "ok"
+	res, _ := json.Marshal(status)
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(res)
+}
+
+func (a *App) getVersion(w http.ResponseWriter, r *http.Request) {
+	res, _ := json.Marshal(VersionInfo{
+		GitSHA:           gitSHA,
+		BuildTime:        buildTime,
+		ProtocolVersions: protocolVersions,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Prefix of the senderId of messages sent by server integrations rather than clients
+const integrationSenderPrefix = "integration:"
+
+// authorizeIntegration - Returns the name of the integration whose token the request carries.
+// Writes an error response and returns false if there is none.
+func (a *App) authorizeIntegration(w http.ResponseWriter, r *http.Request) (string, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	for name, integrationToken := range a.Config.IntegrationTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(integrationToken)) == 1 {
+			return name, true
+		}
+	}
+	http.Error(w, "Unknown integration token", http.StatusUnauthorized)
+	return "", false
+}
+
+// decodeIntegrationBody - Reads a broadcast from an integration request body.
+// Writes an error response and returns false if it can't be read.
+func (a *App) decodeIntegrationBody(w http.ResponseWriter, r *http.Request) (BroadcastToSessionMsg, bool) {
+	var msg BroadcastToSessionMsg
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, a.Config.MaxMessageBytes)).Decode(&msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return msg, false
+	}
+	return msg, true
+}
+
+// integrationGetSession - Returns a single session to an integration
+func (a *App) integrationGetSession(w http.ResponseWriter, r *http.Request) {
+	if _, ok := a.authorizeIntegration(w, r); !ok {
+		return
+	}
+	a.mu.Lock()
+	session, sessionExists := a.SessionMap[mux.Vars(r)["id"]]
+	// Marshalled under the lock as the session's slices are shared with SessionMap
+	res, _ := json.Marshal(session)
+	a.mu.Unlock()
+	if !sessionExists {
+		http.Error(w, "No session with ID "+mux.Vars(r)["id"], http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+}
+
+// integrationBroadcast - Broadcasts into a session on behalf of an integration, as if it were a session member
+func (a *App) integrationBroadcast(w http.ResponseWriter, r *http.Request) {
+	integration, ok := a.authorizeIntegration(w, r)
+	if !ok {
+		return
+	}
+	msg, ok := a.decodeIntegrationBody(w, r)
+	if !ok {
+		return
+	}
+	sessionID := mux.Vars(r)["id"]
+	ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := a.tracer.Start(ctx, "integrationBroadcast")
+	defer span.End()
+	span.SetAttributes(attribute.String("qrsync.integration", integration), attribute.String("qrsync.session_id", sessionID))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	session, sessionExists := a.SessionMap[sessionID]
+	if !sessionExists {
+		http.Error(w, "No session with ID "+sessionID, http.StatusNotFound)
+		return
+	}
+	if err := a.broadcastToSession(ctx, session, integrationSenderPrefix+integration, msg); err != nil {
+		http.Error(w, "Invalid content: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.logger.Info("Integration broadcast to session", "integration", integration, "sessionId", sessionID)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// integrationSendToClient - Sends a single client a broadcast from an integration
+func (a *App) integrationSendToClient(w http.ResponseWriter, r *http.Request) {
+	integration, ok := a.authorizeIntegration(w, r)
+	if !ok {
+		return
+	}
+	msg, ok := a.decodeIntegrationBody(w, r)
+	if !ok {
+		return
+	}
+	clientID := mux.Vars(r)["id"]
+	ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := a.tracer.Start(ctx, "integrationSendToClient")
+	defer span.End()
+	span.SetAttributes(attribute.String("qrsync.integration", integration), attribute.String("qrsync.client_id", clientID))
+
+	if msg.Content != nil {
+		if err := validateContent(*msg.Content); err != nil {
+			http.Error(w, "Invalid content: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	a.mu.Lock()
+	client, connected := a.lookupClient(clientID)
+	a.mu.Unlock()
+	if !connected {
+		http.Error(w, "No client with ID "+clientID, http.StatusNotFound)
+		return
+	}
+	outboundMsg := BroadcastFromSessionMsg{
+		Type:     "BroadcastFromSession",
+		SenderID: integrationSenderPrefix + integration,
+		Payload:  msg.Payload,
+		Content:  msg.Content,
+	}
+	if err := client.transport.Send(ctx, outboundMsg); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	a.logger.Info("Integration sent message to client", "integration", integration, "clientId", clientID)
+	w.WriteHeader(http.StatusAccepted)
+}
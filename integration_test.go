@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func IntegrationRequest(t *testing.T, method string, url string, token string, body string) *http.Response {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Integration request failed %v", err)
+	}
+	return res
+}
+
+func Test_integration_can_broadcast_into_session(t *testing.T) {
+	config := DefaultConfig()
+	config.IntegrationTokens = map[string]string{"boarding": "integration-secret"}
+	app := App{Config: config}
+	app.Init()
+	testServer := httptest.NewServer(app.MainHandler())
+	defer testServer.Close()
+	wsUrl := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/api/v1/ws"
+
+	ws, connectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+	ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var joinMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&joinMsg)
+	sessionUrl := testServer.URL + "/api/v1/sessions/" + joinMsg.SessionID
+
+	res := IntegrationRequest(t, http.MethodPost, sessionUrl+"/broadcast", "wrong", `{"payload":"boarding pass"}`)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected unauthorized but got %d", res.StatusCode)
+	}
+
+	res = IntegrationRequest(t, http.MethodGet, sessionUrl, "integration-secret", "")
+	var session Session
+	json.NewDecoder(res.Body).Decode(&session)
+	res.Body.Close()
+	if session.ID != joinMsg.SessionID || !contains(session.ClientIDs, connectMsg.Client.ID) {
+		t.Fatalf("Expected session %s with client but got %v", joinMsg.SessionID, session)
+	}
+
+	res = IntegrationRequest(t, http.MethodPost, sessionUrl+"/broadcast", "integration-secret", `{"payload":"boarding pass"}`)
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected broadcast to be accepted but got %d", res.StatusCode)
+	}
+	var broadcastMsg BroadcastFromSessionMsg
+	ws.ReadJSON(&broadcastMsg)
+	if broadcastMsg.Payload != "boarding pass" || broadcastMsg.SenderID != "integration:boarding" || broadcastMsg.FromSessionOwner {
+		t.Fatalf("Expected broadcast from integration but got %v", broadcastMsg)
+	}
+
+	res = IntegrationRequest(t, http.MethodPost, testServer.URL+"/api/v1/clients/"+connectMsg.Client.ID+"/messages", "integration-secret", `{"payload":"just for you"}`)
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected client message to be accepted but got %d", res.StatusCode)
+	}
+	ws.ReadJSON(&broadcastMsg)
+	if broadcastMsg.Payload != "just for you" || broadcastMsg.SenderID != "integration:boarding" {
+		t.Fatalf("Expected message from integration but got %v", broadcastMsg)
+	}
+
+	res = IntegrationRequest(t, http.MethodPost, testServer.URL+"/api/v1/sessions/missing/broadcast", "integration-secret", `{"payload":"lost"}`)
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected unknown session to be not found but got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// validatePublicKey - Checks key is a base64 encoded X25519 public key
+func validatePublicKey(publicKey string) error {
+	keyBytes, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return err
+	}
+	_, err = ecdh.X25519().NewPublicKey(keyBytes)
+	return err
+}
+
+// newToken - Random secret for authenticating a client
+func newToken() string {
+	tokenBytes := make([]byte, 16)
+	rand.Read(tokenBytes)
+	return hex.EncodeToString(tokenBytes)
+}
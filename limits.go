@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Codes of errors sent to clients that hit a limit
+const (
+	errRateLimited        = "rate_limited"
+	errTooManySessions    = "too_many_sessions"
+	errSessionFull        = "session_full"
+	errTooManyConnections = "too_many_connections"
+	errTooManyNotes       = "too_many_notes"
+	errNoteTooLong        = "note_too_long"
+	errNoteHistoryTooLong = "note_history_too_long"
+)
+
+// Key of LimitsConfig.ClientMessages limiting every message type together
+const allMessageTypes = "*"
+
+// RateLimit - Token bucket allowing Burst messages at once, refilled at PerSecond.
+// Disabled when PerSecond is zero.
+type RateLimit struct {
+	PerSecond float64 `yaml:"perSecond"`
+	Burst     int     `yaml:"burst"`
+}
+
+// LimitsConfig - Protection against clients flooding the server. Zero disables a limit.
+type LimitsConfig struct {
+	// Messages each client may send keyed by message type, "*" limits all types together
+	ClientMessages map[string]RateLimit `yaml:"clientMessages"`
+	// Messages all clients connected from one IP may send together
+	IPMessages RateLimit `yaml:"ipMessages"`
+	// Sessions a client may own at once
+	MaxSessionsPerClient int `yaml:"maxSessionsPerClient"`
+	// Sessions clients connected from one IP may own together, including sessions of
+	// clients that have since disconnected
+	MaxSessionsPerIP int `yaml:"maxSessionsPerIP"`
+	// Clients that can be added to a session
+	MaxClientsPerSession int `yaml:"maxClientsPerSession"`
+	// Notes that can be edited in a session
+	MaxNotesPerSession int `yaml:"maxNotesPerSession"`
+	// Characters a note can show, deleted characters kept to merge concurrent edits aren't counted
+	MaxNoteLength int `yaml:"maxNoteLength"`
+	// Characters a note can hold including deleted ones, bounding the memory and snapshot
+	// size of notes that are edited over and over
+	MaxNoteElements int `yaml:"maxNoteElements"`
+	// Clients that can be connected from one IP at once
+	MaxConnectionsPerIP int `yaml:"maxConnectionsPerIP"`
+	// Limits a client can hit in a minute before it is disconnected
+	MaxViolationsPerMinute int `yaml:"maxViolationsPerMinute"`
+}
+
+// DefaultLimits - Limits generous enough for any well behaved client
+func DefaultLimits() LimitsConfig {
+	return LimitsConfig{
+		ClientMessages: map[string]RateLimit{
+			allMessageTypes:      {PerSecond: 20, Burst: 50},
+			"CreateSession":      {PerSecond: 0.5, Burst: 5},
+			"BroadcastToSession": {PerSecond: 10, Burst: 20},
+			// Each invite creates a session
+			"InviteTrustedDevice": {PerSecond: 0.5, Burst: 5},
+			// Slows down password guessing
+			"Login":    {PerSecond: 0.1, Burst: 5},
+			"Register": {PerSecond: 0.1, Burst: 3},
+		},
+		IPMessages:             RateLimit{PerSecond: 100, Burst: 200},
+		MaxSessionsPerClient:   20,
+		MaxSessionsPerIP:       100,
+		MaxClientsPerSession:   50,
+		MaxNotesPerSession:     20,
+		MaxNoteLength:          100000,
+		MaxNoteElements:        500000,
+		MaxConnectionsPerIP:    20,
+		MaxViolationsPerMinute: 20,
+	}
+}
+
+// Validate - Checks limits are usable
+func (l LimitsConfig) Validate() error {
+	for msgType, limit := range l.ClientMessages {
+		if limit.PerSecond < 0 || limit.Burst < 0 {
+			return fmt.Errorf("clientMessages %s must not be negative", msgType)
+		}
+	}
+	if l.IPMessages.PerSecond < 0 || l.IPMessages.Burst < 0 {
+		return errors.New("ipMessages must not be negative")
+	}
+	if l.MaxSessionsPerClient < 0 || l.MaxSessionsPerIP < 0 || l.MaxClientsPerSession < 0 || l.MaxNotesPerSession < 0 || l.MaxNoteLength < 0 || l.MaxNoteElements < 0 || l.MaxConnectionsPerIP < 0 || l.MaxViolationsPerMinute < 0 {
+		return errors.New("maximums must not be negative")
+	}
+	return nil
+}
+
+// tokenBucket - Rate limiter state, a nil bucket never limits
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	if limit.PerSecond <= 0 {
+		return nil
+	}
+	limit.Burst = max(limit.Burst, 1)
+	return &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: now}
+}
+
+// take - Uses a token if one is left, otherwise returns how long until there will be one
+func (b *tokenBucket) take(now time.Time) (time.Duration, bool) {
+	if b == nil {
+		return 0, true
+	}
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.PerSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) / b.limit.PerSecond * float64(time.Second)), false
+}
+
+// clientLimits - Rate limiter state of a client, shared by copies of the Client. Guarded by App.mu.
+type clientLimits struct {
+	messages   map[string]*tokenBucket
+	violations *tokenBucket
+}
+
+func newClientLimits(config LimitsConfig, now time.Time) *clientLimits {
+	limits := &clientLimits{
+		messages: make(map[string]*tokenBucket),
+		violations: newTokenBucket(RateLimit{
+			PerSecond: float64(config.MaxViolationsPerMinute) / 60,
+			Burst:     config.MaxViolationsPerMinute,
+		}, now),
+	}
+	// Only configured types get a bucket so clients can't grow the map with made up types
+	for msgType, limit := range config.ClientMessages {
+		limits.messages[msgType] = newTokenBucket(limit, now)
+	}
+	return limits
+}
+
+// take - Uses a token from the buckets for msgType and for all types
+func (l *clientLimits) take(msgType string, now time.Time) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+	if wait, ok := l.messages[msgType].take(now); !ok {
+		return wait, false
+	}
+	return l.messages[allMessageTypes].take(now)
+}
+
+// violation - Records a limit being hit, returns false once too many have been
+func (l *clientLimits) violation(now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	_, ok := l.violations.take(now)
+	return ok
+}
+
+// full - Whether the bucket will have refilled by now, after which it is the same as a new one
+func (b *tokenBucket) full(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	return b.tokens+now.Sub(b.last).Seconds()*b.limit.PerSecond >= float64(b.limit.Burst)
+}
+
+// ipLimits - Connections and shared message rate limit of one IP. Kept after its last client
+// disconnects until the rate limit has refilled, so reconnecting doesn't reset it.
+type ipLimits struct {
+	connections int
+	messages    *tokenBucket
+}
+
+// clientIP - Address a request came from. Requests proxied by another node of the cluster
+// use the address that node received them from.
+func (a *App) clientIP(r *http.Request) string {
+	if a.proxiedByNode(r) {
+		if ip := r.Header.Get(proxiedClientIPHeader); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// refuseConnection - Responds with an error if the request's IP already has too many clients
+// connected, otherwise counts the connection against the IP. Both happen under one lock so
+// parallel requests can't all pass before any is counted. Requests that don't go on to
+// connectClient must call cancelConnection.
+func (a *App) refuseConnection(w http.ResponseWriter, r *http.Request) bool {
+	maxConnections := a.Config.Limits.MaxConnectionsPerIP
+	ip := a.clientIP(r)
+	a.mu.Lock()
+	limits, known := a.ipLimits[ip]
+	if !known {
+		limits = &ipLimits{messages: newTokenBucket(a.Config.Limits.IPMessages, time.Now())}
+		a.ipLimits[ip] = limits
+	}
+	refused := maxConnections > 0 && limits.connections >= maxConnections
+	if !refused {
+		limits.connections++
+	}
+	a.mu.Unlock()
+	if refused {
+		a.metrics.limitViolations.WithLabelValues(errTooManyConnections).Inc()
+		a.logger.Warn("Connection refused", "remoteAddr", r.RemoteAddr, "ip", ip, "code", errTooManyConnections)
+		http.Error(w, "Too many connections", http.StatusTooManyRequests)
+	}
+	return refused
+}
+
+// cancelConnection - Stops counting a request that failed before its client connected
+func (a *App) cancelConnection(r *http.Request) {
+	a.mu.Lock()
+	a.removeConnection(a.clientIP(r))
+	a.mu.Unlock()
+}
+
+// removeConnection - Stops counting a client against ip. Caller must hold a.mu.
+func (a *App) removeConnection(ip string) {
+	if limits, known := a.ipLimits[ip]; known && limits.connections > 0 {
+		limits.connections--
+	}
+}
+
+// removeIdleIPs - Forgets IPs with no clients whose rate limit has refilled. Caller must hold a.mu.
+func (a *App) removeIdleIPs() {
+	now := time.Now()
+	for ip, limits := range a.ipLimits {
+		if limits.connections == 0 && limits.messages.full(now) {
+			delete(a.ipLimits, ip)
+		}
+	}
+}
+
+// allowMessage - Whether client is within its rate limits for msgType. Caller must hold a.mu.
+func (a *App) allowMessage(ctx context.Context, client Client, msgType string) bool {
+	now := time.Now()
+	wait, ok := client.limits.take(msgType, now)
+	if ok {
+		if limits, known := a.ipLimits[client.remoteIP]; known {
+			wait, ok = limits.messages.take(now)
+		}
+	}
+	if !ok {
+		a.limitExceeded(ctx, client, errRateLimited, "Too many "+msgType+" messages", wait)
+	}
+	return ok
+}
+
+// ownedSessionCount - Number of sessions ownerID created. Caller must hold a.mu.
+func (a *App) ownedSessionCount(ownerID string) int {
+	count := 0
+	for _, session := range a.SessionMap {
+		if session.OwnerID == ownerID {
+			count++
+		}
+	}
+	return count
+}
+
+// ipSessionCount - Number of sessions created by clients connected from ip. Caller must hold a.mu.
+func (a *App) ipSessionCount(ip string) int {
+	count := 0
+	for _, session := range a.SessionMap {
+		if session.ownerIP == ip {
+			count++
+		}
+	}
+	return count
+}
+
+// limitExceeded - Tells client it hit a limit and disconnects it if it keeps doing so.
+// Caller must hold a.mu.
+func (a *App) limitExceeded(ctx context.Context, client Client, code string, message string, retryAfter time.Duration) {
+	a.metrics.limitViolations.WithLabelValues(code).Inc()
+	logger := a.clientLogger(client)
+	logger.Warn("Limit exceeded", "code", code)
+	client.transport.Send(ctx, ErrorMsg{
+		Type:         "error",
+		Code:         code,
+		Message:      message,
+		RetryAfterMs: retryAfter.Milliseconds(),
+	})
+	if !client.limits.violation(time.Now()) {
+		logger.Warn("Disconnecting client for exceeding limits")
+		client.transport.CloseWithReason(websocket.ClosePolicyViolation, "Too many limits exceeded")
+	}
+}
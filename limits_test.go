@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func Test_token_bucket_refills_over_time(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(RateLimit{PerSecond: 2, Burst: 2}, now)
+	for i := 0; i < 2; i++ {
+		if _, ok := bucket.take(now); !ok {
+			t.Fatalf("Expected burst of 2 to be allowed")
+		}
+	}
+	wait, ok := bucket.take(now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("Expected to wait 500ms for a token but ok was %v and wait %v", ok, wait)
+	}
+	if _, ok := bucket.take(now.Add(500 * time.Millisecond)); !ok {
+		t.Fatalf("Expected a token after waiting")
+	}
+	if _, ok := (*tokenBucket)(nil).take(now); !ok {
+		t.Fatalf("Expected disabled bucket to allow everything")
+	}
+}
+
+func Test_client_is_rate_limited_then_disconnected(t *testing.T) {
+	_, wsUrl := SetupWsServer(t, func(config *Config) {
+		config.Limits = LimitsConfig{
+			ClientMessages:         map[string]RateLimit{"BroadcastToSession": {PerSecond: 0.01, Burst: 1}},
+			MaxViolationsPerMinute: 2,
+		}
+	})
+	ws, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+	ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var joinMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&joinMsg)
+
+	ws.WriteJSON(BroadcastToSessionMsg{Type: "BroadcastToSession", Payload: "allowed"})
+	var broadcastMsg BroadcastFromSessionMsg
+	ws.ReadJSON(&broadcastMsg)
+	if broadcastMsg.Payload != "allowed" {
+		t.Fatalf("Expected first broadcast to be allowed but got %v", broadcastMsg)
+	}
+
+	for i := 0; i < 3; i++ {
+		ws.WriteJSON(BroadcastToSessionMsg{Type: "BroadcastToSession", Payload: "flood"})
+		var errMsg ErrorMsg
+		ws.ReadJSON(&errMsg)
+		if errMsg.Code != errRateLimited || errMsg.RetryAfterMs <= 0 {
+			t.Fatalf("Expected rate limited error with retry delay but got %v", errMsg)
+		}
+	}
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("Expected client to be disconnected for exceeding limits but got %v", err)
+	}
+}
+
+func Test_sessions_per_client_and_clients_per_session_are_limited(t *testing.T) {
+	_, wsUrl := SetupWsServer(t, func(config *Config) {
+		config.Limits = LimitsConfig{MaxSessionsPerClient: 1, MaxClientsPerSession: 1}
+	})
+	ws1, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws1)
+	ws2, client2ConnectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws2)
+
+	ws1.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var joinMsg ClientJoinedSessionMsg
+	ws1.ReadJSON(&joinMsg)
+	ws1.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var errMsg ErrorMsg
+	ws1.ReadJSON(&errMsg)
+	if errMsg.Code != errTooManySessions {
+		t.Fatalf("Expected second session to be refused but got %v", errMsg)
+	}
+
+	ws1.WriteJSON(AddClientToSessionMsg{
+		Type:        "AddClientToSession",
+		SessionID:   joinMsg.SessionID,
+		AddClientID: client2ConnectMsg.Client.ID,
+	})
+	ws1.ReadJSON(&errMsg)
+	if errMsg.Code != errSessionFull {
+		t.Fatalf("Expected full session to refuse client but got %v", errMsg)
+	}
+}
+
+func Test_connections_per_ip_are_limited(t *testing.T) {
+	_, wsUrl := SetupWsServer(t, func(config *Config) {
+		config.Limits = LimitsConfig{MaxConnectionsPerIP: 1}
+	})
+	ws, _ := ConnectClient(t, wsUrl)
+	_, res, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	if err == nil || res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected second connection from the same ip to be refused but got %v", err)
+	}
+
+	// The connection is counted until the server sees it close
+	CloseWithCloseMessage(ws)
+	WaitFor(t, "connection to be released", func() bool {
+		ws, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+		if err == nil {
+			ws.Close()
+		}
+		return err == nil
+	})
+}
+
+func Test_notes_per_session_and_note_length_are_limited(t *testing.T) {
+	_, wsUrl := SetupWsServer(t, func(config *Config) {
+		config.Limits = LimitsConfig{MaxNotesPerSession: 1, MaxNoteLength: 1}
+	})
+	ws, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+	ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var joinMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&joinMsg)
+
+	ws.WriteJSON(UpdateNoteMsg{Type: "UpdateNote", NoteID: "note1", Ops: typeText("1", "ab")})
+	var errMsg ErrorMsg
+	ws.ReadJSON(&errMsg)
+	if errMsg.Code != errNoteTooLong {
+		t.Fatalf("Expected full note to refuse the second character but got %v", errMsg)
+	}
+	var updatedMsg NoteUpdatedMsg
+	ws.ReadJSON(&updatedMsg)
+	if len(updatedMsg.Ops) != 1 {
+		t.Fatalf("Expected only the first character to be applied but got %v", updatedMsg)
+	}
+
+	ws.WriteJSON(UpdateNoteMsg{Type: "UpdateNote", NoteID: "note2", Ops: typeText("1", "c")})
+	ws.ReadJSON(&errMsg)
+	if errMsg.Code != errTooManyNotes {
+		t.Fatalf("Expected second note to be refused but got %v", errMsg)
+	}
+}
+
+func Test_sessions_per_ip_are_limited_across_reconnects(t *testing.T) {
+	_, wsUrl := SetupWsServer(t, func(config *Config) {
+		config.Limits = LimitsConfig{MaxSessionsPerClient: 1, MaxSessionsPerIP: 2}
+	})
+	for i := 0; i < 2; i++ {
+		ws, _ := ConnectClient(t, wsUrl)
+		ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+		var joinMsg ClientJoinedSessionMsg
+		ws.ReadJSON(&joinMsg)
+		if joinMsg.SessionID == "" {
+			t.Fatalf("Expected session %d to be created", i+1)
+		}
+		CloseWithCloseMessage(ws)
+	}
+
+	// Sessions outlive their owner, so a fresh client ID from the same IP gets no more
+	ws, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+	ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var errMsg ErrorMsg
+	ws.ReadJSON(&errMsg)
+	if errMsg.Code != errTooManySessions {
+		t.Fatalf("Expected third session from the same ip to be refused but got %v", errMsg)
+	}
+}
+
+func Test_ip_rate_limit_is_kept_across_reconnects(t *testing.T) {
+	_, wsUrl := SetupWsServer(t, func(config *Config) {
+		config.Limits = LimitsConfig{IPMessages: RateLimit{PerSecond: 0.01, Burst: 1}}
+	})
+	ws, _ := ConnectClient(t, wsUrl)
+	ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var joinMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&joinMsg)
+	CloseWithCloseMessage(ws)
+
+	ws, _ = ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+	ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var errMsg ErrorMsg
+	ws.ReadJSON(&errMsg)
+	if errMsg.Code != errRateLimited {
+		t.Fatalf("Expected reconnecting not to reset the ip rate limit but got %v", errMsg)
+	}
+}
+
+func Test_parallel_connections_from_one_ip_are_limited(t *testing.T) {
+	_, wsUrl := SetupWsServer(t, func(config *Config) {
+		config.Limits = LimitsConfig{MaxConnectionsPerIP: 1}
+	})
+	var wg sync.WaitGroup
+	var connected atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ws, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+			if err == nil {
+				connected.Add(1)
+				t.Cleanup(func() { CloseWithCloseMessage(ws) })
+			}
+		}()
+	}
+	wg.Wait()
+	if connected.Load() != 1 {
+		t.Fatalf("Expected one of the parallel connections to be allowed but %d were", connected.Load())
+	}
+}
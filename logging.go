@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+func newLogger(w io.Writer, level *slog.LevelVar, format string) *slog.Logger {
+	options := &slog.HandlerOptions{Level: level}
+	if format == "text" {
+		return slog.New(slog.NewTextHandler(w, options))
+	}
+	return slog.New(slog.NewJSONHandler(w, options))
+}
+
+// clientLogger - Logger with fields identifying the client and its session
+func (a *App) clientLogger(client Client) *slog.Logger {
+	return a.logger.With("clientId", client.ID, "sessionId", client.activeSessionID)
+}
+
+// LogLevelBody - Request and response body of the log level admin endpoint
+type LogLevelBody struct {
+	Level string `json:"level"`
+}
+
+// requireAdmin - Only calls next if the request has the configured admin token.
+// The admin API is disabled when no token is configured.
+func (a *App) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if a.Config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.Config.AdminToken)) != 1 {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminLogLevel - Returns the current log level, or changes it for PUT requests
+func (a *App) adminLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		body := LogLevelBody{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(body.Level)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.logLevel.Set(level)
+		a.logger.Info("Log level changed", "level", level.String())
+	}
+	res, _ := json.Marshal(LogLevelBody{Level: a.logLevel.Level().String()})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer - Buffer that can be written by the server while the test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func Test_message_bodies_are_only_logged_at_debug(t *testing.T) {
+	app := App{}
+	app.Init()
+	logs := &syncBuffer{}
+	app.logger = newLogger(logs, app.logLevel, "json")
+	testServer := httptest.NewServer(app.MainHandler())
+	defer testServer.Close()
+	wsUrl := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/api/v1/ws"
+
+	ws, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+	ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var joinMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&joinMsg)
+	ws.WriteJSON(BroadcastToSessionMsg{Type: "BroadcastToSession", Payload: "secret note"})
+	var broadcastMsg BroadcastFromSessionMsg
+	ws.ReadJSON(&broadcastMsg)
+
+	if strings.Contains(logs.String(), "secret note") {
+		t.Fatalf("Expected payload to be redacted at info level but logs were\n%s", logs.String())
+	}
+
+	app.logLevel.UnmarshalText([]byte("debug"))
+	ws.WriteJSON(BroadcastToSessionMsg{Type: "BroadcastToSession", Payload: "debug note"})
+	ws.ReadJSON(&broadcastMsg)
+	// The message is logged before it is handled, so the log is written by the time the broadcast arrives
+	if !strings.Contains(logs.String(), "debug note") {
+		t.Fatalf("Expected payload to be logged at debug level but logs were\n%s", logs.String())
+	}
+
+	// Credentials aren't logged even at debug level
+	var errMsg ErrorMsg
+	ws.WriteJSON(LoginMsg{Type: "Login", Username: "ada", Password: "secret password"})
+	ws.ReadJSON(&errMsg)
+	ws.WriteJSON(LinkDeviceMsg{Type: "LinkDevice", ClientID: "2", LinkCode: "secret link code"})
+	ws.ReadJSON(&errMsg)
+	for _, secret := range []string{"secret password", "secret link code"} {
+		if strings.Contains(logs.String(), secret) {
+			t.Fatalf("Expected %s to be redacted but logs were\n%s", secret, logs.String())
+		}
+	}
+}
+
+func Test_adding_a_client_is_logged_once_it_succeeds(t *testing.T) {
+	app := App{}
+	app.Init()
+	logs := &syncBuffer{}
+	app.logger = newLogger(logs, app.logLevel, "json")
+	testServer := httptest.NewServer(app.MainHandler())
+	defer testServer.Close()
+	wsUrl := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/api/v1/ws"
+
+	ws, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+	ws2, client2ConnectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws2)
+	ws.WriteJSON(AddClientToSessionMsg{Type: "AddClientToSession", SessionID: "missing", AddClientID: client2ConnectMsg.Client.ID})
+	var errMsg ErrorMsg
+	ws.ReadJSON(&errMsg)
+	ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var joinMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&joinMsg)
+	ws.WriteJSON(AddClientToSessionMsg{Type: "AddClientToSession", SessionID: joinMsg.SessionID, AddClientID: client2ConnectMsg.Client.ID})
+	ws.ReadJSON(&joinMsg)
+
+	added := 0
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Count(line, `"sessionId"`) > 1 {
+			t.Fatalf("Expected each key to be logged once but got %s", line)
+		}
+		// Creating a session adds its creator, only count adds of client 2
+		if strings.Contains(line, "Added client to session") && strings.Contains(line, `"addClientId":"`+client2ConnectMsg.Client.ID+`"`) {
+			added++
+			if !strings.Contains(line, `"targetSessionId":"`+joinMsg.SessionID+`"`) {
+				t.Fatalf("Expected the session the client was added to but got %s", line)
+			}
+		}
+	}
+	if added != 1 {
+		t.Fatalf("Expected only the successful add to be logged but it was logged %d times", added)
+	}
+}
+
+func Test_admin_can_change_log_level(t *testing.T) {
+	config := DefaultConfig()
+	config.AdminToken = "admin-secret"
+	app := App{Config: config}
+	app.Init()
+	testServer := httptest.NewServer(app.MainHandler())
+	defer testServer.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, testServer.URL+"/api/v1/admin/log-level", strings.NewReader(`{"level":"debug"}`))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil || res.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected request without token to be forbidden")
+	}
+
+	req, _ = http.NewRequest(http.MethodPut, testServer.URL+"/api/v1/admin/log-level", strings.NewReader(`{"level":"debug"}`))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected log level change to succeed but got %v %v", res, err)
+	}
+	var body LogLevelBody
+	json.NewDecoder(res.Body).Decode(&body)
+	if body.Level != "DEBUG" {
+		t.Fatalf("Expected level DEBUG but was %s", body.Level)
+	}
+}
@@ -1,16 +1,52 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
 	if len(os.Args) > 1 && os.Args[1] == "-ts" {
 		convertToTS()
+	} else if len(os.Args) > 1 && os.Args[1] == "-schema" {
+		writeSchemas()
+	} else if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "print" {
+		config, err := LoadConfig(os.Args[3:], os.Getenv)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		PrintConfig(os.Stdout, config)
 	} else {
-		app := App{}
+		config, err := LoadConfig(os.Args[1:], os.Getenv)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		app := App{Config: config}
 		app.Init()
-		log.Fatal(app.ListenOnPort(4010, false))
+		slog.SetDefault(app.logger)
+
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+		defer stop()
+		go func() {
+			if err := app.Listen(); err != http.ErrServerClosed {
+				slog.Error("Server stopped", "err", err)
+				os.Exit(1)
+			}
+		}()
+		<-ctx.Done()
+
+		slog.Info("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer cancel()
+		if err := app.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Error during shutdown", "err", err)
+		}
 	}
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Channel nodes announce themselves on
+const membershipChannel = "qrsync:membership"
+
+// How often a node tells the others it is alive
+const heartbeatInterval = time.Second
+
+// How long a node can go without a heartbeat before it is considered failed
+const nodeFailureTimeout = 5 * heartbeatInterval
+
+// clusterNode - Node of the cluster and the address other nodes proxy clients to
+type clusterNode struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// membershipMsg - Heartbeat or leave announcement
+type membershipMsg struct {
+	Node    clusterNode `json:"node"`
+	Leaving bool        `json:"leaving,omitempty"`
+}
+
+// membership - Tracks the live nodes of the cluster from heartbeats sent over the backplane
+// and keeps the hash ring of session owners up to date.
+type membership struct {
+	self      clusterNode
+	backplane Backplane
+	logger    *slog.Logger
+	// Called whenever a node joins, leaves or fails
+	onChange func()
+	// Clock used for failure detection, replaced in tests
+	now func() time.Time
+
+	mu       sync.Mutex
+	nodes    map[string]clusterNode
+	lastSeen map[string]time.Time
+	ring     *hashRing
+	left     bool
+	stop     chan struct{}
+}
+
+func newMembership(self clusterNode, backplane Backplane, logger *slog.Logger, onChange func()) *membership {
+	return &membership{
+		self:      self,
+		backplane: backplane,
+		logger:    logger,
+		onChange:  onChange,
+		now:       time.Now,
+		nodes:     map[string]clusterNode{self.ID: self},
+		lastSeen:  map[string]time.Time{},
+		ring:      newHashRing([]string{self.ID}),
+		stop:      make(chan struct{}),
+	}
+}
+
+// join - Starts listening for other nodes and announces this one
+func (m *membership) join() error {
+	if err := m.backplane.Subscribe(membershipChannel, m.onMessage); err != nil {
+		return err
+	}
+	return m.heartbeat()
+}
+
+// run - Sends heartbeats and detects failed nodes until leave is called
+func (m *membership) run() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.heartbeat()
+			m.expire()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// leave - Tells other nodes this node is going away so they take over its sessions straight away
+func (m *membership) leave() {
+	m.mu.Lock()
+	if m.left {
+		m.mu.Unlock()
+		return
+	}
+	m.left = true
+	close(m.stop)
+	m.mu.Unlock()
+	m.publish(membershipMsg{Node: m.self, Leaving: true})
+	m.update(func() bool {
+		delete(m.nodes, m.self.ID)
+		return true
+	})
+}
+
+func (m *membership) heartbeat() error {
+	return m.publish(membershipMsg{Node: m.self})
+}
+
+func (m *membership) publish(msg membershipMsg) error {
+	msgBytes, _ := json.Marshal(msg)
+	err := m.backplane.Publish(membershipChannel, msgBytes)
+	if err != nil {
+		m.logger.Warn("Could not send heartbeat", "err", err)
+	}
+	return err
+}
+
+func (m *membership) onMessage(data []byte) {
+	var msg membershipMsg
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Node.ID == m.self.ID {
+		return
+	}
+	joined := false
+	m.update(func() bool {
+		if msg.Leaving {
+			delete(m.lastSeen, msg.Node.ID)
+			if _, known := m.nodes[msg.Node.ID]; known {
+				delete(m.nodes, msg.Node.ID)
+				return true
+			}
+			return false
+		}
+		m.lastSeen[msg.Node.ID] = m.now()
+		if _, known := m.nodes[msg.Node.ID]; !known {
+			m.nodes[msg.Node.ID] = msg.Node
+			joined = true
+			return true
+		}
+		return false
+	})
+	if joined {
+		m.logger.Info("Node joined cluster", "nodeId", msg.Node.ID, "addr", msg.Node.Addr)
+		// Answer straight away so the new node doesn't wait a heartbeat to learn about this one
+		m.heartbeat()
+	}
+}
+
+// expire - Removes nodes that have stopped sending heartbeats
+func (m *membership) expire() {
+	m.update(func() bool {
+		changed := false
+		for nodeID, lastSeen := range m.lastSeen {
+			if m.now().Sub(lastSeen) > nodeFailureTimeout {
+				m.logger.Warn("Node failed", "nodeId", nodeID)
+				delete(m.lastSeen, nodeID)
+				delete(m.nodes, nodeID)
+				changed = true
+			}
+		}
+		return changed
+	})
+}
+
+// update - Applies change to the node list and rebuilds the ring if it reports a change
+func (m *membership) update(change func() bool) {
+	m.mu.Lock()
+	if !change() {
+		m.mu.Unlock()
+		return
+	}
+	m.ring = newHashRing(m.sortedNodeIDs())
+	m.mu.Unlock()
+	if m.onChange != nil {
+		m.onChange()
+	}
+}
+
+// owner - Live node that owns the session, false if there are no live nodes
+func (m *membership) owner(sessionID string) (clusterNode, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.nodes[m.ring.owner(sessionID)]
+	return node, ok
+}
+
+// node - Looks up a live node by ID
+func (m *membership) node(nodeID string) (clusterNode, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.nodes[nodeID]
+	return node, ok
+}
+
+// nodeIDs - IDs of the live nodes, sorted
+func (m *membership) nodeIDs() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sortedNodeIDs()
+}
+
+// sortedNodeIDs - Caller must hold m.mu
+func (m *membership) sortedNodeIDs() []string {
+	nodeIDs := make([]string, 0, len(m.nodes))
+	for nodeID := range m.nodes {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+	return nodeIDs
+}
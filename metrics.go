@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// appMetrics - Prometheus metrics for an App. Each App has its own registry.
+type appMetrics struct {
+	registry          *prometheus.Registry
+	messagesIn        *prometheus.CounterVec
+	messagesOut       *prometheus.CounterVec
+	bytesIn           prometheus.Counter
+	bytesOut          prometheus.Counter
+	droppedMessages   *prometheus.CounterVec
+	upgradeFailures   prometheus.Counter
+	handlerDuration   *prometheus.HistogramVec
+	fanOutDuration    prometheus.Histogram
+	webhookDeliveries *prometheus.CounterVec
+	limitViolations   *prometheus.CounterVec
+	rejectedMessages  *prometheus.CounterVec
+	originRejections  prometheus.Counter
+	authFailures      prometheus.Counter
+}
+
+func newAppMetrics(a *App) *appMetrics {
+	m := &appMetrics{
+		registry: prometheus.NewRegistry(),
+		messagesIn: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "qrsync_messages_in_total",
+			Help: "Messages received from clients by type.",
+		}, []string{"type"}),
+		messagesOut: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "qrsync_messages_out_total",
+			Help: "Messages written to clients by type.",
+		}, []string{"type"}),
+		bytesIn: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "qrsync_bytes_in_total",
+			Help: "Bytes received from clients.",
+		}),
+		bytesOut: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "qrsync_bytes_out_total",
+			Help: "Bytes written to clients.",
+		}),
+		droppedMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "qrsync_dropped_messages_total",
+			Help: "Messages that could not be delivered to a client by reason.",
+		}, []string{"reason"}),
+		upgradeFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "qrsync_upgrade_failures_total",
+			Help: "Websocket upgrades that failed.",
+		}),
+		handlerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "qrsync_handler_duration_seconds",
+			Help:    "Time taken to handle a message from a client by type.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"type"}),
+		fanOutDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "qrsync_broadcast_fan_out_duration_seconds",
+			Help:    "Time taken to queue a message for every client in a session.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}),
+		webhookDeliveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "qrsync_webhook_deliveries_total",
+			Help: "Webhook delivery attempts by result.",
+		}, []string{"result"}),
+		limitViolations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "qrsync_limit_violations_total",
+			Help: "Messages and connections refused for exceeding a limit by error code.",
+		}, []string{"code"}),
+		rejectedMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "qrsync_rejected_messages_total",
+			Help: "Messages from clients rejected as too large, malformed or of an unknown type by error code.",
+		}, []string{"code"}),
+		originRejections: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "qrsync_origin_rejections_total",
+			Help: "Requests and websocket upgrades refused because their origin is not allowed.",
+		}),
+		authFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "qrsync_auth_failures_total",
+			Help: "Connections refused for a missing or invalid bearer token.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.messagesIn,
+		m.messagesOut,
+		m.bytesIn,
+		m.bytesOut,
+		m.droppedMessages,
+		m.upgradeFailures,
+		m.handlerDuration,
+		m.fanOutDuration,
+		m.webhookDeliveries,
+		m.limitViolations,
+		m.rejectedMessages,
+		m.originRejections,
+		m.authFailures,
+		&stateCollector{app: a},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// msgTypeLabel - Type label of a message from a client. Types clients can't send are counted
+// as unknown so made up types can't create new series.
+func msgTypeLabel(msgType string) string {
+	if _, known := inboundMsgTypes[msgType]; known {
+		return msgType
+	}
+	return "unknown"
+}
+
+func (m *appMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+var (
+	connectedClientsDesc = prometheus.NewDesc(
+		"qrsync_connected_clients", "Clients currently connected.", nil, nil,
+	)
+	activeSessionsDesc = prometheus.NewDesc(
+		"qrsync_active_sessions", "Sessions currently held by the server.", nil, nil,
+	)
+	sessionSizeDesc = prometheus.NewDesc(
+		"qrsync_session_size", "Number of clients in each session.", nil, nil,
+	)
+	sessionSizeBuckets = []float64{1, 2, 3, 4, 6, 8, 12, 16}
+)
+
+// stateCollector - Reads client and session counts from the App when scraped
+type stateCollector struct {
+	app *App
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connectedClientsDesc
+	ch <- activeSessionsDesc
+	ch <- sessionSizeDesc
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	c.app.mu.Lock()
+	clientCount := len(c.app.ClientMap)
+	sessionCount := len(c.app.SessionMap)
+	buckets := make(map[float64]uint64, len(sessionSizeBuckets))
+	sum := 0.0
+	for _, session := range c.app.SessionMap {
+		size := float64(len(session.ClientIDs))
+		sum += size
+		for _, bucket := range sessionSizeBuckets {
+			if size <= bucket {
+				buckets[bucket]++
+			}
+		}
+	}
+	c.app.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(connectedClientsDesc, prometheus.GaugeValue, float64(clientCount))
+	ch <- prometheus.MustNewConstMetric(activeSessionsDesc, prometheus.GaugeValue, float64(sessionCount))
+	ch <- prometheus.MustNewConstHistogram(sessionSizeDesc, uint64(sessionCount), sum, buckets)
+}
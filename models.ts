@@ -1,10 +1,39 @@
 export namespace ServerTypes {
-    export type Msg = ClientConnectMsg | CreateSessionMsg | UpdateClientMsg | AddClientToSessionMsg | ClientJoinedSessionMsg | ClientLeftSessionMsg | BroadcastToSessionMsg | BroadcastFromSessionMsg | ErrorMsg | InfoMsg
+    export type Msg = ClientConnectMsg | CreateSessionMsg | UpdateClientMsg | ClientUpdatedMsg | AddClientToSessionMsg | ClientJoinedSessionMsg | ClientLeftSessionMsg | BroadcastToSessionMsg | BroadcastFromSessionMsg | UpdateNoteMsg | NoteUpdatedMsg | NoteSnapshotMsg | SetClipboardMsg | ClipboardUpdatedMsg | ClipboardHistoryMsg | RtcOfferMsg | RtcAnswerMsg | RtcIceCandidateMsg | PublishKeyMsg | SessionKeyRotationMsg | SendEncryptedMsg | EncryptedFromSessionMsg | ServerShuttingDownMsg | SessionMovedMsg | SessionEndedMsg | RegisterMsg | LoginMsg | LinkDeviceMsg | DeviceLinkedMsg | UnlinkDeviceMsg | ListDevicesMsg | UserDevicesMsg | StartSessionWithDevicesMsg | PairRequestMsg | PairAcceptMsg | TrustedDeviceCredentialMsg | InviteTrustedDeviceMsg | ListTrustedDevicesMsg | RevokeTrustedDeviceMsg | TrustedDevicesMsg | PresenceChangedMsg | ErrorMsg | InfoMsg
 
+    export enum ContentKind {
+        TextNote = "textNote",
+        URL = "url",
+        Clipboard = "clipboard",
+        FileRef = "fileRef",
+        JSONData = "jsonData",
+    }
+    export enum DeviceType {
+        Phone = "phone",
+        Tablet = "tablet",
+        Laptop = "laptop",
+        Desktop = "desktop",
+        TV = "tv",
+        Other = "other",
+    }
+    export enum PresenceStatus {
+        Active = "active",
+        Idle = "idle",
+        Away = "away",
+    }
     export interface Client {
         id: string;
         name: string;
         lastJoinTime: string;
+        clipboardSync: boolean;
+        publicKey: string;
+        deviceType?: DeviceType;
+        platform?: string;
+        userAgent?: string;
+        appVersion?: string;
+        presence: PresenceStatus;
+        presenceSince: string;
+        lastActivity: string;
     }
     export interface Session {
         id: string;
@@ -14,18 +43,41 @@ export namespace ServerTypes {
     export interface ClientConnectMsg {
         type: "ClientConnect";
         client: Client;
+        transportToken: string;
+        identity?: string;
+        userId?: string;
+        deviceId?: string;
+        trustedDeviceId?: string;
+        linkCode: string;
     }
     export interface CreateSessionMsg {
         type: "CreateSession";
     }
     export interface UpdateClientMsg {
         type: "UpdateClient";
-        name: string;
+        name?: string;
+        clipboardSync?: boolean;
+        deviceType?: DeviceType;
+        platform?: string;
+        userAgent?: string;
+        appVersion?: string;
+        presence?: PresenceStatus;
+    }
+    export interface ClientUpdatedMsg {
+        type: "ClientUpdated";
+        clientId: string;
+        name?: string;
+        clipboardSync?: boolean;
+        deviceType?: DeviceType;
+        platform?: string;
+        userAgent?: string;
+        appVersion?: string;
     }
     export interface AddClientToSessionMsg {
         type: "AddClientToSession";
         sessionId: string;
         addClientId: string;
+        trust?: boolean;
     }
     export interface ClientJoinedSessionMsg {
         type: "ClientJoinedSession";
@@ -33,6 +85,8 @@ export namespace ServerTypes {
         sessionId: string;
         sessionOwnerId: string;
         clientMap: {[key: string]: Client};
+        keyEpoch: number;
+        keyDirectory: {[key: string]: string};
     }
     export interface ClientLeftSessionMsg {
         type: "ClientLeftSession";
@@ -41,19 +95,257 @@ export namespace ServerTypes {
         sessionOwnerId: string;
         clientMap: {[key: string]: Client};
     }
+    export interface JSONDataContent {
+        data: string;
+    }
+    export interface FileRefContent {
+        name: string;
+        mimeType: string;
+        size: number;
+        url: string;
+    }
+    export interface ClipboardContent {
+        mimeType: string;
+        content: string;
+    }
+    export interface URLContent {
+        url: string;
+        title: string;
+    }
+    export interface TextNoteContent {
+        title: string;
+        text: string;
+    }
+    export interface SharedContent {
+        kind: ContentKind;
+        textNote?: TextNoteContent;
+        url?: URLContent;
+        clipboard?: ClipboardContent;
+        fileRef?: FileRefContent;
+        jsonData?: JSONDataContent;
+    }
     export interface BroadcastToSessionMsg {
         type: "BroadcastToSession";
         payload: string;
+        content?: SharedContent;
     }
     export interface BroadcastFromSessionMsg {
         type: "BroadcastFromSession";
         fromSessionOwner: boolean;
         senderId: string;
         payload: string;
+        content?: SharedContent;
+    }
+    export interface NoteOpID {
+        clientId: string;
+        counter: number;
+    }
+    export interface NoteOp {
+        kind: string;
+        id: NoteOpID;
+        origin?: NoteOpID;
+        value: string;
+    }
+    export interface UpdateNoteMsg {
+        type: "UpdateNote";
+        noteId: string;
+        ops: NoteOp[];
+    }
+    export interface NoteUpdatedMsg {
+        type: "NoteUpdated";
+        noteId: string;
+        senderId: string;
+        ops: NoteOp[];
+    }
+    export interface NoteElement {
+        id: NoteOpID;
+        origin?: NoteOpID;
+        value: string;
+        length?: number;
+        deleted: boolean;
+    }
+    export interface NoteSnapshotMsg {
+        type: "NoteSnapshot";
+        noteId: string;
+        elements: NoteElement[];
+    }
+    export interface SetClipboardMsg {
+        type: "SetClipboard";
+        mimeType: string;
+        content: string;
+    }
+    export interface ClipboardEntry {
+        senderId: string;
+        mimeType: string;
+        content: string;
+        setTime: string;
+    }
+    export interface ClipboardUpdatedMsg {
+        type: "ClipboardUpdated";
+        entry: ClipboardEntry;
+    }
+    export interface ClipboardHistoryMsg {
+        type: "ClipboardHistory";
+        entries: ClipboardEntry[];
+    }
+    export interface RtcOfferMsg {
+        type: "RtcOffer";
+        toClientId: string;
+        fromClientId: string;
+        sdp: string;
+    }
+    export interface RtcAnswerMsg {
+        type: "RtcAnswer";
+        toClientId: string;
+        fromClientId: string;
+        sdp: string;
+    }
+    export interface RtcIceCandidateMsg {
+        type: "RtcIceCandidate";
+        toClientId: string;
+        fromClientId: string;
+        candidate: string;
+        sdpMid: string;
+        sdpMLineIndex: number;
+    }
+    export interface PublishKeyMsg {
+        type: "PublishKey";
+        publicKey: string;
+    }
+    export interface SessionKeyRotationMsg {
+        type: "SessionKeyRotation";
+        sessionId: string;
+        keyEpoch: number;
+        keyDirectory: {[key: string]: string};
+    }
+    export interface EncryptedEnvelope {
+        toClientId: string;
+        ciphertext: string;
+        nonce: string;
+    }
+    export interface SendEncryptedMsg {
+        type: "SendEncrypted";
+        keyEpoch: number;
+        envelopes: EncryptedEnvelope[];
+    }
+    export interface EncryptedFromSessionMsg {
+        type: "EncryptedFromSession";
+        senderId: string;
+        keyEpoch: number;
+        ciphertext: string;
+        nonce: string;
+    }
+    export interface ServerShuttingDownMsg {
+        type: "ServerShuttingDown";
+        message: string;
+        reconnectAfterMs: number;
+    }
+    export interface SessionMovedMsg {
+        type: "SessionMoved";
+        sessionId: string;
+        rejoinToken?: string;
+        reconnectAfterMs: number;
+    }
+    export interface SessionEndedMsg {
+        type: "SessionEnded";
+        sessionId: string;
+    }
+    export interface RegisterMsg {
+        type: "Register";
+        username: string;
+        password: string;
+        deviceName: string;
+    }
+    export interface LoginMsg {
+        type: "Login";
+        username: string;
+        password: string;
+        deviceName: string;
+    }
+    export interface LinkDeviceMsg {
+        type: "LinkDevice";
+        clientId: string;
+        linkCode: string;
+        deviceName: string;
+    }
+    export interface DeviceLinkedMsg {
+        type: "DeviceLinked";
+        userId: string;
+        username: string;
+        deviceId: string;
+        deviceToken: string;
+    }
+    export interface UnlinkDeviceMsg {
+        type: "UnlinkDevice";
+        deviceId: string;
+    }
+    export interface ListDevicesMsg {
+        type: "ListDevices";
+    }
+    export interface UserDevice {
+        id: string;
+        name: string;
+        linkedAt: string;
+        clientId?: string;
+    }
+    export interface UserDevicesMsg {
+        type: "UserDevices";
+        userId: string;
+        devices: UserDevice[];
+    }
+    export interface StartSessionWithDevicesMsg {
+        type: "StartSessionWithDevices";
+        deviceIds?: string[];
+    }
+    export interface PairRequestMsg {
+        type: "PairRequest";
+        requestId: string;
+        clientId: string;
+        name: string;
+    }
+    export interface PairAcceptMsg {
+        type: "PairAccept";
+        requestId: string;
+    }
+    export interface TrustedDeviceCredentialMsg {
+        type: "TrustedDeviceCredential";
+        deviceId: string;
+        deviceToken: string;
+    }
+    export interface InviteTrustedDeviceMsg {
+        type: "InviteTrustedDevice";
+        deviceId: string;
+    }
+    export interface ListTrustedDevicesMsg {
+        type: "ListTrustedDevices";
+    }
+    export interface RevokeTrustedDeviceMsg {
+        type: "RevokeTrustedDevice";
+        deviceId: string;
+    }
+    export interface TrustedDeviceInfo {
+        id: string;
+        name: string;
+        pairedAt: string;
+        clientId?: string;
+    }
+    export interface TrustedDevicesMsg {
+        type: "TrustedDevices";
+        deviceId: string;
+        devices: TrustedDeviceInfo[];
+    }
+    export interface PresenceChangedMsg {
+        type: "PresenceChanged";
+        clientId: string;
+        presence: PresenceStatus;
+        presenceSince: string;
+        lastActivity: string;
     }
     export interface ErrorMsg {
         type: "Error";
+        code?: string;
         message: string;
+        retryAfterMs?: number;
     }
     export interface InfoMsg {
         type: "Info";
@@ -6,22 +6,57 @@ import (
 	"strings"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/tkrajina/typescriptify-golang-structs/typescriptify"
 )
 
 func convertToTS() {
 	converter := typescriptify.New().
+		AddEnum(allContentKinds).
+		AddEnum(allDeviceTypes).
+		AddEnum(allPresenceStatuses).
 		Add(Client{}).
 		Add(Session{}).
 		Add(ClientConnectMsg{}).
 		Add(CreateSessionMsg{}).
 		Add(UpdateClientMsg{}).
+		Add(ClientUpdatedMsg{}).
 		Add(AddClientToSessionMsg{}).
 		Add(ClientJoinedSessionMsg{}).
 		Add(ClientLeftSessionMsg{}).
 		Add(BroadcastToSessionMsg{}).
 		Add(BroadcastFromSessionMsg{}).
+		Add(UpdateNoteMsg{}).
+		Add(NoteUpdatedMsg{}).
+		Add(NoteSnapshotMsg{}).
+		Add(SetClipboardMsg{}).
+		Add(ClipboardUpdatedMsg{}).
+		Add(ClipboardHistoryMsg{}).
+		Add(RtcOfferMsg{}).
+		Add(RtcAnswerMsg{}).
+		Add(RtcIceCandidateMsg{}).
+		Add(PublishKeyMsg{}).
+		Add(SessionKeyRotationMsg{}).
+		Add(SendEncryptedMsg{}).
+		Add(EncryptedFromSessionMsg{}).
+		Add(ServerShuttingDownMsg{}).
+		Add(SessionMovedMsg{}).
+		Add(SessionEndedMsg{}).
+		Add(RegisterMsg{}).
+		Add(LoginMsg{}).
+		Add(LinkDeviceMsg{}).
+		Add(DeviceLinkedMsg{}).
+		Add(UnlinkDeviceMsg{}).
+		Add(ListDevicesMsg{}).
+		Add(UserDevicesMsg{}).
+		Add(StartSessionWithDevicesMsg{}).
+		Add(PairRequestMsg{}).
+		Add(PairAcceptMsg{}).
+		Add(TrustedDeviceCredentialMsg{}).
+		Add(InviteTrustedDeviceMsg{}).
+		Add(ListTrustedDevicesMsg{}).
+		Add(RevokeTrustedDeviceMsg{}).
+		Add(TrustedDevicesMsg{}).
+		Add(PresenceChangedMsg{}).
 		Add(ErrorMsg{}).
 		Add(InfoMsg{})
 
@@ -52,9 +87,35 @@ func convertToTS() {
 type Client struct {
 	ID              string `json:"id"`
 	Name            string `json:"name"`
-	conn            *websocket.Conn
+	transport       Transport
 	activeSessionID string
+	transportToken  string
 	LastJoinTime    time.Time `json:"lastJoinTime"`
+	// Whether the client receives clipboard updates from its session
+	ClipboardSync bool `json:"clipboardSync"`
+	// Base64 X25519 public key used by other members to encrypt content for this client
+	PublicKey string `json:"publicKey"`
+	// Device the client runs on as reported by the client, the user agent defaults to the one it connected with
+	DeviceType DeviceType `json:"deviceType,omitempty"`
+	Platform   string     `json:"platform,omitempty"`
+	UserAgent  string     `json:"userAgent,omitempty"`
+	AppVersion string     `json:"appVersion,omitempty"`
+	// Presence reported by the client, when it last changed and when the client last sent a message
+	Presence      PresenceStatus `json:"presence"`
+	PresenceSince time.Time      `json:"presenceSince"`
+	LastActivity  time.Time      `json:"lastActivity"`
+	// Address the client connected from, for per IP limits
+	remoteIP string
+	limits   *clientLimits
+	// Issuer and subject of the bearer token the client connected with as issuer|sub
+	identity string
+	// Account user and device the client is signed in as, empty for anonymous clients
+	userID   string
+	deviceID string
+	// Trusted device the client connected as, empty until it is paired
+	trustedDeviceID string
+	// Secret another device must know to link this client, empty once used
+	linkCode string
 }
 
 // Session - Session for sharing content
@@ -63,6 +124,30 @@ type Session struct {
 	OwnerID     string   `json:"ownerId"`
 	ClientIDs   []string `json:"clientIds"`
 	createdDate time.Time
+	notes       map[string]*NoteDoc
+	// Most recent clipboard entries, latest last
+	clipboard []ClipboardEntry
+	// Incremented whenever membership or member keys change
+	keyEpoch int
+	// Rejoin secrets of clients that were welcomed to the session, by client ID
+	members map[string]SessionMember
+	// IP the owner created the session from, counted against its session limit
+	ownerIP string
+}
+
+// SessionMember - Hash of the transport token a member was welcomed with, which it
+// presents to rejoin the session after reconnecting
+type SessionMember struct {
+	TokenHash string    `json:"tokenHash"`
+	JoinedAt  time.Time `json:"joinedAt"`
+}
+
+// ClipboardEntry - Value set on a session clipboard
+type ClipboardEntry struct {
+	SenderID string    `json:"senderId"`
+	MimeType string    `json:"mimeType"`
+	Content  string    `json:"content"`
+	SetTime  time.Time `json:"setTime"`
 }
 
 // CreateSessionMsg - Sent from client to create session
@@ -74,19 +159,55 @@ type CreateSessionMsg struct {
 type ClientConnectMsg struct {
 	Type   string `json:"type"`
 	Client Client `json:"client"`
+	// Secret used by clients without a websocket to send messages over http, and as the
+	// rejoinToken to get back into the client's session after reconnecting
+	TransportToken string `json:"transportToken"`
+	// Set when the client connected with a bearer token, the token's issuer and subject as issuer|sub
+	Identity string `json:"identity,omitempty"`
+	// Set when the client connected with the deviceToken of a device linked to a user
+	UserID   string `json:"userId,omitempty"`
+	DeviceID string `json:"deviceId,omitempty"`
+	// Set when the client connected with the trustedDeviceToken of a paired device
+	TrustedDeviceID string `json:"trustedDeviceId,omitempty"`
+	// One time code to show in the client's QR code, a signed in device that scans it
+	// sends the code in LinkDevice to link this client to its user
+	LinkCode string `json:"linkCode"`
 }
 
 // UpdateClientMsg - Updates a client
 type UpdateClientMsg struct {
 	Type string `json:"type"`
-	Name string `json:"name"`
+	// Fields left out are unchanged
+	Name          *string `json:"name,omitempty"`
+	ClipboardSync *bool   `json:"clipboardSync,omitempty"`
+	// Device details and presence, left unchanged when empty
+	DeviceType DeviceType     `json:"deviceType,omitempty"`
+	Platform   string         `json:"platform,omitempty"`
+	UserAgent  string         `json:"userAgent,omitempty"`
+	AppVersion string         `json:"appVersion,omitempty"`
+	Presence   PresenceStatus `json:"presence,omitempty"`
+}
+
+// ClientUpdatedMsg - Sent to clients sharing a session with ClientID when it changes, with only the changed fields set
+type ClientUpdatedMsg struct {
+	Type          string     `json:"type"`
+	ClientID      string     `json:"clientId"`
+	Name          *string    `json:"name,omitempty"`
+	ClipboardSync *bool      `json:"clipboardSync,omitempty"`
+	DeviceType    DeviceType `json:"deviceType,omitempty"`
+	Platform      string     `json:"platform,omitempty"`
+	UserAgent     string     `json:"userAgent,omitempty"`
+	AppVersion    string     `json:"appVersion,omitempty"`
 }
 
 // AddClientToSessionMsg - Websocket message
 type AddClientToSessionMsg struct {
 	Type        string `json:"type"`
-	SessionID   string `json:"sessionId"`
-	AddClientID string `json:"addClientId"`
+	SessionID   string `json:"sessionId" jsonschema:"required"`
+	AddClientID string `json:"addClientId" jsonschema:"required"`
+	// Asks the added client to pair its device with the session owner's so either can
+	// invite the other into later sessions without a QR scan. They are paired once it accepts.
+	Trust bool `json:"trust,omitempty"`
 }
 
 // ClientJoinedSessionMsg -
@@ -96,6 +217,8 @@ type ClientJoinedSessionMsg struct {
 	SessionID      string            `json:"sessionId"`
 	SessionOwnerID string            `json:"sessionOwnerId"`
 	ClientMap      map[string]Client `json:"clientMap"`
+	KeyEpoch       int               `json:"keyEpoch"`
+	KeyDirectory   map[string]string `json:"keyDirectory"`
 }
 
 // ClientLeftSessionMsg -
@@ -107,24 +230,300 @@ type ClientLeftSessionMsg struct {
 	ClientMap      map[string]Client `json:"clientMap"`
 }
 
-// BroadcastToSessionMsg - Used by client to send content to all clients in session
+// BroadcastToSessionMsg - Used by client to send content to all clients in session.
+// New clients should send typed Content, Payload is kept for older clients.
 type BroadcastToSessionMsg struct {
-	Type    string `json:"type"`
-	Payload string `json:"payload"`
+	Type    string         `json:"type"`
+	Payload string         `json:"payload"`
+	Content *SharedContent `json:"content,omitempty"`
 }
 
-// BroadcastFromSessionMsg - Used by server to send content all clients in a session
+// BroadcastFromSessionMsg - Used by server to send content all clients in a session.
+// SenderID starts with "integration:" when a server integration sent it through the REST API.
 type BroadcastFromSessionMsg struct {
-	Type             string `json:"type"`
-	FromSessionOwner bool   `json:"fromSessionOwner"`
-	SenderID         string `json:"senderId"`
-	Payload          string `json:"payload"`
+	Type             string         `json:"type"`
+	FromSessionOwner bool           `json:"fromSessionOwner"`
+	SenderID         string         `json:"senderId"`
+	Payload          string         `json:"payload"`
+	Content          *SharedContent `json:"content,omitempty"`
+}
+
+// UpdateNoteMsg - Sent by client to edit a collaborative note in its active session
+type UpdateNoteMsg struct {
+	Type   string   `json:"type"`
+	NoteID string   `json:"noteId" jsonschema:"required"`
+	Ops    []NoteOp `json:"ops" jsonschema:"required"`
+}
+
+// NoteUpdatedMsg - Sent by server to all clients in a session with ops merged into a note
+type NoteUpdatedMsg struct {
+	Type     string   `json:"type"`
+	NoteID   string   `json:"noteId"`
+	SenderID string   `json:"senderId"`
+	Ops      []NoteOp `json:"ops"`
+}
+
+// NoteSnapshotMsg - Sent to a client joining a session with the current state of a note
+type NoteSnapshotMsg struct {
+	Type     string        `json:"type"`
+	NoteID   string        `json:"noteId"`
+	Elements []NoteElement `json:"elements"`
+}
+
+// SetClipboardMsg - Sent by client to set the clipboard of its active session
+type SetClipboardMsg struct {
+	Type     string `json:"type"`
+	MimeType string `json:"mimeType"`
+	Content  string `json:"content" jsonschema:"required"`
+}
+
+// ClipboardUpdatedMsg - Sent to clients in a session with clipboard sync on when the clipboard is set
+type ClipboardUpdatedMsg struct {
+	Type  string         `json:"type"`
+	Entry ClipboardEntry `json:"entry"`
+}
+
+// ClipboardHistoryMsg - Sent to a client joining a session with the latest clipboard entries, latest last
+type ClipboardHistoryMsg struct {
+	Type    string           `json:"type"`
+	Entries []ClipboardEntry `json:"entries"`
+}
+
+// RtcOfferMsg - WebRTC offer relayed to another client in the same session.
+// FromClientID is set by the server.
+type RtcOfferMsg struct {
+	Type         string `json:"type"`
+	ToClientID   string `json:"toClientId" jsonschema:"required"`
+	FromClientID string `json:"fromClientId"`
+	SDP          string `json:"sdp" jsonschema:"required"`
+}
+
+// RtcAnswerMsg - WebRTC answer relayed to another client in the same session.
+// FromClientID is set by the server.
+type RtcAnswerMsg struct {
+	Type         string `json:"type"`
+	ToClientID   string `json:"toClientId" jsonschema:"required"`
+	FromClientID string `json:"fromClientId"`
+	SDP          string `json:"sdp" jsonschema:"required"`
+}
+
+// RtcIceCandidateMsg - WebRTC ICE candidate relayed to another client in the same session.
+// FromClientID is set by the server.
+type RtcIceCandidateMsg struct {
+	Type          string `json:"type"`
+	ToClientID    string `json:"toClientId" jsonschema:"required"`
+	FromClientID  string `json:"fromClientId"`
+	Candidate     string `json:"candidate" jsonschema:"required"`
+	SDPMid        string `json:"sdpMid"`
+	SDPMLineIndex int    `json:"sdpMLineIndex"`
+}
+
+// PublishKeyMsg - Sent by client to publish its X25519 public key
+type PublishKeyMsg struct {
+	Type      string `json:"type"`
+	PublicKey string `json:"publicKey" jsonschema:"required"`
+}
+
+// SessionKeyRotationMsg - Sent to session members when membership or keys change.
+// Content must be re-encrypted for the new key directory.
+type SessionKeyRotationMsg struct {
+	Type         string            `json:"type"`
+	SessionID    string            `json:"sessionId"`
+	KeyEpoch     int               `json:"keyEpoch"`
+	KeyDirectory map[string]string `json:"keyDirectory"`
+}
+
+// EncryptedEnvelope - Content encrypted by the sender for a single recipient
+type EncryptedEnvelope struct {
+	ToClientID string `json:"toClientId" jsonschema:"required"`
+	Ciphertext string `json:"ciphertext" jsonschema:"required"`
+	Nonce      string `json:"nonce" jsonschema:"required"`
+}
+
+// SendEncryptedMsg - Sent by client with one envelope per recipient
+type SendEncryptedMsg struct {
+	Type      string              `json:"type"`
+	KeyEpoch  int                 `json:"keyEpoch" jsonschema:"required"`
+	Envelopes []EncryptedEnvelope `json:"envelopes" jsonschema:"required"`
+}
+
+// EncryptedFromSessionMsg - Envelope relayed by server to its recipient
+type EncryptedFromSessionMsg struct {
+	Type       string `json:"type"`
+	SenderID   string `json:"senderId"`
+	KeyEpoch   int    `json:"keyEpoch"`
+	Ciphertext string `json:"ciphertext"`
+	Nonce      string `json:"nonce"`
+}
+
+// RegisterMsg - Creates a user account and links the sending device to it
+type RegisterMsg struct {
+	Type       string `json:"type"`
+	Username   string `json:"username" jsonschema:"required"`
+	Password   string `json:"password" jsonschema:"required"`
+	DeviceName string `json:"deviceName"`
+}
+
+// LoginMsg - Links the sending device to an existing user account
+type LoginMsg struct {
+	Type       string `json:"type"`
+	Username   string `json:"username" jsonschema:"required"`
+	Password   string `json:"password" jsonschema:"required"`
+	DeviceName string `json:"deviceName"`
+}
+
+// LinkDeviceMsg - Sent by a signed in device after scanning another device's QR code
+// to link that device to the same user
+type LinkDeviceMsg struct {
+	Type     string `json:"type"`
+	ClientID string `json:"clientId" jsonschema:"required"`
+	// linkCode from the scanned device's QR code
+	LinkCode   string `json:"linkCode" jsonschema:"required"`
+	DeviceName string `json:"deviceName"`
+}
+
+// DeviceLinkedMsg - Sent to a device when it is linked to a user. The device should keep
+// DeviceToken and connect with ?deviceToken= to be signed in again.
+type DeviceLinkedMsg struct {
+	Type        string `json:"type"`
+	UserID      string `json:"userId"`
+	Username    string `json:"username"`
+	DeviceID    string `json:"deviceId"`
+	DeviceToken string `json:"deviceToken"`
+}
+
+// UnlinkDeviceMsg - Removes a device from the sender's user, which can be the sender itself
+type UnlinkDeviceMsg struct {
+	Type     string `json:"type"`
+	DeviceID string `json:"deviceId" jsonschema:"required"`
+}
+
+// ListDevicesMsg - Asks for the devices linked to the sender's user
+type ListDevicesMsg struct {
+	Type string `json:"type"`
+}
+
+// UserDevice - Device linked to a user. ClientID is set while the device is connected.
+type UserDevice struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	LinkedAt time.Time `json:"linkedAt"`
+	ClientID string    `json:"clientId,omitempty"`
+}
+
+// UserDevicesMsg - Devices linked to a user
+type UserDevicesMsg struct {
+	Type    string       `json:"type"`
+	UserID  string       `json:"userId"`
+	Devices []UserDevice `json:"devices"`
+}
+
+// StartSessionWithDevicesMsg - Creates a session with the sender's other connected devices.
+// All of them are added when DeviceIDs is empty.
+type StartSessionWithDevicesMsg struct {
+	Type      string   `json:"type"`
+	DeviceIDs []string `json:"deviceIds,omitempty"`
+}
+
+// PairRequestMsg - Sent to a client added to a session with trust, asking whether it wants to
+// pair with the session owner ClientID
+type PairRequestMsg struct {
+	Type      string `json:"type"`
+	RequestID string `json:"requestId"`
+	ClientID  string `json:"clientId"`
+	Name      string `json:"name"`
+}
+
+// PairAcceptMsg - Accepts a PairRequest, after which both devices are sent credentials
+type PairAcceptMsg struct {
+	Type      string `json:"type"`
+	RequestID string `json:"requestId" jsonschema:"required"`
+}
+
+// TrustedDeviceCredentialMsg - Credential a newly trusted device reconnects with as the
+// trustedDeviceToken query parameter to stay paired
+type TrustedDeviceCredentialMsg struct {
+	Type        string `json:"type"`
+	DeviceID    string `json:"deviceId"`
+	DeviceToken string `json:"deviceToken"`
+}
+
+// InviteTrustedDeviceMsg - Creates a session with a connected device paired with the sender
+type InviteTrustedDeviceMsg struct {
+	Type     string `json:"type"`
+	DeviceID string `json:"deviceId" jsonschema:"required"`
+}
+
+// ListTrustedDevicesMsg - Asks for the devices paired with the sender
+type ListTrustedDevicesMsg struct {
+	Type string `json:"type"`
+}
+
+// RevokeTrustedDeviceMsg - Unpairs the sender's device from another device
+type RevokeTrustedDeviceMsg struct {
+	Type     string `json:"type"`
+	DeviceID string `json:"deviceId" jsonschema:"required"`
+}
+
+// TrustedDeviceInfo - Device paired with the receiver. ClientID is set while it is connected.
+type TrustedDeviceInfo struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	PairedAt time.Time `json:"pairedAt"`
+	ClientID string    `json:"clientId,omitempty"`
+}
+
+// TrustedDevicesMsg - Devices paired with the receiver's trusted device DeviceID
+type TrustedDevicesMsg struct {
+	Type     string              `json:"type"`
+	DeviceID string              `json:"deviceId"`
+	Devices  []TrustedDeviceInfo `json:"devices"`
+}
+
+// PresenceChangedMsg - Sent to a client's session members when its presence changes
+type PresenceChangedMsg struct {
+	Type          string         `json:"type"`
+	ClientID      string         `json:"clientId"`
+	Presence      PresenceStatus `json:"presence"`
+	PresenceSince time.Time      `json:"presenceSince"`
+	LastActivity  time.Time      `json:"lastActivity"`
+}
+
+// SessionMovedMsg - Tells a client its session is served by another node. The client should
+// reconnect with its clientId, the rejoinToken sent here or else its transportToken, and the
+// sessionId so it is routed to the node that owns the session.
+type SessionMovedMsg struct {
+	Type      string `json:"type"`
+	SessionID string `json:"sessionId"`
+	// One time token for clients added from another node, which never saw their transportToken
+	RejoinToken string `json:"rejoinToken,omitempty"`
+	// How long clients should wait before reconnecting
+	ReconnectAfterMs int64 `json:"reconnectAfterMs"`
+}
+
+// SessionEndedMsg - Tells a client its active session expired and no longer exists
+type SessionEndedMsg struct {
+	Type      string `json:"type"`
+	SessionID string `json:"sessionId"`
+}
+
+// ServerShuttingDownMsg - Sent to all clients before the server restarts. Clients reconnect
+// with their clientId and their transportToken as rejoinToken to get back into their session.
+type ServerShuttingDownMsg struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	// How long clients should wait before reconnecting
+	ReconnectAfterMs int64 `json:"reconnectAfterMs"`
 }
 
 // ErrorMsg - Websocket error message
 type ErrorMsg struct {
-	Type    string `json:"type"`
+	Type string `json:"type"`
+	// Machine readable reason, e.g. rate_limited, empty for errors without one
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message"`
+	// How long to wait before sending the message again when rate limited
+	RetryAfterMs int64 `json:"retryAfterMs,omitempty"`
 }
 
 // InfoMsg - Websocket info message
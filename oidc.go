@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long signing keys are used before being fetched again
+	jwksCacheTTL = time.Hour
+	// Least time between fetches triggered by tokens signed with an unknown key
+	jwksRefetchInterval = time.Minute
+	// Allowed clock difference between this server and the issuer
+	jwtLeeway = time.Minute
+)
+
+// OIDCIssuerConfig - Identity provider whose bearer JWTs clients may connect with
+type OIDCIssuerConfig struct {
+	// iss claim of the issuer's tokens, e.g. https://login.example.com
+	Issuer string `yaml:"issuer"`
+	// Where signing keys are fetched from, discovered from the issuer's openid-configuration when empty
+	JWKSURL string `yaml:"jwksUrl"`
+	// aud claim tokens must have, usually the client ID registered with the issuer
+	Audience string `yaml:"audience"`
+	// Claims mapped onto the client's identity and name, sub and name when empty
+	UserClaim string `yaml:"userClaim"`
+	NameClaim string `yaml:"nameClaim"`
+}
+
+// Validate - Checks tokens from the issuer can be verified
+func (c OIDCIssuerConfig) Validate() error {
+	urls := []string{c.Issuer}
+	if c.JWKSURL != "" {
+		urls = append(urls, c.JWKSURL)
+	}
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("%q must be an absolute http or https url", u)
+		}
+	}
+	if c.Audience == "" {
+		return fmt.Errorf("%s: audience is required", c.Issuer)
+	}
+	return nil
+}
+
+// identity - User a client proved it is with a bearer token
+type identity struct {
+	Issuer string
+	// Value of the issuer's user claim
+	Subject string
+	Name    string
+}
+
+// ID - Subject qualified by its issuer as issuer|sub, so users of different issuers
+// and user accounts on this server can never be mistaken for each other
+func (id identity) ID() string {
+	return id.Issuer + "|" + id.Subject
+}
+
+type identityKey struct{}
+
+func withIdentity(ctx context.Context, id identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+func identityFromContext(ctx context.Context) (identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(identity)
+	return id, ok
+}
+
+// jwtVerifier - Verifies bearer JWTs signed by the configured issuers
+type jwtVerifier struct {
+	issuers map[string]*oidcIssuer
+}
+
+// oidcIssuer - Issuer config and its cached signing keys
+type oidcIssuer struct {
+	config OIDCIssuerConfig
+	client *http.Client
+	// Held while fetching so concurrent connections wait for one fetch
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+func newJWTVerifier(issuers []OIDCIssuerConfig) *jwtVerifier {
+	v := &jwtVerifier{issuers: make(map[string]*oidcIssuer)}
+	for _, config := range issuers {
+		if config.UserClaim == "" {
+			config.UserClaim = "sub"
+		}
+		if config.NameClaim == "" {
+			config.NameClaim = "name"
+		}
+		v.issuers[config.Issuer] = &oidcIssuer{config: config, client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	return v
+}
+
+// jwtHeader - JOSE header of a JWT
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtAlgs - Supported signature algorithms. HMAC and none are never accepted.
+var jwtAlgs = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// jwtCurves - Curve of the keys each ECDSA algorithm must be used with
+var jwtCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(), "ES384": elliptic.P384(), "ES512": elliptic.P521(),
+}
+
+// verify - Checks token's signature and claims and returns the identity it proves
+func (v *jwtVerifier) verify(ctx context.Context, token string) (identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return identity{}, errors.New("token is not a signed JWT")
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return identity{}, fmt.Errorf("header: %v", err)
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return identity{}, fmt.Errorf("claims: %v", err)
+	}
+	iss, _ := claims["iss"].(string)
+	issuer, trusted := v.issuers[iss]
+	if !trusted {
+		return identity{}, fmt.Errorf("untrusted issuer %q", iss)
+	}
+	hash, supported := jwtAlgs[header.Alg]
+	if !supported {
+		return identity{}, fmt.Errorf("unsupported alg %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return identity{}, errors.New("signature is not base64url")
+	}
+	key, err := issuer.key(ctx, header.Kid)
+	if err != nil {
+		return identity{}, err
+	}
+	if err := verifyJWTSignature(header.Alg, hash, key, parts[0]+"."+parts[1], signature); err != nil {
+		return identity{}, err
+	}
+	if err := issuer.checkClaims(claims, time.Now()); err != nil {
+		return identity{}, err
+	}
+	subject, _ := claims[issuer.config.UserClaim].(string)
+	if subject == "" {
+		return identity{}, fmt.Errorf("missing %s claim", issuer.config.UserClaim)
+	}
+	name, _ := claims[issuer.config.NameClaim].(string)
+	return identity{Issuer: iss, Subject: subject, Name: name}, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("not base64url")
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifyJWTSignature(alg string, hash crypto.Hash, key crypto.PublicKey, signed string, signature []byte) error {
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+		case "PS":
+			return rsa.VerifyPSS(key, hash, digest, signature, nil)
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if key.Curve != jwtCurves[alg] || len(signature) != 2*size {
+			break
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("key can't verify %s signatures", alg)
+}
+
+// checkClaims - Checks the token is meant for this server and hasn't expired
+func (i *oidcIssuer) checkClaims(claims map[string]interface{}, now time.Time) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("missing exp claim")
+	}
+	if now.Add(-jwtLeeway).After(time.Unix(int64(exp), 0)) {
+		return errors.New("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token is not valid yet")
+	}
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud == i.config.Audience {
+			return nil
+		}
+	case []interface{}:
+		for _, a := range aud {
+			if a == i.config.Audience {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("token is not for audience %q", i.config.Audience)
+}
+
+// key - Signing key with ID kid, fetching the issuer's keys when they are stale or kid is new
+func (i *oidcIssuer) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	key, known := i.keys[kid]
+	stale := time.Since(i.fetchedAt) > jwksCacheTTL
+	if stale || (!known && time.Since(i.fetchedAt) > jwksRefetchInterval) {
+		keys, err := i.fetchKeys(ctx)
+		// Keep using the cached keys if the issuer can't be reached
+		if err != nil && i.keys == nil {
+			return nil, fmt.Errorf("fetching keys of %s: %v", i.config.Issuer, err)
+		}
+		if err == nil {
+			i.keys = keys
+			i.fetchedAt = time.Now()
+		}
+		key, known = i.keys[kid]
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// fetchKeys - Downloads the issuer's JWKS, discovering where it is first if it isn't configured
+func (i *oidcIssuer) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	jwksURL := i.config.JWKSURL
+	if jwksURL == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := i.getJSON(ctx, strings.TrimSuffix(i.config.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, err
+		}
+		if discovery.Issuer != i.config.Issuer || discovery.JWKSURI == "" {
+			return nil, fmt.Errorf("openid-configuration is for issuer %q", discovery.Issuer)
+		}
+		jwksURL = discovery.JWKSURI
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := i.getJSON(ctx, jwksURL, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// Keys of unsupported types are skipped so the issuer can add them without breaking us
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (i *oidcIssuer) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	res, err := i.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded %s", u, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// jsonWebKey - Public key from a JWKS
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA modulus and exponent
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC curve and point
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid exponent")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < 2048 {
+			return nil, errors.New("rsa keys must be at least 2048 bits")
+		}
+		return key, nil
+	case "EC":
+		var curve elliptic.Curve
+		var ecdhCurve ecdh.Curve
+		switch k.Crv {
+		case "P-256":
+			curve, ecdhCurve = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, ecdhCurve = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, ecdhCurve = elliptic.P521(), ecdh.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		size := (curve.Params().BitSize + 7) / 8
+		if errX != nil || errY != nil || len(x) != size || len(y) != size {
+			return nil, errors.New("invalid point")
+		}
+		// Parsing the uncompressed point checks it is on the curve
+		if _, err := ecdhCurve.NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// bearerToken - Token from the Authorization header, or the access_token query parameter
+// as browsers can't set headers on websockets and event streams
+func bearerToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// authenticateConnection - Verifies the bearer token a client connects with, adding the identity it
+// proves to the request context, and refuses clients without one when anonymous access is off
+func (a *App) authenticateConnection(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" || a.jwt == nil {
+			if !a.Config.AllowAnonymous {
+				a.refuseUnauthenticated(w, r, errors.New("missing bearer token"))
+				return
+			}
+			next(w, r)
+			return
+		}
+		id, err := a.jwt.verify(r.Context(), token)
+		if err != nil {
+			a.refuseUnauthenticated(w, r, err)
+			return
+		}
+		next(w, r.WithContext(withIdentity(r.Context(), id)))
+	}
+}
+
+func (a *App) refuseUnauthenticated(w http.ResponseWriter, r *http.Request, err error) {
+	a.metrics.authFailures.Inc()
+	a.logger.Warn("Connection not authenticated", "remoteAddr", r.RemoteAddr, "err", err)
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
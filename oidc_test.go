@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testIssuer - In process OIDC issuer serving its openid-configuration and JWKS
+type testIssuer struct {
+	server *httptest.Server
+	mu     sync.Mutex
+	keys   map[string]*ecdsa.PrivateKey
+	// Number of times the JWKS was fetched
+	fetches int
+}
+
+func StartTestIssuer(t *testing.T) *testIssuer {
+	issuer := &testIssuer{keys: map[string]*ecdsa.PrivateKey{}}
+	issuer.addKey("key-1")
+	issuer.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.server.URL, "jwks_uri": issuer.server.URL + "/jwks"})
+		case "/jwks":
+			issuer.mu.Lock()
+			defer issuer.mu.Unlock()
+			issuer.fetches++
+			keys := []jsonWebKey{}
+			for kid, key := range issuer.keys {
+				keys = append(keys, jsonWebKey{
+					Kty: "EC",
+					Kid: kid,
+					Use: "sig",
+					Crv: "P-256",
+					X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+					Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+				})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+func (i *testIssuer) addKey(kid string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	i.mu.Lock()
+	i.keys[kid] = key
+	i.mu.Unlock()
+}
+
+func (i *testIssuer) fetchCount() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.fetches
+}
+
+// token - ES256 JWT for the qrsync audience signed with key kid, with claims overriding the defaults
+func (i *testIssuer) token(kid string, claims map[string]interface{}) string {
+	payload := map[string]interface{}{
+		"iss":  i.server.URL,
+		"aud":  "qrsync",
+		"sub":  "user-42",
+		"name": "Ada Lovelace",
+		"exp":  time.Now().Add(time.Hour).Unix(),
+	}
+	for claim, value := range claims {
+		payload[claim] = value
+	}
+	i.mu.Lock()
+	key := i.keys[kid]
+	i.mu.Unlock()
+	signed := encodeJWTPart(map[string]string{"alg": "ES256", "kid": kid, "typ": "JWT"}) + "." + encodeJWTPart(payload)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, _ := ecdsa.Sign(rand.Reader, key, digest[:])
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func encodeJWTPart(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// trustedBy - Config option accepting bearer tokens from the issuer
+func (i *testIssuer) trustedBy(config *Config) {
+	config.OIDCIssuers = []OIDCIssuerConfig{{Issuer: i.server.URL, Audience: "qrsync"}}
+}
+
+func Test_clients_connecting_with_a_bearer_token_are_the_user_it_identifies(t *testing.T) {
+	issuer := StartTestIssuer(t)
+	_, wsUrl := SetupWsServer(t, issuer.trustedBy)
+
+	ws, connectMsg := ConnectClient(t, wsUrl+"?access_token="+issuer.token("key-1", nil))
+	defer CloseWithCloseMessage(ws)
+	if connectMsg.Identity != issuer.server.URL+"|user-42" || connectMsg.Client.Name != "Ada Lovelace" {
+		t.Fatalf("Expected claims to be mapped onto the client but got %v", connectMsg)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsUrl, http.Header{"Authorization": {"Bearer " + issuer.token("key-1", map[string]interface{}{"sub": "user-7"})}})
+	if err != nil {
+		t.Fatalf("Expected token in header to be accepted but got %v", err)
+	}
+	defer CloseWithCloseMessage(ws)
+	ws.ReadJSON(&connectMsg)
+	if connectMsg.Identity != issuer.server.URL+"|user-7" {
+		t.Fatalf("Expected user from header token but got %v", connectMsg)
+	}
+
+	// Anonymous clients can still connect unless that is turned off
+	ws, connectMsg = ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+	if connectMsg.Identity != "" {
+		t.Fatalf("Expected anonymous client but got %v", connectMsg)
+	}
+}
+
+func Test_invalid_bearer_tokens_are_refused(t *testing.T) {
+	issuer := StartTestIssuer(t)
+	_, wsUrl := SetupWsServer(t, issuer.trustedBy, func(config *Config) { config.AllowAnonymous = false })
+	otherIssuer := StartTestIssuer(t)
+	valid := issuer.token("key-1", nil)
+	parts := strings.Split(valid, ".")
+
+	for name, token := range map[string]string{
+		"missing":        "",
+		"expired":        issuer.token("key-1", map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}),
+		"wrong audience": issuer.token("key-1", map[string]interface{}{"aud": []string{"someone-else"}}),
+		"untrusted":      otherIssuer.token("key-1", map[string]interface{}{"iss": issuer.server.URL}),
+		"unsigned":       encodeJWTPart(map[string]string{"alg": "none"}) + "." + parts[1] + ".",
+		"tampered":       parts[0] + "." + encodeJWTPart(map[string]interface{}{"iss": issuer.server.URL, "aud": "qrsync", "sub": "admin", "exp": time.Now().Add(time.Hour).Unix()}) + "." + parts[2],
+		"garbage":        "not-a-jwt",
+	} {
+		_, res, err := websocket.DefaultDialer.Dial(wsUrl+"?access_token="+token, nil)
+		if err == nil || res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Expected %s token to be refused but got %v", name, err)
+		}
+	}
+	ws, _ := ConnectClient(t, wsUrl+"?access_token="+valid)
+	CloseWithCloseMessage(ws)
+}
+
+func Test_signing_keys_are_fetched_again_when_the_issuer_rotates_them(t *testing.T) {
+	issuer := StartTestIssuer(t)
+	verifier := newJWTVerifier([]OIDCIssuerConfig{{Issuer: issuer.server.URL, Audience: "qrsync"}})
+	if _, err := verifier.verify(context.Background(), issuer.token("key-1", nil)); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	verifier.verify(context.Background(), issuer.token("key-1", nil))
+	if issuer.fetchCount() != 1 {
+		t.Fatalf("Expected keys to be cached but were fetched %d times", issuer.fetchCount())
+	}
+
+	issuer.addKey("key-2")
+	verifier.issuers[issuer.server.URL].fetchedAt = time.Now().Add(-2 * jwksRefetchInterval)
+	id, err := verifier.verify(context.Background(), issuer.token("key-2", nil))
+	if err != nil || id.Subject != "user-42" || issuer.fetchCount() != 2 {
+		t.Fatalf("Expected new key to be fetched but got %v %v", id, err)
+	}
+	// Tokens signed with unknown keys don't make every connection fetch the keys again
+	forger := StartTestIssuer(t)
+	forger.addKey("key-3")
+	if _, err := verifier.verify(context.Background(), forger.token("key-3", map[string]interface{}{"iss": issuer.server.URL})); err == nil || issuer.fetchCount() != 2 {
+		t.Fatalf("Expected unknown key to be refused without fetching keys again but got %v", err)
+	}
+}
+
+func Test_rsa_signed_tokens_are_verified(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{{
+			Kty: "RSA",
+			Kid: "rsa",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString([]byte{1, 0, 1}),
+		}}})
+	}))
+	defer jwks.Close()
+	verifier := newJWTVerifier([]OIDCIssuerConfig{{Issuer: "https://sso.example.com", JWKSURL: jwks.URL, Audience: "qrsync", UserClaim: "email"}})
+
+	signed := encodeJWTPart(map[string]string{"alg": "RS256", "kid": "rsa"}) + "." + encodeJWTPart(map[string]interface{}{
+		"iss":   "https://sso.example.com",
+		"aud":   "qrsync",
+		"email": "ada@example.com",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+	digest := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	id, err := verifier.verify(context.Background(), signed+"."+base64.RawURLEncoding.EncodeToString(signature))
+	if err != nil || id.ID() != "https://sso.example.com|ada@example.com" {
+		t.Fatalf("Expected email claim to be the subject but got %v %v", id, err)
+	}
+}
+
+func Test_ecdsa_keys_must_be_on_the_curve_of_the_alg(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	signed := "header.claims"
+	digest := sha256.Sum256([]byte(signed))
+	r, s, _ := ecdsa.Sign(rand.Reader, key, digest[:])
+	signature := append(r.FillBytes(make([]byte, 48)), s.FillBytes(make([]byte, 48))...)
+	if err := verifyJWTSignature("ES256", crypto.SHA256, &key.PublicKey, signed, signature); err == nil {
+		t.Fatalf("Expected ES256 signature from a P-384 key to be refused")
+	}
+}
+
+func Test_bearer_identity_is_kept_apart_from_accounts(t *testing.T) {
+	issuer := StartTestIssuer(t)
+	app := &App{}
+	_, wsUrl := StartTestApp(t, app, issuer.trustedBy, func(config *Config) { config.AccountsBackend = "memory" })
+	app.accounts.hashCost = bcrypt.MinCost
+
+	ws, _ := ConnectClient(t, wsUrl)
+	ws.WriteJSON(RegisterMsg{Type: "Register", Username: "ada", Password: "correct horse"})
+	var linkedMsg DeviceLinkedMsg
+	ws.ReadJSON(&linkedMsg)
+	CloseWithCloseMessage(ws)
+
+	// A token whose subject is an account's user ID doesn't sign the client in to that account
+	ws, connectMsg := ConnectClient(t, wsUrl+"?access_token="+issuer.token("key-1", map[string]interface{}{"sub": linkedMsg.UserID}))
+	CloseWithCloseMessage(ws)
+	if connectMsg.UserID != "" || connectMsg.Identity != issuer.server.URL+"|"+linkedMsg.UserID {
+		t.Fatalf("Expected only the bearer identity to be set but got %v", connectMsg)
+	}
+
+	// Signing in a linked device keeps the identity of the bearer token
+	ws, connectMsg = ConnectClient(t, wsUrl+"?deviceToken="+linkedMsg.DeviceToken+"&access_token="+issuer.token("key-1", nil))
+	CloseWithCloseMessage(ws)
+	if connectMsg.UserID != linkedMsg.UserID || connectMsg.Identity != issuer.server.URL+"|user-42" {
+		t.Fatalf("Expected both the account and bearer identity to be set but got %v", connectMsg)
+	}
+}
+
+func Test_config_requires_an_issuer_to_disable_anonymous_access(t *testing.T) {
+	getenv := func(string) string { return "" }
+	if _, err := LoadConfig([]string{"-allow-anonymous=false"}, getenv); err == nil {
+		t.Fatalf("Expected error when no issuer is configured")
+	}
+	config, err := LoadConfig([]string{"-allow-anonymous=false", "-oidc-issuer", "https://sso.example.com", "-oidc-audience", "qrsync"}, getenv)
+	if err != nil || config.AllowAnonymous || config.OIDCIssuers[0].Audience != "qrsync" {
+		t.Fatalf("Expected single issuer from flags but got %v %v", config, err)
+	}
+}
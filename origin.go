@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// originPolicy - Browser origins allowed to use the API and open websockets.
+// Patterns are "*", an exact origin such as https://app.example.com or a wildcard
+// subdomain such as https://*.example.com, which doesn't match example.com itself.
+type originPolicy struct {
+	any   bool
+	exact map[string]bool
+	// Scheme and host suffix, including any port, of each wildcard pattern
+	wildcards [][2]string
+	// Allows any localhost origin for local development
+	allowLocalhost bool
+}
+
+func newOriginPolicy(patterns []string, allowLocalhost bool) (*originPolicy, error) {
+	p := &originPolicy{exact: make(map[string]bool), allowLocalhost: allowLocalhost}
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			p.any = true
+			continue
+		}
+		scheme, host, err := splitOrigin(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if suffix, wildcard := strings.CutPrefix(host, "*."); wildcard {
+			p.wildcards = append(p.wildcards, [2]string{scheme, "." + suffix})
+		} else {
+			p.exact[scheme+"://"+host] = true
+		}
+	}
+	return p, nil
+}
+
+// splitOrigin - Lower case scheme and host, with port, of an origin
+func splitOrigin(origin string) (string, string, error) {
+	u, err := url.Parse(strings.ToLower(strings.TrimSuffix(origin, "/")))
+	if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return "", "", fmt.Errorf("invalid origin %q", origin)
+	}
+	return u.Scheme, u.Host, nil
+}
+
+func (p *originPolicy) allows(origin string) bool {
+	if p.any {
+		return true
+	}
+	scheme, host, err := splitOrigin(origin)
+	if err != nil {
+		return false
+	}
+	if p.exact[scheme+"://"+host] {
+		return true
+	}
+	for _, wildcard := range p.wildcards {
+		if scheme == wildcard[0] && len(host) > len(wildcard[1]) && strings.HasSuffix(host, wildcard[1]) {
+			return true
+		}
+	}
+	if p.allowLocalhost {
+		hostname := host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			hostname = h
+		}
+		hostname = strings.Trim(hostname, "[]")
+		return hostname == "localhost" || hostname == "127.0.0.1" || hostname == "::1"
+	}
+	return false
+}
+
+// originAllowed - Whether a request may be served. Requests without an Origin header
+// don't come from a browser script and pages served by this host are always allowed.
+func (a *App) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if _, host, err := splitOrigin(origin); err == nil && host == strings.ToLower(r.Host) {
+		return true
+	}
+	return a.origins.allows(origin)
+}
+
+// refuseOrigins - Rejects requests from browser origins that aren't allowed before CORS headers are added
+func (a *App) refuseOrigins(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.originAllowed(r) {
+			a.metrics.originRejections.Inc()
+			a.logger.Warn("Origin not allowed", "origin", r.Header.Get("Origin"), "path", r.URL.Path, "remoteAddr", r.RemoteAddr)
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func Test_origin_policy_matches_exact_and_wildcard_origins(t *testing.T) {
+	policy, err := newOriginPolicy([]string{"https://app.example.com", "https://*.qrsync.io"}, false)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	for origin, expected := range map[string]bool{
+		"https://app.example.com":      true,
+		"https://APP.example.com/":     true,
+		"http://app.example.com":       false,
+		"https://evil.example.com":     false,
+		"https://web.qrsync.io":        true,
+		"https://a.b.qrsync.io":        true,
+		"https://qrsync.io":            false,
+		"https://evilqrsync.io":        false,
+		"http://localhost:3000":        false,
+		"https://web.qrsync.io.evil.a": false,
+	} {
+		if policy.allows(origin) != expected {
+			t.Fatalf("Expected %s allowed to be %v", origin, expected)
+		}
+	}
+
+	devPolicy, _ := newOriginPolicy(nil, true)
+	for _, origin := range []string{"http://localhost:3000", "http://127.0.0.1:8080", "http://[::1]:3000", "http://localhost"} {
+		if !devPolicy.allows(origin) {
+			t.Fatalf("Expected dev mode to allow %s", origin)
+		}
+	}
+	if devPolicy.allows("http://localhost.evil.com") {
+		t.Fatalf("Expected dev mode to only allow localhost")
+	}
+}
+
+func Test_config_rejects_invalid_origins(t *testing.T) {
+	_, err := LoadConfig([]string{"-cors-origins", "example.com"}, func(string) string { return "" })
+	if err == nil {
+		t.Fatalf("Expected error for origin without scheme")
+	}
+}
+
+func Test_websockets_and_requests_from_other_origins_are_refused(t *testing.T) {
+	config := DefaultConfig()
+	config.CORSOrigins = []string{"https://app.example.com"}
+	app := App{Config: config}
+	app.Init()
+	testServer := httptest.NewServer(app.MainHandler())
+	defer testServer.Close()
+	wsUrl := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/api/v1/ws"
+
+	_, res, err := websocket.DefaultDialer.Dial(wsUrl, http.Header{"Origin": {"https://evil.example.com"}})
+	if err == nil || res.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected websocket from other origin to be refused but got %v", err)
+	}
+	ws, _, err := websocket.DefaultDialer.Dial(wsUrl, http.Header{"Origin": {"https://app.example.com"}})
+	if err != nil {
+		t.Fatalf("Expected websocket from allowed origin to connect but got %v", err)
+	}
+	CloseWithCloseMessage(ws)
+	ws, _, err = websocket.DefaultDialer.Dial(wsUrl, http.Header{"Origin": {testServer.URL}})
+	if err != nil {
+		t.Fatalf("Expected websocket from page served by the server to connect but got %v", err)
+	}
+	CloseWithCloseMessage(ws)
+
+	req, _ := http.NewRequest(http.MethodOptions, testServer.URL+"/api/v1/messages", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil || res.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Fatalf("Expected CORS headers for allowed origin but got %v", res.Header)
+	}
+	req.Header.Set("Origin", "https://evil.example.com")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil || res.StatusCode != http.StatusForbidden || res.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("Expected preflight from other origin to be refused but got %v", res.Status)
+	}
+}
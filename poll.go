@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// How long a poll waits for a message when the client doesn't give a timeout
+const defaultPollTimeout = 25 * time.Second
+
+// Longest a single poll may wait, kept under common proxy idle timeouts
+const maxPollTimeout = 55 * time.Second
+
+// How long a polling client can go without polling before it is disconnected
+const pollExpiry = 2 * maxPollTimeout
+
+// PollResponse - Response body of the long-polling endpoints.
+// Cursor is passed back on the next poll to acknowledge every message up to and including it.
+type PollResponse struct {
+	Messages []json.RawMessage `json:"messages"`
+	Cursor   int64             `json:"cursor"`
+}
+
+// pendingMsg - Encoded message a polling client hasn't acknowledged yet
+type pendingMsg struct {
+	cursor   int64
+	msgBytes []byte
+}
+
+// pollTransport - Transport for clients that can only make plain http requests.
+// Messages are held until the client acknowledges them with a later poll, so a poll
+// lost on the network is resent rather than dropped.
+type pollTransport struct {
+	metrics *appMetrics
+	tracer  trace.Tracer
+	mu      sync.Mutex
+	pending []pendingMsg
+	// Cursor of the most recently queued message
+	cursor int64
+	// Closed and replaced whenever a message is queued or the transport closes
+	notify   chan struct{}
+	polling  int
+	lastPoll time.Time
+	closed   bool
+	// Closed once the transport is closed and the client has acknowledged every message
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func newPollTransport(metrics *appMetrics, tracer trace.Tracer) *pollTransport {
+	return &pollTransport{
+		metrics:  metrics,
+		tracer:   tracer,
+		notify:   make(chan struct{}),
+		lastPoll: time.Now(),
+		done:     make(chan struct{}),
+	}
+}
+
+func (p *pollTransport) Send(ctx context.Context, v interface{}) error {
+	ctx, span := p.tracer.Start(ctx, "write")
+	defer span.End()
+	msgBytes, err := encodeOutbound(ctx, span, p.metrics, v)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errConnClosed
+	}
+	if len(p.pending) >= sendQueueLength {
+		p.metrics.droppedMessages.WithLabelValues("queue_full").Inc()
+		return errSendQueueFull
+	}
+	p.cursor++
+	p.pending = append(p.pending, pendingMsg{cursor: p.cursor, msgBytes: msgBytes})
+	p.wake()
+	return nil
+}
+
+func (p *pollTransport) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		p.wake()
+		p.finishIfAcked()
+	}
+	return nil
+}
+
+// CloseWithReason - Polling has no close frame, clients find out from the messages sent before closing
+func (p *pollTransport) CloseWithReason(code int, text string) error {
+	return p.Close()
+}
+
+func (p *pollTransport) Done() <-chan struct{} {
+	return p.done
+}
+
+// poll - Acknowledges messages up to ackCursor then returns the rest,
+// waiting up to timeout for one to be queued if there are none
+func (p *pollTransport) poll(ctx context.Context, ackCursor int64, timeout time.Duration) (PollResponse, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	p.mu.Lock()
+	p.polling++
+	defer func() {
+		p.polling--
+		p.lastPoll = time.Now()
+		p.mu.Unlock()
+	}()
+	p.ack(ackCursor)
+	for {
+		if len(p.pending) > 0 {
+			res := PollResponse{Cursor: p.pending[len(p.pending)-1].cursor}
+			for _, pending := range p.pending {
+				res.Messages = append(res.Messages, pending.msgBytes)
+			}
+			return res, nil
+		}
+		if p.closed {
+			return PollResponse{}, errConnClosed
+		}
+		notify := p.notify
+		p.mu.Unlock()
+		select {
+		case <-notify:
+			p.mu.Lock()
+		case <-timer.C:
+			p.mu.Lock()
+			return PollResponse{Messages: []json.RawMessage{}, Cursor: p.cursor}, nil
+		case <-ctx.Done():
+			p.mu.Lock()
+			return PollResponse{}, ctx.Err()
+		}
+	}
+}
+
+// expired - Client hasn't polled for longer than pollExpiry
+func (p *pollTransport) expired() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.polling == 0 && time.Since(p.lastPoll) > pollExpiry
+}
+
+// discard - Drops unacknowledged messages so the transport finishes closing
+func (p *pollTransport) discard() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.pending = nil
+	p.wake()
+	p.finishIfAcked()
+}
+
+// ack - Drops messages the client has received. Caller must hold p.mu.
+func (p *pollTransport) ack(ackCursor int64) {
+	acked := 0
+	for acked < len(p.pending) && p.pending[acked].cursor <= ackCursor {
+		acked++
+	}
+	p.pending = p.pending[acked:]
+	p.finishIfAcked()
+}
+
+// wake - Wakes any waiting poll. Caller must hold p.mu.
+func (p *pollTransport) wake() {
+	close(p.notify)
+	p.notify = make(chan struct{})
+}
+
+// finishIfAcked - Marks the transport done once closed with nothing left to deliver. Caller must hold p.mu.
+func (p *pollTransport) finishIfAcked() {
+	if p.closed && len(p.pending) == 0 {
+		p.doneOnce.Do(func() { close(p.done) })
+	}
+}
+
+// pollConnect - Registers a long-polling client. The response holds the ClientConnect message
+// with the transportToken used to authorize later polls and posted messages.
+func (a *App) pollConnect(w http.ResponseWriter, r *http.Request) {
+	a.logger.Info("Polling client connecting", "remoteAddr", r.RemoteAddr)
+	if a.draining.Load() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if a.refuseConnection(w, r) {
+		return
+	}
+	ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, connectSpan := a.tracer.Start(ctx, "poll.connect")
+	transport := newPollTransport(a.metrics, a.tracer)
+	client := a.connectClient(ctx, r, transport)
+	connectSpan.SetAttributes(attribute.String("qrsync.client_id", client.ID))
+	connectSpan.End()
+	logger := a.logger.With("clientId", client.ID, "remoteAddr", r.RemoteAddr, "transport", "poll")
+	logger.Info("Client connected")
+	// The request context ends with this response, the client stays connected until it stops polling
+	go a.expirePollClient(context.WithoutCancel(ctx), logger, client.ID, transport)
+
+	res, _ := transport.poll(r.Context(), 0, 0)
+	writePollResponse(w, res)
+}
+
+// poll - Returns messages queued for a long-polling client, waiting for one if there are none.
+// The cursor query parameter acknowledges messages from earlier polls.
+func (a *App) poll(w http.ResponseWriter, r *http.Request) {
+	client, ok := a.authorizeTransport(w, r)
+	if !ok {
+		return
+	}
+	transport, polling := client.transport.(*pollTransport)
+	if !polling {
+		http.Error(w, "Client is not using long polling", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	cursor, err := strconv.ParseInt(query.Get("cursor"), 10, 64)
+	if err != nil && query.Has("cursor") {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+	timeout := defaultPollTimeout
+	if query.Has("timeout") {
+		seconds, err := strconv.Atoi(query.Get("timeout"))
+		if err != nil || seconds < 0 {
+			http.Error(w, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = min(time.Duration(seconds)*time.Second, maxPollTimeout)
+	}
+
+	res, err := transport.poll(r.Context(), cursor, timeout)
+	if err == errConnClosed {
+		http.Error(w, "Client disconnected", http.StatusGone)
+		return
+	}
+	if err != nil {
+		// Client went away mid poll, unacknowledged messages are returned by the next one
+		return
+	}
+	writePollResponse(w, res)
+}
+
+// expirePollClient - Disconnects a polling client once it stops polling
+func (a *App) expirePollClient(ctx context.Context, logger *slog.Logger, clientID string, transport *pollTransport) {
+	ticker := time.NewTicker(pollExpiry / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-transport.Done():
+			a.disconnectClient(ctx, logger, clientID)
+			return
+		case <-ticker.C:
+			if transport.expired() {
+				logger.Info("Client stopped polling")
+				a.disconnectClient(ctx, logger, clientID)
+				transport.discard()
+				return
+			}
+		}
+	}
+}
+
+func writePollResponse(w http.ResponseWriter, res PollResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(res)
+}
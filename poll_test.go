@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// Poll - Long polls for a client, acknowledging messages up to cursor
+func Poll(t *testing.T, serverUrl string, connectMsg ClientConnectMsg, cursor int64, timeoutSeconds int) (*http.Response, PollResponse) {
+	url := fmt.Sprintf("%s/api/v1/poll?clientId=%s&cursor=%d&timeout=%d", serverUrl, connectMsg.Client.ID, cursor, timeoutSeconds)
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Authorization", "Bearer "+connectMsg.TransportToken)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to poll %v", err)
+	}
+	defer res.Body.Close()
+	var pollRes PollResponse
+	json.NewDecoder(res.Body).Decode(&pollRes)
+	return res, pollRes
+}
+
+func Test_polling_client_can_join_websocket_session(t *testing.T) {
+	testServer, wsUrl := SetupWsServer(t)
+	defer testServer.Close()
+
+	ws, client1ConnectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+
+	res, err := http.Post(testServer.URL+"/api/v1/poll/connect", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect polling client %v", err)
+	}
+	var connectRes PollResponse
+	json.NewDecoder(res.Body).Decode(&connectRes)
+	res.Body.Close()
+	if len(connectRes.Messages) != 1 {
+		t.Fatalf("Expected ClientConnect in connect response but got %v", connectRes)
+	}
+	var client2ConnectMsg ClientConnectMsg
+	json.Unmarshal(connectRes.Messages[0], &client2ConnectMsg)
+	if client2ConnectMsg.Type != "ClientConnect" || client2ConnectMsg.TransportToken == "" {
+		t.Fatalf("Expected ClientConnect with transport token but got %v", client2ConnectMsg)
+	}
+
+	// Nothing queued, so the poll waits for the timeout
+	_, emptyRes := Poll(t, testServer.URL, client2ConnectMsg, connectRes.Cursor, 0)
+	if len(emptyRes.Messages) != 0 || emptyRes.Cursor != connectRes.Cursor {
+		t.Fatalf("Expected empty poll at cursor %d but got %v", connectRes.Cursor, emptyRes)
+	}
+
+	PostMessage(t, testServer.URL, client2ConnectMsg, CreateSessionMsg{Type: "CreateSession"})
+	_, joinRes := Poll(t, testServer.URL, client2ConnectMsg, connectRes.Cursor, 5)
+	var client2AddedToSessionMsg ClientJoinedSessionMsg
+	json.Unmarshal(joinRes.Messages[0], &client2AddedToSessionMsg)
+	PostMessage(t, testServer.URL, client2ConnectMsg, AddClientToSessionMsg{
+		Type:        "AddClientToSession",
+		SessionID:   client2AddedToSessionMsg.SessionID,
+		AddClientID: client1ConnectMsg.Client.ID,
+	})
+	var joinMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&joinMsg)
+
+	// Without acknowledging the join message it is sent again along with the new one
+	_, unackedRes := Poll(t, testServer.URL, client2ConnectMsg, connectRes.Cursor, 5)
+	if len(unackedRes.Messages) != 2 {
+		t.Fatalf("Expected unacknowledged message to be resent but got %d messages", len(unackedRes.Messages))
+	}
+
+	ws.WriteJSON(BroadcastToSessionMsg{Type: "BroadcastToSession", Payload: "from websocket"})
+	_, broadcastRes := Poll(t, testServer.URL, client2ConnectMsg, unackedRes.Cursor, 5)
+	if len(broadcastRes.Messages) != 1 {
+		t.Fatalf("Expected only the broadcast after acknowledging but got %d messages", len(broadcastRes.Messages))
+	}
+	var broadcastMsg BroadcastFromSessionMsg
+	json.Unmarshal(broadcastRes.Messages[0], &broadcastMsg)
+	if broadcastMsg.Payload != "from websocket" || broadcastMsg.SenderID != client1ConnectMsg.Client.ID {
+		t.Fatalf("Expected broadcast from websocket client but got %v", broadcastMsg)
+	}
+}
+
+func Test_poll_needs_transport_token(t *testing.T) {
+	testServer, wsUrl := SetupWsServer(t)
+	defer testServer.Close()
+
+	ws, connectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+	res, _ := Poll(t, testServer.URL, connectMsg, 0, 0)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected websocket client to be refused but got %d", res.StatusCode)
+	}
+	connectMsg.TransportToken = "wrong"
+	res, _ = Poll(t, testServer.URL, connectMsg, 0, 0)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected unauthorized but got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Longest user agent kept for a client, browsers can send much longer headers
+const maxUserAgentLength = 512
+
+// DeviceType - Kind of device a client runs on, so members can tell a phone from a laptop
+type DeviceType string
+
+// Kinds of device clients can report
+const (
+	DeviceTypePhone   DeviceType = "phone"
+	DeviceTypeTablet  DeviceType = "tablet"
+	DeviceTypeLaptop  DeviceType = "laptop"
+	DeviceTypeDesktop DeviceType = "desktop"
+	DeviceTypeTV      DeviceType = "tv"
+	DeviceTypeOther   DeviceType = "other"
+)
+
+// All device types, used to generate the typescript enum
+var allDeviceTypes = []struct {
+	Value  DeviceType
+	TSName string
+}{
+	{DeviceTypePhone, "Phone"},
+	{DeviceTypeTablet, "Tablet"},
+	{DeviceTypeLaptop, "Laptop"},
+	{DeviceTypeDesktop, "Desktop"},
+	{DeviceTypeTV, "TV"},
+	{DeviceTypeOther, "Other"},
+}
+
+// PresenceStatus - Whether the person using a client is there, as reported by the client
+type PresenceStatus string
+
+// Presence statuses clients can report
+const (
+	PresenceActive PresenceStatus = "active"
+	PresenceIdle   PresenceStatus = "idle"
+	PresenceAway   PresenceStatus = "away"
+)
+
+// All presence statuses, used to generate the typescript enum
+var allPresenceStatuses = []struct {
+	Value  PresenceStatus
+	TSName string
+}{
+	{PresenceActive, "Active"},
+	{PresenceIdle, "Idle"},
+	{PresenceAway, "Away"},
+}
+
+// recordActivity - Notes that client just sent a message. Caller must hold a.mu.
+func (a *App) recordActivity(client Client) Client {
+	client.LastActivity = time.Now()
+	a.ClientMap[client.ID] = client
+	return client
+}
+
+// setPresence - Changes the presence of client and tells its session members. Caller must hold a.mu.
+func (a *App) setPresence(ctx context.Context, client Client, presence PresenceStatus) Client {
+	if presence == "" || presence == client.Presence {
+		return client
+	}
+	client.Presence = presence
+	client.PresenceSince = time.Now()
+	a.ClientMap[client.ID] = client
+	a.sendToPeers(ctx, client, PresenceChangedMsg{
+		Type:          "PresenceChanged",
+		ClientID:      client.ID,
+		Presence:      client.Presence,
+		PresenceSince: client.PresenceSince,
+		LastActivity:  client.LastActivity,
+	})
+	return client
+}
+
+// truncate - s cut to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n], "")
+}
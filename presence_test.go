@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ReadUntilQuiet - Types of the messages ws receives until none arrive for wait
+func ReadUntilQuiet(ws *websocket.Conn, wait time.Duration) []string {
+	msgTypes := []string{}
+	for {
+		ws.SetReadDeadline(time.Now().Add(wait))
+		var msg struct {
+			Type string `json:"type"`
+		}
+		if err := ws.ReadJSON(&msg); err != nil {
+			return msgTypes
+		}
+		msgTypes = append(msgTypes, msg.Type)
+	}
+}
+
+func Test_presence_changes_are_only_sent_to_session_members(t *testing.T) {
+	testServer, wsUrl := SetupWsServer(t)
+	defer testServer.Close()
+	phone, phoneConnectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(phone)
+	laptop, laptopConnectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(laptop)
+	outsider, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(outsider)
+	if phoneConnectMsg.Client.Presence != PresenceActive || phoneConnectMsg.Client.UserAgent == "" {
+		t.Fatalf("Expected new client to be active with its user agent but got %v", phoneConnectMsg.Client)
+	}
+
+	phone.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var joinMsg ClientJoinedSessionMsg
+	phone.ReadJSON(&joinMsg)
+	phone.WriteJSON(AddClientToSessionMsg{Type: "AddClientToSession", SessionID: joinMsg.SessionID, AddClientID: laptopConnectMsg.Client.ID})
+	phone.ReadJSON(&joinMsg)
+	laptop.ReadJSON(&joinMsg)
+
+	name := "Phone"
+	phone.WriteJSON(UpdateClientMsg{
+		Type:       "UpdateClient",
+		Name:       &name,
+		DeviceType: DeviceTypePhone,
+		Platform:   "ios",
+		AppVersion: "2.1.0",
+		Presence:   PresenceIdle,
+	})
+	var updatedMsg ClientUpdatedMsg
+	laptop.ReadJSON(&updatedMsg)
+	if updatedMsg.DeviceType != DeviceTypePhone {
+		t.Fatalf("Expected laptop to see phone's device type but got %v", updatedMsg)
+	}
+	var presenceMsg PresenceChangedMsg
+	laptop.ReadJSON(&presenceMsg)
+	if presenceMsg.Type != "PresenceChanged" || presenceMsg.ClientID != phoneConnectMsg.Client.ID || presenceMsg.Presence != PresenceIdle {
+		t.Fatalf("Expected laptop to see phone go idle but got %v", presenceMsg)
+	}
+	if msgTypes := ReadUntilQuiet(outsider, 200*time.Millisecond); len(msgTypes) > 0 {
+		t.Fatalf("Expected client outside the session not to be sent anything but got %v", msgTypes)
+	}
+
+	// Clients joining later see the device details and presence of existing members
+	tablet, tabletConnectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(tablet)
+	phone.WriteJSON(AddClientToSessionMsg{Type: "AddClientToSession", SessionID: joinMsg.SessionID, AddClientID: tabletConnectMsg.Client.ID})
+	tablet.ReadJSON(&joinMsg)
+	phoneClient := joinMsg.ClientMap[phoneConnectMsg.Client.ID]
+	if phoneClient.DeviceType != DeviceTypePhone || phoneClient.Platform != "ios" || phoneClient.AppVersion != "2.1.0" || phoneClient.Presence != PresenceIdle {
+		t.Fatalf("Expected phone's device details in session but got %v", phoneClient)
+	}
+	if !phoneClient.LastActivity.After(phoneConnectMsg.Client.LastActivity) {
+		t.Fatalf("Expected last activity to be updated by messages")
+	}
+
+	tablet.WriteMessage(websocket.TextMessage, []byte(`{"type":"UpdateClient","name":"Tablet","deviceType":"toaster"}`))
+	var errMsg ErrorMsg
+	tablet.ReadJSON(&errMsg)
+	if errMsg.Code != errInvalidMessage {
+		t.Fatalf("Expected unknown device type to be rejected but got %v", errMsg)
+	}
+}
@@ -2,7 +2,7 @@
 git reset --hard
 git pull
 chmod a+x ./redeploy.sh
-docker build -t qrsync_server .
+docker build --build-arg GIT_SHA=$(git rev-parse HEAD) -t qrsync_server .
 EXISTING_CONTAINER_ID=$(docker container ls --format "table {{.ID}}\t{{.Ports}}" -a | grep "4010->4010" | awk '{print $1}')
 if [ ! -z EXISTING_CONTAINER_ID ]
 then
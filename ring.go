@@ -0,0 +1,43 @@
+package main
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// Points each node has on the ring, more points spread sessions more evenly
+const ringReplicas = 64
+
+// hashRing - Consistent hash ring mapping session IDs to nodes.
+// Adding or removing a node only moves the sessions that hash next to its points.
+type hashRing struct {
+	points []uint32
+	nodes  map[uint32]string
+}
+
+func newHashRing(nodeIDs []string) *hashRing {
+	r := &hashRing{nodes: make(map[uint32]string, len(nodeIDs)*ringReplicas)}
+	for _, nodeID := range nodeIDs {
+		for replica := 0; replica < ringReplicas; replica++ {
+			point := crc32.ChecksumIEEE([]byte(nodeID + "#" + strconv.Itoa(replica)))
+			r.points = append(r.points, point)
+			r.nodes[point] = nodeID
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// owner - Node that owns key, or "" if the ring is empty
+func (r *hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.nodes[r.points[i]]
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Headers set on requests proxied between nodes so they are never proxied twice and keep
+// the address of the client. They are only trusted when signed with the cluster secret.
+const (
+	proxiedHeader         = "X-QRSync-Proxied-By"
+	proxiedClientIPHeader = "X-QRSync-Client-IP"
+	proxySignatureHeader  = "X-QRSync-Proxy-Signature"
+)
+
+// How old a proxied request's signature can be before the request is treated as a client's
+const maxProxySignatureAge = time.Minute
+
+// Attempts at picking a session ID this node owns before settling for one it doesn't
+const maxSessionIDAttempts = 1000
+
+// hashRouting - Whether each session is served by the single node it hashes to,
+// rather than its members being spread across nodes
+func (a *App) hashRouting() bool {
+	return a.membership != nil
+}
+
+// startHashRouting - Joins the cluster membership so session owners can be found
+func (a *App) startHashRouting() error {
+	self := clusterNode{ID: a.Config.NodeID, Addr: a.Config.AdvertiseAddr}
+	a.membership = newMembership(self, a.backplane, a.logger, a.rebalanceSessions)
+	if err := a.membership.join(); err != nil {
+		return err
+	}
+	go a.membership.run()
+	return nil
+}
+
+// ownsSession - Whether this node should serve the session
+func (a *App) ownsSession(sessionID string) bool {
+	if !a.hashRouting() {
+		return true
+	}
+	owner, ok := a.membership.owner(sessionID)
+	return !ok || owner.ID == a.Config.NodeID
+}
+
+// newSessionID - Picks the next session ID, one that this node owns when routing by hash
+// so the creator doesn't have to move. Caller must hold a.mu.
+func (a *App) newSessionID() string {
+	for attempt := 1; ; attempt++ {
+		a.QRIDCounter++
+		sessionID := a.idPrefix + fmt.Sprint(a.QRIDCounter)
+		if attempt == maxSessionIDAttempts || a.ownsSession(sessionID) {
+			return sessionID
+		}
+	}
+}
+
+// routeSession - Proxies connections for a session owned by another node to that node
+func (a *App) routeSession(next http.HandlerFunc) http.HandlerFunc {
+	return a.routeSessionBy(func(r *http.Request) string { return r.URL.Query().Get("sessionId") }, next)
+}
+
+// routeSessionPath - Proxies requests for a session in the path owned by another node to that node
+func (a *App) routeSessionPath(next http.HandlerFunc) http.HandlerFunc {
+	return a.routeSessionBy(func(r *http.Request) string { return mux.Vars(r)["id"] }, next)
+}
+
+func (a *App) routeSessionBy(sessionIDOf func(r *http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID := sessionIDOf(r)
+		if a.hashRouting() && sessionID != "" && !a.proxiedByNode(r) {
+			if owner, ok := a.membership.owner(sessionID); ok && owner.ID != a.Config.NodeID {
+				a.proxyTo(w, r, owner)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// routeClient - Proxies requests from clients connected to another node to that node
+func (a *App) routeClient(next http.HandlerFunc) http.HandlerFunc {
+	return a.routeClientBy(func(r *http.Request) string { return r.URL.Query().Get("clientId") }, next)
+}
+
+// routeClientPath - Proxies requests for a client in the path connected to another node to that node
+func (a *App) routeClientPath(next http.HandlerFunc) http.HandlerFunc {
+	return a.routeClientBy(func(r *http.Request) string { return mux.Vars(r)["id"] }, next)
+}
+
+func (a *App) routeClientBy(clientIDOf func(r *http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.hashRouting() && !a.proxiedByNode(r) {
+			a.mu.Lock()
+			client, remote := a.remoteClients[clientIDOf(r)]
+			a.mu.Unlock()
+			if remote {
+				if node, ok := a.membership.node(client.transport.(*remoteTransport).nodeID); ok {
+					a.proxyTo(w, r, node)
+					return
+				}
+			}
+		}
+		next(w, r)
+	}
+}
+
+// proxyTo - Forwards a request, including websocket upgrades and event streams, to another node
+func (a *App) proxyTo(w http.ResponseWriter, r *http.Request, node clusterNode) {
+	target, err := url.Parse(node.Addr)
+	if err != nil {
+		http.Error(w, "Invalid address for node "+node.ID, http.StatusBadGateway)
+		return
+	}
+	a.logger.Debug("Proxying request", "nodeId", node.ID, "path", r.URL.Path, "remoteAddr", r.RemoteAddr)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ModifyResponse = func(res *http.Response) error {
+		// This node has already added CORS headers, repeating them makes browsers reject the response
+		for header := range res.Header {
+			if strings.HasPrefix(header, "Access-Control-") {
+				res.Header.Del(header)
+			}
+		}
+		return nil
+	}
+	a.signProxiedRequest(r, time.Now())
+	proxy.ServeHTTP(w, r)
+}
+
+// signProxiedRequest - Marks r as proxied by this node for the client it came from
+func (a *App) signProxiedRequest(r *http.Request, now time.Time) {
+	clientIP := a.clientIP(r)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	r.Header.Set(proxiedHeader, a.Config.NodeID)
+	r.Header.Set(proxiedClientIPHeader, clientIP)
+	r.Header.Set(proxySignatureHeader, timestamp+"."+a.proxySignature(r, a.Config.NodeID, clientIP, timestamp))
+}
+
+// proxiedByNode - Whether r was proxied by another node of the cluster, rather than sent by
+// a client pretending to be one
+func (a *App) proxiedByNode(r *http.Request) bool {
+	nodeID := r.Header.Get(proxiedHeader)
+	if !a.hashRouting() || nodeID == "" {
+		return false
+	}
+	if _, member := a.membership.node(nodeID); !member {
+		return false
+	}
+	timestamp, signature, ok := strings.Cut(r.Header.Get(proxySignatureHeader), ".")
+	if !ok {
+		return false
+	}
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(signedAt, 0)).Abs() > maxProxySignatureAge {
+		return false
+	}
+	expected := a.proxySignature(r, nodeID, r.Header.Get(proxiedClientIPHeader), timestamp)
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
+
+// proxySignature - HMAC of the parts of a proxied request other nodes rely on
+func (a *App) proxySignature(r *http.Request, nodeID string, clientIP string, timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(a.Config.ClusterSecret))
+	for _, part := range []string{nodeID, clientIP, timestamp, r.Method, canonicalRequestTarget(r.URL)} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// canonicalRequestTarget - Path and query of a request in a form that survives proxies
+// re-encoding the path or reordering query parameters. The path is the one proxyTo forwards
+// to, as advertiseAddr has no path of its own.
+func canonicalRequestTarget(u *url.URL) string {
+	return u.Path + "?" + u.Query().Encode()
+}
+
+// rebalanceSessions - Hands sessions this node no longer owns to their new owner and
+// tells their clients to reconnect, which routes them to the new owner.
+// Called whenever a node joins, leaves or fails.
+func (a *App) rebalanceSessions() {
+	ctx := context.Background()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for sessionID, session := range a.SessionMap {
+		owner, ok := a.membership.owner(sessionID)
+		if !ok || owner.ID == a.Config.NodeID {
+			continue
+		}
+		stored := storedSession(session)
+		if err := a.publishCluster(nodeChannel(owner.ID), clusterEnvelope{Kind: clusterSessionHandoff, Session: &stored}); err != nil {
+			continue
+		}
+		delete(a.SessionMap, sessionID)
+		a.logger.Info("Session moved", "sessionId", sessionID, "nodeId", owner.ID)
+		movedMsg := SessionMovedMsg{
+			Type:             "SessionMoved",
+			SessionID:        sessionID,
+			ReconnectAfterMs: a.Config.ReconnectAfter.Milliseconds(),
+		}
+		for _, clientID := range session.ClientIDs {
+			if client, local := a.ClientMap[clientID]; local {
+				client.transport.Send(ctx, movedMsg)
+				client.transport.CloseWithReason(websocket.CloseGoingAway, "Session moved")
+			}
+		}
+	}
+}
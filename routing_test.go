@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeClock - Clock the test moves forward by hand
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// WaitFor - Polls until condition holds, for changes that arrive over the backplane
+func WaitFor(t *testing.T, description string, condition func() bool) {
+	for attempt := 0; attempt < 200; attempt++ {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", description)
+}
+
+func StartHashRoutedNode(t *testing.T, nodeID string, backplane Backplane) (*App, string) {
+	app := &App{backplane: backplane}
+	_, wsUrl := StartTestApp(t, app, func(config *Config) {
+		config.NodeID = nodeID
+		config.SessionRouting = "hash"
+		config.ClusterSecret = "test-cluster-secret"
+		config.ReconnectAfter = 0
+		// Tests create sessions until one hashes to another node
+		config.Limits = LimitsConfig{}
+	})
+	t.Cleanup(app.membership.leave)
+	return app, wsUrl
+}
+
+func Test_hash_ring_only_moves_sessions_to_a_new_node(t *testing.T) {
+	before := newHashRing([]string{"node1", "node2", "node3"})
+	after := newHashRing([]string{"node1", "node2", "node3", "node4"})
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		sessionID := fmt.Sprint(i)
+		if before.owner(sessionID) != after.owner(sessionID) {
+			moved++
+			if after.owner(sessionID) != "node4" {
+				t.Fatalf("Expected session %s to move to the new node but it moved to %s", sessionID, after.owner(sessionID))
+			}
+		}
+	}
+	if moved == 0 || moved > 500 {
+		t.Fatalf("Expected about a quarter of sessions to move but %d of 1000 did", moved)
+	}
+}
+
+func Test_membership_detects_joins_leaves_and_failures(t *testing.T) {
+	hub := newMemoryBackplane()
+	clock := &fakeClock{now: time.Now()}
+	changes := make(chan struct{}, 100)
+	members := []*membership{}
+	for _, nodeID := range []string{"node1", "node2", "node3"} {
+		m := newMembership(clusterNode{ID: nodeID}, hub.node(), slog.Default(), func() { changes <- struct{}{} })
+		m.now = clock.Now
+		members = append(members, m)
+		if err := m.join(); err != nil {
+			t.Fatalf("Failed to join %v", err)
+		}
+	}
+	node1, node2, node3 := members[0], members[1], members[2]
+	for _, m := range members {
+		WaitFor(t, m.self.ID+" to see every node", func() bool { return len(m.nodeIDs()) == 3 })
+	}
+
+	// node3 stops sending heartbeats
+	clock.Advance(nodeFailureTimeout + time.Second)
+	node2.heartbeat()
+	WaitFor(t, "heartbeat from node2", func() bool {
+		node1.mu.Lock()
+		defer node1.mu.Unlock()
+		return node1.lastSeen["node2"].Equal(clock.Now())
+	})
+	node1.expire()
+	if nodeIDs := node1.nodeIDs(); strings.Join(nodeIDs, ",") != "node1,node2" {
+		t.Fatalf("Expected node3 to have failed but nodes were %v", nodeIDs)
+	}
+	if owner, _ := node1.owner("any session"); owner.ID == "node3" {
+		t.Fatalf("Expected failed node to own no sessions")
+	}
+
+	node2.leave()
+	WaitFor(t, "node1 to see node2 leave", func() bool { return len(node1.nodeIDs()) == 1 })
+	node3.leave()
+	if len(changes) == 0 {
+		t.Fatalf("Expected membership changes to be reported")
+	}
+}
+
+func Test_clients_are_proxied_to_the_node_owning_their_session(t *testing.T) {
+	hub := newMemoryBackplane()
+	node1, wsUrl1 := StartHashRoutedNode(t, "node1", hub.node())
+	node2, wsUrl2 := StartHashRoutedNode(t, "node2", hub.node())
+	WaitFor(t, "nodes to see each other", func() bool {
+		return len(node1.membership.nodeIDs()) == 2 && len(node2.membership.nodeIDs()) == 2
+	})
+
+	ws1, _ := ConnectClient(t, wsUrl1)
+	defer CloseWithCloseMessage(ws1)
+	ws1.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var client1JoinMsg ClientJoinedSessionMsg
+	ws1.ReadJSON(&client1JoinMsg)
+	if owner, _ := node1.membership.owner(client1JoinMsg.SessionID); owner.ID != "node1" {
+		t.Fatalf("Expected session created on node1 to be owned by it but owner was %s", owner.ID)
+	}
+
+	// Client 2 connects to node2 but is served by node1, which owns the session
+	ws2, client2ConnectMsg := ConnectClient(t, wsUrl2+"?sessionId="+client1JoinMsg.SessionID)
+	defer CloseWithCloseMessage(ws2)
+	if !strings.HasPrefix(client2ConnectMsg.Client.ID, "node1-") {
+		t.Fatalf("Expected client 2 to be proxied to node1 but its ID was %s", client2ConnectMsg.Client.ID)
+	}
+	ws1.WriteJSON(AddClientToSessionMsg{
+		Type:        "AddClientToSession",
+		SessionID:   client1JoinMsg.SessionID,
+		AddClientID: client2ConnectMsg.Client.ID,
+	})
+	ws1.ReadJSON(&client1JoinMsg)
+	var client2JoinMsg ClientJoinedSessionMsg
+	ws2.ReadJSON(&client2JoinMsg)
+
+	ws2.WriteJSON(BroadcastToSessionMsg{Type: "BroadcastToSession", Payload: "through the proxy"})
+	var broadcastMsg BroadcastFromSessionMsg
+	ws1.ReadJSON(&broadcastMsg)
+	if broadcastMsg.Payload != "through the proxy" || broadcastMsg.SenderID != client2ConnectMsg.Client.ID {
+		t.Fatalf("Expected broadcast from client 2 but got %v", broadcastMsg)
+	}
+}
+
+func Test_integration_requests_are_proxied_to_the_node_owning_the_session(t *testing.T) {
+	hub := newMemoryBackplane()
+	node1, wsUrl1 := StartHashRoutedNode(t, "node1", hub.node())
+	node2, wsUrl2 := StartHashRoutedNode(t, "node2", hub.node())
+	node1.Config.IntegrationTokens = map[string]string{"boarding": "integration-secret"}
+	node2.Config.IntegrationTokens = node1.Config.IntegrationTokens
+	WaitFor(t, "nodes to see each other", func() bool {
+		return len(node1.membership.nodeIDs()) == 2 && len(node2.membership.nodeIDs()) == 2
+	})
+	ws, _ := ConnectClient(t, wsUrl1)
+	defer CloseWithCloseMessage(ws)
+	ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var joinMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&joinMsg)
+
+	// The session only lives on node1, so node2 has to send these requests there
+	apiUrl2 := "http" + strings.TrimSuffix(strings.TrimPrefix(wsUrl2, "ws"), "/ws")
+	res := IntegrationRequest(t, http.MethodGet, apiUrl2+"/sessions/"+joinMsg.SessionID, "integration-secret", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected session to be found through node2 but got %d", res.StatusCode)
+	}
+	res = IntegrationRequest(t, http.MethodPost, apiUrl2+"/sessions/"+joinMsg.SessionID+"/broadcast", "integration-secret", `{"payload":"boarding now"}`)
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected broadcast through node2 to be accepted but got %d", res.StatusCode)
+	}
+	var broadcastMsg BroadcastFromSessionMsg
+	ws.ReadJSON(&broadcastMsg)
+	if broadcastMsg.Payload != "boarding now" || broadcastMsg.SenderID != "integration:boarding" {
+		t.Fatalf("Expected broadcast from the integration but got %v", broadcastMsg)
+	}
+}
+
+func Test_only_requests_signed_by_another_node_count_as_proxied(t *testing.T) {
+	hub := newMemoryBackplane()
+	node1, _ := StartHashRoutedNode(t, "node1", hub.node())
+	node2, _ := StartHashRoutedNode(t, "node2", hub.node())
+	WaitFor(t, "nodes to see each other", func() bool {
+		return len(node1.membership.nodeIDs()) == 2 && len(node2.membership.nodeIDs()) == 2
+	})
+
+	// Node IDs are public, so naming one isn't enough to skip routing or pick an IP
+	forged := httptest.NewRequest(http.MethodGet, "/api/v1/ws?sessionId=1", nil)
+	forged.RemoteAddr = "203.0.113.7:5000"
+	forged.Header.Set(proxiedHeader, "node1")
+	forged.Header.Set(proxiedClientIPHeader, "10.0.0.1")
+	if node2.proxiedByNode(forged) || node2.clientIP(forged) != "203.0.113.7" {
+		t.Fatalf("Expected unsigned proxy headers to be ignored")
+	}
+
+	proxied := httptest.NewRequest(http.MethodGet, "/api/v1/ws?sessionId=1", nil)
+	proxied.RemoteAddr = "198.51.100.2:5000"
+	node1.signProxiedRequest(proxied, time.Now())
+	if !node2.proxiedByNode(proxied) || node2.clientIP(proxied) != "198.51.100.2" {
+		t.Fatalf("Expected request signed by node1 to keep its client IP")
+	}
+	proxied.Header.Set(proxiedClientIPHeader, "10.0.0.1")
+	if node2.proxiedByNode(proxied) {
+		t.Fatalf("Expected tampered client IP to break the signature")
+	}
+
+	// Proxies between nodes may re-encode the path and reorder the query without breaking it
+	reencoded := httptest.NewRequest(http.MethodGet, "/api/v1/client/a%20b?sessionId=1&name=x", nil)
+	node1.signProxiedRequest(reencoded, time.Now())
+	reencoded.URL, _ = url.Parse("/api/v1/client/a%20%62?name=x&sessionId=1")
+	if !node2.proxiedByNode(reencoded) {
+		t.Fatalf("Expected signature to cover the canonical path and query")
+	}
+	reencoded.URL, _ = url.Parse("/api/v1/client/other?name=x&sessionId=1")
+	if node2.proxiedByNode(reencoded) {
+		t.Fatalf("Expected a different path to break the signature")
+	}
+
+	stale := httptest.NewRequest(http.MethodGet, "/api/v1/ws?sessionId=1", nil)
+	node1.signProxiedRequest(stale, time.Now().Add(-2*maxProxySignatureAge))
+	if node2.proxiedByNode(stale) {
+		t.Fatalf("Expected old signatures to be refused")
+	}
+}
+
+func Test_sessions_move_when_a_node_joins(t *testing.T) {
+	hub := newMemoryBackplane()
+	node1, wsUrl1 := StartHashRoutedNode(t, "node1", hub.node())
+
+	// Create sessions on node1 until one will belong to node2 once it joins
+	ws, connectMsg := ConnectClient(t, wsUrl1)
+	futureRing := newHashRing([]string{"node1", "node2"})
+	var joinMsg ClientJoinedSessionMsg
+	for joinMsg.SessionID == "" || futureRing.owner(joinMsg.SessionID) != "node2" {
+		ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+		ws.ReadJSON(&joinMsg)
+	}
+	ws.WriteJSON(UpdateNoteMsg{
+		Type:   "UpdateNote",
+		NoteID: "note1",
+		Ops:    []NoteOp{{Kind: "insert", ID: NoteOpID{Counter: 1, ClientID: connectMsg.Client.ID}, Value: "x"}},
+	})
+	var noteUpdatedMsg NoteUpdatedMsg
+	ws.ReadJSON(&noteUpdatedMsg)
+
+	node2, _ := StartHashRoutedNode(t, "node2", hub.node())
+	var movedMsg SessionMovedMsg
+	ws.ReadJSON(&movedMsg)
+	if movedMsg.Type != "SessionMoved" || movedMsg.SessionID != joinMsg.SessionID {
+		t.Fatalf("Expected session %s to move but got %v", joinMsg.SessionID, movedMsg)
+	}
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("Expected connection to be closed after session moved but got %v", err)
+	}
+	WaitFor(t, "session to be handed to node2", func() bool {
+		node2.mu.Lock()
+		defer node2.mu.Unlock()
+		_, handedOver := node2.SessionMap[joinMsg.SessionID]
+		return handedOver
+	})
+	node1.mu.Lock()
+	_, stillOnNode1 := node1.SessionMap[joinMsg.SessionID]
+	node1.mu.Unlock()
+	if stillOnNode1 {
+		t.Fatalf("Expected node1 to drop the session it handed over")
+	}
+
+	// Reconnecting through node1 reaches node2, which restores the client's session and notes
+	ws, rejoinMsg := ConnectClient(t, wsUrl1+"?clientId="+connectMsg.Client.ID+"&rejoinToken="+connectMsg.TransportToken+"&sessionId="+joinMsg.SessionID)
+	defer CloseWithCloseMessage(ws)
+	if rejoinMsg.Client.ID != connectMsg.Client.ID {
+		t.Fatalf("Expected to rejoin as %s but was %s", connectMsg.Client.ID, rejoinMsg.Client.ID)
+	}
+	var rejoinedMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&rejoinedMsg)
+	if rejoinedMsg.SessionID != joinMsg.SessionID {
+		t.Fatalf("Expected to rejoin session %s but got %v", joinMsg.SessionID, rejoinedMsg)
+	}
+	var snapshotMsg NoteSnapshotMsg
+	ws.ReadJSON(&snapshotMsg)
+	if snapshotMsg.NoteID != "note1" {
+		t.Fatalf("Expected note to move with the session but got %v", snapshotMsg)
+	}
+}
+
+func Test_clients_added_from_another_node_can_rejoin_on_the_owner(t *testing.T) {
+	hub := newMemoryBackplane()
+	node1, wsUrl1 := StartHashRoutedNode(t, "node1", hub.node())
+	node2, wsUrl2 := StartHashRoutedNode(t, "node2", hub.node())
+	WaitFor(t, "nodes to see each other", func() bool {
+		return len(node1.membership.nodeIDs()) == 2 && len(node2.membership.nodeIDs()) == 2
+	})
+
+	ws1, _ := ConnectClient(t, wsUrl1)
+	defer CloseWithCloseMessage(ws1)
+	ws1.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var client1JoinMsg ClientJoinedSessionMsg
+	ws1.ReadJSON(&client1JoinMsg)
+
+	// Client 2 connects to node2 before scanning the QR code, so node1 never sees its transport token
+	ws2, client2ConnectMsg := ConnectClient(t, wsUrl2)
+	WaitFor(t, "node1 to see client 2", func() bool {
+		node1.mu.Lock()
+		defer node1.mu.Unlock()
+		_, known := node1.remoteClients[client2ConnectMsg.Client.ID]
+		return known
+	})
+	ws1.WriteJSON(AddClientToSessionMsg{
+		Type:        "AddClientToSession",
+		SessionID:   client1JoinMsg.SessionID,
+		AddClientID: client2ConnectMsg.Client.ID,
+	})
+	ws1.ReadJSON(&client1JoinMsg)
+	var movedMsg SessionMovedMsg
+	ws2.ReadJSON(&movedMsg)
+	if movedMsg.Type != "SessionMoved" || movedMsg.SessionID != client1JoinMsg.SessionID || movedMsg.RejoinToken == "" {
+		t.Fatalf("Expected client 2 to be told to rejoin on node1 but got %v", movedMsg)
+	}
+	CloseWithCloseMessage(ws2)
+
+	ws2, rejoinMsg := ConnectClient(t, wsUrl2+"?clientId="+client2ConnectMsg.Client.ID+"&rejoinToken="+movedMsg.RejoinToken+"&sessionId="+movedMsg.SessionID)
+	defer CloseWithCloseMessage(ws2)
+	if rejoinMsg.Client.ID != client2ConnectMsg.Client.ID {
+		t.Fatalf("Expected to rejoin as %s but was %s", client2ConnectMsg.Client.ID, rejoinMsg.Client.ID)
+	}
+	var client2JoinMsg ClientJoinedSessionMsg
+	ws2.ReadJSON(&client2JoinMsg)
+	if client2JoinMsg.SessionID != client1JoinMsg.SessionID {
+		t.Fatalf("Expected to rejoin session %s but got %v", client1JoinMsg.SessionID, client2JoinMsg)
+	}
+
+	ws2.WriteJSON(BroadcastToSessionMsg{Type: "BroadcastToSession", Payload: "rejoined"})
+	var broadcastMsg BroadcastFromSessionMsg
+	ws1.ReadJSON(&broadcastMsg)
+	if broadcastMsg.Payload != "rejoined" || broadcastMsg.SenderID != client2ConnectMsg.Client.ID {
+		t.Fatalf("Expected broadcast from client 2 as a member but got %v", broadcastMsg)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Codes of errors sent to clients whose messages are rejected before reaching a handler
+const (
+	errInvalidMessage  = "invalid_message"
+	errUnknownType     = "unknown_type"
+	errMessageTooLarge = "message_too_large"
+)
+
+// inboundMsgTypes - Messages clients can send keyed by type, each is validated against
+// a JSON Schema generated from its struct
+var inboundMsgTypes = map[string]interface{}{
+	"UpdateClient":            UpdateClientMsg{},
+	"CreateSession":           CreateSessionMsg{},
+	"AddClientToSession":      AddClientToSessionMsg{},
+	"BroadcastToSession":      BroadcastToSessionMsg{},
+	"UpdateNote":              UpdateNoteMsg{},
+	"SetClipboard":            SetClipboardMsg{},
+	"RtcOffer":                RtcOfferMsg{},
+	"RtcAnswer":               RtcAnswerMsg{},
+	"RtcIceCandidate":         RtcIceCandidateMsg{},
+	"PublishKey":              PublishKeyMsg{},
+	"SendEncrypted":           SendEncryptedMsg{},
+	"Register":                RegisterMsg{},
+	"Login":                   LoginMsg{},
+	"LinkDevice":              LinkDeviceMsg{},
+	"UnlinkDevice":            UnlinkDeviceMsg{},
+	"ListDevices":             ListDevicesMsg{},
+	"StartSessionWithDevices": StartSessionWithDevicesMsg{},
+	"InviteTrustedDevice":     InviteTrustedDeviceMsg{},
+	"ListTrustedDevices":      ListTrustedDevicesMsg{},
+	"RevokeTrustedDevice":     RevokeTrustedDeviceMsg{},
+	"PairAccept":              PairAcceptMsg{},
+}
+
+// Messages with credentials, whose bodies are never logged
+var credentialMsgTypes = map[string]bool{
+	"Register":   true,
+	"Login":      true,
+	"LinkDevice": true,
+}
+
+var inboundSchemas = newInboundSchemas()
+
+// Values allowed for named string types
+var schemaEnums = map[reflect.Type][]interface{}{
+	reflect.TypeOf(ContentKind("")): func() []interface{} {
+		kinds := []interface{}{}
+		for _, kind := range allContentKinds {
+			kinds = append(kinds, kind.Value)
+		}
+		return kinds
+	}(),
+	reflect.TypeOf(DeviceType("")): func() []interface{} {
+		deviceTypes := []interface{}{}
+		for _, deviceType := range allDeviceTypes {
+			deviceTypes = append(deviceTypes, deviceType.Value)
+		}
+		return deviceTypes
+	}(),
+	reflect.TypeOf(PresenceStatus("")): func() []interface{} {
+		statuses := []interface{}{}
+		for _, status := range allPresenceStatuses {
+			statuses = append(statuses, status.Value)
+		}
+		return statuses
+	}(),
+}
+
+// jsonSchema - The subset of JSON Schema needed to describe message types.
+// Fields tagged `jsonschema:"required"` must be present, others may be left out.
+type jsonSchema struct {
+	Schema     string                 `json:"$schema,omitempty"`
+	Title      string                 `json:"title,omitempty"`
+	Type       interface{}            `json:"type,omitempty"`
+	Format     string                 `json:"format,omitempty"`
+	Const      interface{}            `json:"const,omitempty"`
+	Enum       []interface{}          `json:"enum,omitempty"`
+	Properties map[string]*jsonSchema `json:"properties,omitempty"`
+	Required   []string               `json:"required,omitempty"`
+	Items      *jsonSchema            `json:"items,omitempty"`
+	// Schema of map values
+	AdditionalProperties *jsonSchema `json:"additionalProperties,omitempty"`
+}
+
+func newInboundSchemas() map[string]*jsonSchema {
+	schemas := make(map[string]*jsonSchema, len(inboundMsgTypes))
+	for msgType, msg := range inboundMsgTypes {
+		schema := schemaFor(reflect.TypeOf(msg))
+		schema.Schema = "https://json-schema.org/draft/2020-12/schema"
+		schema.Title = reflect.TypeOf(msg).Name()
+		schema.Properties["type"] = &jsonSchema{Const: msgType}
+		schema.Required = append([]string{"type"}, schema.Required...)
+		schemas[msgType] = schema
+	}
+	return schemas
+}
+
+// schemaFor - Describes the JSON encoding/json produces for t
+func schemaFor(t reflect.Type) *jsonSchema {
+	if t == reflect.TypeOf(time.Time{}) {
+		return &jsonSchema{Type: "string", Format: "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := schemaFor(t.Elem())
+		if schema.Type != nil {
+			schema.Type = []string{schema.Type.(string), "null"}
+		}
+		return schema
+	case reflect.String:
+		return &jsonSchema{Type: "string", Enum: schemaEnums[t]}
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &jsonSchema{Type: "array", Items: schemaFor(t.Elem())}
+	case reflect.Map:
+		return &jsonSchema{Type: "object", AdditionalProperties: schemaFor(t.Elem())}
+	case reflect.Struct:
+		schema := &jsonSchema{Type: "object", Properties: map[string]*jsonSchema{}}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			schema.Properties[name] = schemaFor(field.Type)
+			if field.Tag.Get("jsonschema") == "required" {
+				schema.Required = append(schema.Required, name)
+			}
+		}
+		return schema
+	}
+	// Interfaces and anything else can hold any value
+	return &jsonSchema{}
+}
+
+// validate - Checks a value decoded with json.Decoder.UseNumber matches the schema.
+// path is the JSON pointer to value, used in the error.
+func (s *jsonSchema) validate(value interface{}, path string) error {
+	if s.Const != nil && value != s.Const {
+		return fmt.Errorf("%s must be %q", pointerOrRoot(path), s.Const)
+	}
+	if s.Type != nil && !s.allowsType(jsonType(value)) {
+		return fmt.Errorf("%s must be %s", pointerOrRoot(path), s.typeNames())
+	}
+	if len(s.Enum) > 0 {
+		allowed := false
+		for _, option := range s.Enum {
+			allowed = allowed || fmt.Sprint(option) == fmt.Sprint(value)
+		}
+		if !allowed {
+			return fmt.Errorf("%s must be one of %v", pointerOrRoot(path), s.Enum)
+		}
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, present := v[name]; !present {
+				return fmt.Errorf("%s is required", path+"/"+name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		// Sorted so the same message always reports the same error
+		sort.Strings(names)
+		for _, name := range names {
+			property := s.Properties[name]
+			if property == nil {
+				property = s.AdditionalProperties
+			}
+			if property != nil {
+				if err := property.validate(v[name], path+"/"+name); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(item, path+"/"+strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) allowsType(valueType string) bool {
+	for _, allowed := range s.typeList() {
+		if allowed == valueType || (allowed == "number" && valueType == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *jsonSchema) typeList() []string {
+	if types, ok := s.Type.([]string); ok {
+		return types
+	}
+	return []string{s.Type.(string)}
+}
+
+func (s *jsonSchema) typeNames() string {
+	return strings.Join(s.typeList(), " or ")
+}
+
+// jsonType - JSON Schema type of a value decoded with json.Decoder.UseNumber
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+func pointerOrRoot(path string) string {
+	if path == "" {
+		return "message"
+	}
+	return path
+}
+
+// ingressError - Why a message from a client was rejected before reaching its handler
+type ingressError struct {
+	Code    string
+	Message string
+}
+
+func (e *ingressError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// checkInbound - Rejects messages that are too large for their type, not JSON or don't match their schema
+func (a *App) checkInbound(msgType string, message []byte) *ingressError {
+	if msgType == "" {
+		return &ingressError{Code: errInvalidMessage, Message: "Message has no type"}
+	}
+	schema, known := inboundSchemas[msgType]
+	if !known {
+		return &ingressError{Code: errUnknownType, Message: "Unknown message type " + strconv.Quote(msgType)}
+	}
+	maxBytes, limited := a.Config.MaxMessageBytesByType[msgType]
+	if !limited {
+		maxBytes = a.Config.MaxMessageBytes
+	}
+	if int64(len(message)) > maxBytes {
+		return &ingressError{Code: errMessageTooLarge, Message: fmt.Sprintf("%s messages can be at most %d bytes", msgType, maxBytes)}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return &ingressError{Code: errInvalidMessage, Message: "Invalid JSON: " + err.Error()}
+	}
+	if err := schema.validate(value, ""); err != nil {
+		return &ingressError{Code: errInvalidMessage, Message: "Invalid " + msgType + ": " + err.Error()}
+	}
+	return nil
+}
+
+// writeSchemas - Writes the schemas of client messages for clients to validate against
+func writeSchemas() {
+	schemaBytes, err := json.MarshalIndent(inboundSchemas, "", "    ")
+	if err != nil {
+		panic(err.Error())
+	}
+	os.WriteFile("./schemas.json", append(schemaBytes, '\n'), 0644)
+}
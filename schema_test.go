@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func Test_schemas_are_generated_from_message_structs(t *testing.T) {
+	schema := inboundSchemas["UpdateNote"]
+	if strings.Join(schema.Required, ",") != "type,noteId,ops" {
+		t.Fatalf("Expected type, noteId and ops to be required but was %v", schema.Required)
+	}
+	op := schema.Properties["ops"].Items
+	if origin := op.Properties["origin"]; strings.Join(origin.typeList(), ",") != "object,null" {
+		t.Fatalf("Expected pointer fields to allow null but origin was %v", origin.Type)
+	}
+	kind := inboundSchemas["BroadcastToSession"].Properties["content"].Properties["kind"]
+	if len(kind.Enum) != len(allContentKinds) {
+		t.Fatalf("Expected content kind to be limited to the known kinds but was %v", kind.Enum)
+	}
+}
+
+func Test_schema_validation_reports_path_of_invalid_value(t *testing.T) {
+	var value interface{}
+	json.Unmarshal([]byte(`{"type":"UpdateNote","noteId":"n","ops":[{"kind":"insert","id":{"clientId":"1","counter":"one"}}]}`), &value)
+	err := inboundSchemas["UpdateNote"].validate(value, "")
+	if err == nil || err.Error() != "/ops/0/id/counter must be integer" {
+		t.Fatalf("Expected error for counter but got %v", err)
+	}
+}
+
+func Test_invalid_messages_are_rejected_with_typed_errors(t *testing.T) {
+	testServer, wsUrl := SetupWsServer(t)
+	defer testServer.Close()
+	ws, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+
+	for _, test := range []struct {
+		message      string
+		expectedCode string
+	}{
+		{`{"name":"no type"}`, errInvalidMessage},
+		{`{"type":"Teleport"}`, errUnknownType},
+		{`{"type":"CreateSession", "padding":"` + strings.Repeat("x", 2048) + `"}`, errMessageTooLarge},
+		{`{"type":"AddClientToSession","sessionId":"1"}`, errInvalidMessage},
+		{`{"type":"UpdateClient","name":5}`, errInvalidMessage},
+		{`{"type":"SetClipboard","content":`, errInvalidMessage},
+	} {
+		ws.WriteMessage(websocket.TextMessage, []byte(test.message))
+		var errMsg ErrorMsg
+		ws.ReadJSON(&errMsg)
+		if errMsg.Type != "error" || errMsg.Code != test.expectedCode {
+			t.Fatalf("Expected %s error for %s but got %v", test.expectedCode, test.message, errMsg)
+		}
+	}
+
+	// Valid messages are still handled after rejected ones
+	ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var joinMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&joinMsg)
+	if joinMsg.Type != "ClientJoinedSession" {
+		t.Fatalf("Expected to join session but got %v", joinMsg)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// serveEvents - Server-Sent Events stream of server to client messages, for networks that block websockets.
+// Clients send messages back with POST /api/v1/messages using the transportToken from ClientConnect.
+func (a *App) serveEvents(w http.ResponseWriter, r *http.Request) {
+	a.logger.Info("Event stream connecting", "remoteAddr", r.RemoteAddr)
+	if a.draining.Load() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if a.refuseConnection(w, r) {
+		return
+	}
+	ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, connectSpan := a.tracer.Start(ctx, "sse.connect")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		connectSpan.End()
+		a.cancelConnection(r)
+		return
+	}
+
+	conn := newClientConn(&sseWriter{w: w, rc: rc}, a.metrics, a.tracer)
+	client := a.connectClient(ctx, r, conn)
+	connectSpan.SetAttributes(attribute.String("qrsync.client_id", client.ID))
+	connectSpan.End()
+	logger := a.logger.With("clientId", client.ID, "remoteAddr", r.RemoteAddr, "transport", "sse")
+	logger.Info("Client connected")
+
+	select {
+	case <-r.Context().Done():
+	case <-conn.Done():
+	}
+	a.disconnectClient(ctx, logger, client.ID)
+	// The response can't be written once the handler returns, so wait for the writer to stop
+	conn.Close()
+	<-conn.Done()
+}
+
+// postMessage - Receives a single client to server message from a client without a websocket
+func (a *App) postMessage(w http.ResponseWriter, r *http.Request) {
+	client, ok := a.authorizeTransport(w, r)
+	if !ok {
+		return
+	}
+	message, err := io.ReadAll(http.MaxBytesReader(w, r.Body, a.Config.MaxMessageBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	logger := a.logger.With("clientId", client.ID, "remoteAddr", r.RemoteAddr, "transport", "http")
+	a.handleMessage(logger, client.ID, message)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// authorizeTransport - Looks up the client in the clientId query parameter and checks the request
+// carries its transportToken. Writes an error response and returns false if not.
+func (a *App) authorizeTransport(w http.ResponseWriter, r *http.Request) (Client, bool) {
+	clientID := r.URL.Query().Get("clientId")
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	a.mu.Lock()
+	client, connected := a.ClientMap[clientID]
+	a.mu.Unlock()
+	if !connected || subtle.ConstantTimeCompare([]byte(token), []byte(client.transportToken)) != 1 {
+		http.Error(w, "Unknown client or token", http.StatusUnauthorized)
+		return Client{}, false
+	}
+	return client, true
+}
+
+// sseWriter - Writes messages as Server-Sent Events
+type sseWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (s *sseWriter) WriteMessage(msgBytes []byte) error {
+	// Encoded json never contains a raw newline so fits on a single data line
+	return s.write(fmt.Sprintf("data: %s\n\n", msgBytes))
+}
+
+func (s *sseWriter) WritePing() error {
+	return s.write(": ping\n\n")
+}
+
+// Close - Event streams have no close frame, the response ends when serveEvents returns
+func (s *sseWriter) Close(code int, text string) {}
+
+func (s *sseWriter) write(event string) error {
+	s.rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := io.WriteString(s.w, event); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
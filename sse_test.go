@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// ReadEvent - Reads the data of the next message event from an event stream, skipping pings
+func ReadEvent(t *testing.T, reader *bufio.Reader, v interface{}) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event %v", err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), v); err != nil {
+				t.Fatalf("Error parsing event json %v", err)
+			}
+			return
+		}
+	}
+}
+
+func PostMessage(t *testing.T, serverUrl string, connectMsg ClientConnectMsg, msg interface{}) *http.Response {
+	msgBytes, _ := json.Marshal(msg)
+	req, _ := http.NewRequest(http.MethodPost, serverUrl+"/api/v1/messages?clientId="+connectMsg.Client.ID, strings.NewReader(string(msgBytes)))
+	req.Header.Set("Authorization", "Bearer "+connectMsg.TransportToken)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to post message %v", err)
+	}
+	res.Body.Close()
+	return res
+}
+
+func Test_event_stream_client_can_join_websocket_session(t *testing.T) {
+	testServer, wsUrl := SetupWsServer(t)
+	defer testServer.Close()
+
+	ws, client1ConnectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+
+	res, err := http.Get(testServer.URL + "/api/v1/events")
+	if err != nil {
+		t.Fatalf("Failed to open event stream %v", err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected event stream but content type was %s", res.Header.Get("Content-Type"))
+	}
+	events := bufio.NewReader(res.Body)
+	var client2ConnectMsg ClientConnectMsg
+	ReadEvent(t, events, &client2ConnectMsg)
+	if client2ConnectMsg.Type != "ClientConnect" || client2ConnectMsg.TransportToken == "" {
+		t.Fatalf("Expected ClientConnect with transport token but got %v", client2ConnectMsg)
+	}
+
+	// Client 2 creates a session over http and adds the websocket client
+	PostMessage(t, testServer.URL, client2ConnectMsg, CreateSessionMsg{Type: "CreateSession"})
+	var client2AddedToSessionMsg ClientJoinedSessionMsg
+	ReadEvent(t, events, &client2AddedToSessionMsg)
+	PostMessage(t, testServer.URL, client2ConnectMsg, AddClientToSessionMsg{
+		Type:        "AddClientToSession",
+		SessionID:   client2AddedToSessionMsg.SessionID,
+		AddClientID: client1ConnectMsg.Client.ID,
+	})
+	var joinMsg ClientJoinedSessionMsg
+	ReadEvent(t, events, &joinMsg)
+	ws.ReadJSON(&joinMsg)
+
+	ws.WriteJSON(BroadcastToSessionMsg{Type: "BroadcastToSession", Payload: "from websocket"})
+	var broadcastMsg BroadcastFromSessionMsg
+	ReadEvent(t, events, &broadcastMsg)
+	if broadcastMsg.Payload != "from websocket" || broadcastMsg.SenderID != client1ConnectMsg.Client.ID {
+		t.Fatalf("Expected broadcast from websocket client but got %v", broadcastMsg)
+	}
+}
+
+func Test_post_message_needs_transport_token(t *testing.T) {
+	testServer, wsUrl := SetupWsServer(t)
+	defer testServer.Close()
+
+	ws, connectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+	connectMsg.TransportToken = "wrong"
+	res := PostMessage(t, testServer.URL, connectMsg, CreateSessionMsg{Type: "CreateSession"})
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected unauthorized but got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Store - Keeps session state across restarts
+type Store interface {
+	// Load - Returns the saved state, or nil if nothing has been saved
+	Load() (*StoreState, error)
+	Save(state *StoreState) error
+	// Ping - Returns an error if the store cannot currently be used
+	Ping() error
+}
+
+// StoreState - Everything the server persists
+type StoreState struct {
+	QRIDCounter int             `json:"qrIdCounter"`
+	Sessions    []StoredSession `json:"sessions"`
+	// Devices given credentials when paired and the pairings between them
+	TrustedDevices []TrustedDevice `json:"trustedDevices,omitempty"`
+	Pairings       []DevicePairing `json:"pairings,omitempty"`
+}
+
+// StoredSession - Persisted form of a Session
+type StoredSession struct {
+	ID          string                   `json:"id"`
+	OwnerID     string                   `json:"ownerId"`
+	ClientIDs   []string                 `json:"clientIds"`
+	CreatedDate time.Time                `json:"createdDate"`
+	Clipboard   []ClipboardEntry         `json:"clipboard"`
+	Notes       map[string][]NoteElement `json:"notes"`
+	Members     map[string]SessionMember `json:"members,omitempty"`
+	OwnerIP     string                   `json:"ownerIp,omitempty"`
+}
+
+func newStore(config *Config) Store {
+	if config.StoreBackend == "file" {
+		return &fileStore{path: config.StorePath}
+	}
+	return memoryStore{}
+}
+
+// memoryStore - Store that keeps nothing, state only lives in the App maps
+type memoryStore struct{}
+
+func (memoryStore) Load() (*StoreState, error) {
+	return nil, nil
+}
+
+func (memoryStore) Save(state *StoreState) error {
+	return nil
+}
+
+func (memoryStore) Ping() error {
+	return nil
+}
+
+// fileStore - Store that writes state to a json file
+type fileStore struct {
+	path string
+}
+
+func (s *fileStore) Load() (*StoreState, error) {
+	stateBytes, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &StoreState{}
+	if err := json.Unmarshal(stateBytes, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (s *fileStore) Save(state *StoreState) error {
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a failed save never leaves a half written state file
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, stateBytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+func (s *fileStore) Ping() error {
+	info, err := os.Stat(filepath.Dir(s.path))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", filepath.Dir(s.path))
+	}
+	return nil
+}
+
+// snapshotState - State to pass to saveState once a.mu is released. Caller must hold a.mu.
+func (a *App) snapshotState() (*StoreState, int) {
+	a.stateSeq++
+	return a.storeState(), a.stateSeq
+}
+
+// saveState - Saves a snapshot unless one taken after it has already been saved.
+// Caller must not hold a.mu.
+func (a *App) saveState(state *StoreState, seq int) error {
+	a.saveMu.Lock()
+	defer a.saveMu.Unlock()
+	if seq < a.savedSeq {
+		return nil
+	}
+	a.savedSeq = seq
+	return a.store.Save(state)
+}
+
+// storeState - Copy of the app state to persist, sharing nothing the app changes later.
+// Caller must hold a.mu.
+func (a *App) storeState() *StoreState {
+	state := &StoreState{QRIDCounter: a.QRIDCounter, Pairings: slices.Clone(a.pairings)}
+	for _, device := range a.trustedDevices {
+		state.TrustedDevices = append(state.TrustedDevices, device)
+	}
+	for _, session := range a.SessionMap {
+		state.Sessions = append(state.Sessions, storedSession(session))
+	}
+	return state
+}
+
+func storedSession(session Session) StoredSession {
+	notes := make(map[string][]NoteElement, len(session.notes))
+	for noteID, note := range session.notes {
+		notes[noteID] = note.Snapshot()
+	}
+	return StoredSession{
+		ID:          session.ID,
+		OwnerID:     session.OwnerID,
+		ClientIDs:   slices.Clone(session.ClientIDs),
+		CreatedDate: session.createdDate,
+		Clipboard:   slices.Clone(session.clipboard),
+		Notes:       notes,
+		Members:     maps.Clone(session.members),
+		OwnerIP:     session.ownerIP,
+	}
+}
+
+// restoreState - Loads persisted sessions into the app. Caller must hold a.mu.
+func (a *App) restoreState(state *StoreState) {
+	a.QRIDCounter = state.QRIDCounter
+	for _, device := range state.TrustedDevices {
+		a.trustedDevices[device.ID] = device
+	}
+	a.pairings = state.Pairings
+	for _, stored := range state.Sessions {
+		a.SessionMap[stored.ID] = restoredSession(stored)
+	}
+}
+
+func restoredSession(stored StoredSession) Session {
+	notes := make(map[string]*NoteDoc, len(stored.Notes))
+	for noteID, elements := range stored.Notes {
+		notes[noteID] = newNoteDocFromSnapshot(elements)
+	}
+	members := stored.Members
+	if members == nil {
+		members = make(map[string]SessionMember)
+	}
+	return Session{
+		ID:          stored.ID,
+		OwnerID:     stored.OwnerID,
+		ClientIDs:   stored.ClientIDs,
+		createdDate: stored.CreatedDate,
+		notes:       notes,
+		clipboard:   stored.Clipboard,
+		members:     members,
+		ownerIP:     stored.OwnerIP,
+	}
+}
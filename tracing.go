@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Name of the tracer used for all server spans
+const tracerName = "github.com/michaelclapham/qrsync-server"
+
+// Trace context is carried in the message envelope using W3C trace context field names
+var tracePropagator = propagation.TraceContext{}
+
+// newTracerProvider - Creates the tracer provider for the configured exporter.
+// The returned function flushes and stops the exporter.
+func newTracerProvider(config *Config) (trace.TracerProvider, func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.TraceExporter {
+	case "none":
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		var file *os.File
+		file, err = os.OpenFile(config.TraceFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		}
+	case "otlp":
+		options := []otlptracehttp.Option{}
+		if config.OTLPEndpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(config.OTLPEndpoint))
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	default:
+		err = fmt.Errorf("unknown trace exporter %q", config.TraceExporter)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return newTracerProviderWithExporter(exporter)
+}
+
+func newTracerProviderWithExporter(exporter sdktrace.SpanExporter) (trace.TracerProvider, func(context.Context) error, error) {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("qrsync-server"))),
+	)
+	return provider, provider.Shutdown, nil
+}
+
+// messageCarrier - Reads and writes trace context fields at the top level of a json message
+type messageCarrier map[string]string
+
+func (c messageCarrier) Get(key string) string {
+	return c[key]
+}
+
+func (c messageCarrier) Set(key string, value string) {
+	c[key] = value
+}
+
+func (c messageCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// injectTraceContext - Adds traceparent and tracestate fields from ctx to an encoded json object
+func injectTraceContext(ctx context.Context, msgBytes []byte) []byte {
+	carrier := messageCarrier{}
+	tracePropagator.Inject(ctx, carrier)
+	if len(carrier) == 0 || len(msgBytes) < 2 || msgBytes[0] != '{' {
+		return msgBytes
+	}
+	fields := []byte{'{'}
+	for key, value := range carrier {
+		fields = append(fields, fmt.Sprintf("%q:%q,", key, value)...)
+	}
+	if msgBytes[1] == '}' {
+		// Empty object, drop the trailing comma
+		fields = fields[:len(fields)-1]
+	}
+	return append(fields, msgBytes[1:]...)
+}
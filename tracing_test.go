@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func Test_message_trace_context_links_server_spans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	app := App{}
+	app.Init()
+	app.tracer = provider.Tracer(tracerName)
+	testServer := httptest.NewServer(app.MainHandler())
+	defer testServer.Close()
+	wsUrl := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/api/v1/ws"
+
+	ws, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	ws.WriteMessage(1, []byte(`{"type":"CreateSession","traceparent":"00-`+traceID+`-00f067aa0ba902b7-01"}`))
+
+	_, msgBytes, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var joinMsg map[string]interface{}
+	json.Unmarshal(msgBytes, &joinMsg)
+	if !strings.Contains(joinMsg["traceparent"].(string), traceID) {
+		t.Fatalf("Expected reply to carry trace %s but got %v", traceID, joinMsg["traceparent"])
+	}
+
+	// Spans end after the reply is queued so may not be exported yet
+	expectedSpans := []string{"message CreateSession", "decode", "onCreateSessionMsg", "onAddClientToSessionMsg", "write"}
+	spanNames := map[string]bool{}
+	for attempt := 0; attempt < 100 && len(spanNames) < len(expectedSpans); attempt++ {
+		time.Sleep(10 * time.Millisecond)
+		for _, span := range exporter.GetSpans() {
+			if span.SpanContext.TraceID().String() == traceID {
+				spanNames[span.Name] = true
+			}
+		}
+	}
+	for _, expected := range expectedSpans {
+		if !spanNames[expected] {
+			t.Fatalf("Expected span %s in trace but got %v", expected, spanNames)
+		}
+	}
+}
+
+func Test_inject_trace_context_into_empty_object(t *testing.T) {
+	if string(injectTraceContext(context.Background(), []byte("{}"))) != "{}" {
+		t.Fatalf("Expected message without trace context to be unchanged")
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Codes of errors sent to clients for trusted device messages
+const (
+	errNotTrusted    = "not_trusted"
+	errDeviceOffline = "device_offline"
+)
+
+// TrustedDevice - Device given a long lived credential when it was first paired. The device
+// reconnects with the credential, only a hash of which is kept.
+type TrustedDevice struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	TokenHash string    `json:"tokenHash"`
+	Created   time.Time `json:"created"`
+}
+
+// How long a client has to accept a request to pair with a session owner
+const pairRequestTTL = 5 * time.Minute
+
+// pairRequest - Session owner's request to pair with a client, kept until the client accepts it
+type pairRequest struct {
+	OwnerID  string
+	ClientID string
+	Created  time.Time
+}
+
+// DevicePairing - Two trusted devices that can pull each other into sessions without a QR scan
+type DevicePairing struct {
+	DeviceIDs [2]string `json:"deviceIds"`
+	PairedAt  time.Time `json:"pairedAt"`
+}
+
+func (p DevicePairing) other(deviceID string) (string, bool) {
+	switch deviceID {
+	case p.DeviceIDs[0]:
+		return p.DeviceIDs[1], true
+	case p.DeviceIDs[1]:
+		return p.DeviceIDs[0], true
+	}
+	return "", false
+}
+
+// signInTrustedDevice - Makes client the trusted device whose credential it connected with.
+// Caller must hold a.mu.
+func (a *App) signInTrustedDevice(client *Client, token string) {
+	if token == "" {
+		return
+	}
+	tokenHash := hashDeviceToken(token)
+	for _, device := range a.trustedDevices {
+		if device.TokenHash == tokenHash {
+			client.trustedDeviceID = device.ID
+			return
+		}
+	}
+}
+
+// trustClient - Returns the trusted device ID of client, issuing it a credential if it
+// doesn't have one yet. Caller must hold a.mu.
+func (a *App) trustClient(ctx context.Context, client Client) string {
+	client = a.ClientMap[client.ID]
+	if _, trusted := a.trustedDevices[client.trustedDeviceID]; trusted {
+		return client.trustedDeviceID
+	}
+	token := newToken()
+	device := TrustedDevice{
+		ID:        newToken()[:12],
+		Name:      client.Name,
+		TokenHash: hashDeviceToken(token),
+		Created:   time.Now(),
+	}
+	a.trustedDevices[device.ID] = device
+	client.trustedDeviceID = device.ID
+	a.ClientMap[client.ID] = client
+	client.transport.Send(ctx, TrustedDeviceCredentialMsg{
+		Type:        "TrustedDeviceCredential",
+		DeviceID:    device.ID,
+		DeviceToken: token,
+	})
+	return device.ID
+}
+
+// requestPairing - Asks client whether it wants to pair with the session owner's device.
+// Nothing is trusted until the client sends PairAccept. Caller must hold a.mu.
+func (a *App) requestPairing(ctx context.Context, ownerClient Client, client Client) {
+	if _, local := a.ClientMap[client.ID]; !local {
+		a.sendError(ctx, ownerClient, "Only clients connected to this server can be trusted")
+		return
+	}
+	for requestID, request := range a.pairRequests {
+		if time.Since(request.Created) > pairRequestTTL {
+			delete(a.pairRequests, requestID)
+		}
+	}
+	requestID := newToken()
+	a.pairRequests[requestID] = pairRequest{OwnerID: ownerClient.ID, ClientID: client.ID, Created: time.Now()}
+	client.transport.Send(ctx, PairRequestMsg{
+		Type:      "PairRequest",
+		RequestID: requestID,
+		ClientID:  ownerClient.ID,
+		Name:      ownerClient.Name,
+	})
+}
+
+// onPairAcceptMsg - Pairs the sender with the session owner that asked to pair with it
+func (a *App) onPairAcceptMsg(ctx context.Context, senderClient Client, msg PairAcceptMsg) {
+	ctx, span := a.tracer.Start(ctx, "onPairAcceptMsg")
+	defer span.End()
+	request, ok := a.pairRequests[msg.RequestID]
+	if !ok || request.ClientID != senderClient.ID || time.Since(request.Created) > pairRequestTTL {
+		a.sendErrorCode(ctx, senderClient, errNotTrusted, "No pair request with ID "+msg.RequestID)
+		return
+	}
+	delete(a.pairRequests, msg.RequestID)
+	ownerClient, connected := a.ClientMap[request.OwnerID]
+	if !connected {
+		a.sendErrorCode(ctx, senderClient, errDeviceOffline, "Client "+request.OwnerID+" isn't connected")
+		return
+	}
+	a.pairClients(ctx, ownerClient, senderClient)
+}
+
+// pairClients - Pairs the devices of two clients in a session, sending each its trusted devices.
+// Caller must hold a.mu.
+func (a *App) pairClients(ctx context.Context, ownerClient Client, client Client) {
+	ownerDeviceID := a.trustClient(ctx, ownerClient)
+	deviceID := a.trustClient(ctx, client)
+	if ownerDeviceID == deviceID {
+		return
+	}
+	if _, paired := a.pairing(ownerDeviceID, deviceID); !paired {
+		a.pairings = append(a.pairings, DevicePairing{DeviceIDs: [2]string{ownerDeviceID, deviceID}, PairedAt: time.Now()})
+		a.saveTrustedDevices()
+	}
+	a.clientLogger(ownerClient).Info("Devices paired", "deviceId", ownerDeviceID, "pairedDeviceId", deviceID)
+	a.sendTrustedDevices(ctx, a.ClientMap[ownerClient.ID])
+	a.sendTrustedDevices(ctx, a.ClientMap[client.ID])
+}
+
+// pairing - Index of the pairing between two devices. Caller must hold a.mu.
+func (a *App) pairing(deviceID string, otherDeviceID string) (int, bool) {
+	for i, pairing := range a.pairings {
+		if other, ok := pairing.other(deviceID); ok && other == otherDeviceID {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// saveTrustedDevices - Saves state straight away so credentials handed out survive a crash.
+// The write happens in the background so a.mu isn't held while the whole state is saved.
+// Caller must hold a.mu.
+func (a *App) saveTrustedDevices() {
+	state, seq := a.snapshotState()
+	a.saves.Add(1)
+	go func() {
+		defer a.saves.Done()
+		if err := a.saveState(state, seq); err != nil {
+			a.logger.Error("Could not save trusted devices", "err", err)
+		}
+	}()
+}
+
+// trustedDeviceClient - Connected client signed in as deviceID. Caller must hold a.mu.
+func (a *App) trustedDeviceClient(deviceID string) (Client, bool) {
+	for _, client := range a.ClientMap {
+		if client.trustedDeviceID == deviceID {
+			return client, true
+		}
+	}
+	return Client{}, false
+}
+
+// requirePairing - Sends an error and returns false unless the sender's device is paired with deviceID.
+// Caller must hold a.mu.
+func (a *App) requirePairing(ctx context.Context, senderClient Client, deviceID string) bool {
+	if senderClient.trustedDeviceID == "" {
+		a.sendErrorCode(ctx, senderClient, errNotTrusted, "This device isn't trusted, pair it with another device first")
+		return false
+	}
+	if _, paired := a.pairing(senderClient.trustedDeviceID, deviceID); !paired {
+		a.sendErrorCode(ctx, senderClient, errNotTrusted, "No trusted device with ID "+deviceID)
+		return false
+	}
+	return true
+}
+
+// onInviteTrustedDeviceMsg - Creates a session with a device paired with the sender
+func (a *App) onInviteTrustedDeviceMsg(ctx context.Context, senderClient Client, msg InviteTrustedDeviceMsg) {
+	ctx, span := a.tracer.Start(ctx, "onInviteTrustedDeviceMsg")
+	defer span.End()
+	if !a.requirePairing(ctx, senderClient, msg.DeviceID) {
+		return
+	}
+	client, online := a.trustedDeviceClient(msg.DeviceID)
+	if !online {
+		a.sendErrorCode(ctx, senderClient, errDeviceOffline, "Trusted device "+msg.DeviceID+" isn't connected")
+		return
+	}
+	a.startSessionWith(ctx, senderClient, []Client{client})
+}
+
+func (a *App) onListTrustedDevicesMsg(ctx context.Context, senderClient Client, msg ListTrustedDevicesMsg) {
+	ctx, span := a.tracer.Start(ctx, "onListTrustedDevicesMsg")
+	defer span.End()
+	a.sendTrustedDevices(ctx, senderClient)
+}
+
+// onRevokeTrustedDeviceMsg - Removes the pairing between the sender's device and another device
+func (a *App) onRevokeTrustedDeviceMsg(ctx context.Context, senderClient Client, msg RevokeTrustedDeviceMsg) {
+	ctx, span := a.tracer.Start(ctx, "onRevokeTrustedDeviceMsg")
+	defer span.End()
+	if !a.requirePairing(ctx, senderClient, msg.DeviceID) {
+		return
+	}
+	i, _ := a.pairing(senderClient.trustedDeviceID, msg.DeviceID)
+	a.pairings = append(a.pairings[:i], a.pairings[i+1:]...)
+	a.saveTrustedDevices()
+	a.clientLogger(senderClient).Info("Device pairing revoked", "deviceId", senderClient.trustedDeviceID, "pairedDeviceId", msg.DeviceID)
+	a.sendTrustedDevices(ctx, senderClient)
+	if client, online := a.trustedDeviceClient(msg.DeviceID); online {
+		a.sendTrustedDevices(ctx, client)
+	}
+}
+
+// sendTrustedDevices - Sends client the devices paired with its device. Caller must hold a.mu.
+func (a *App) sendTrustedDevices(ctx context.Context, client Client) {
+	devicesMsg := TrustedDevicesMsg{Type: "TrustedDevices", DeviceID: client.trustedDeviceID, Devices: []TrustedDeviceInfo{}}
+	for _, pairing := range a.pairings {
+		deviceID, ok := pairing.other(client.trustedDeviceID)
+		if !ok || client.trustedDeviceID == "" {
+			continue
+		}
+		online, _ := a.trustedDeviceClient(deviceID)
+		devicesMsg.Devices = append(devicesMsg.Devices, TrustedDeviceInfo{
+			ID:       deviceID,
+			Name:     a.trustedDevices[deviceID].Name,
+			PairedAt: pairing.PairedAt,
+			ClientID: online.ID,
+		})
+	}
+	client.transport.Send(ctx, devicesMsg)
+}
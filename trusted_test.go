@@ -0,0 +1,118 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func Test_trusted_devices_can_invite_each_other_after_restart(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "state.json")
+	useFileStore := func(config *Config) {
+		config.StoreBackend = "file"
+		config.StorePath = storePath
+	}
+	app := &App{}
+	_, wsUrl := StartTestApp(t, app, useFileStore)
+
+	phone, _ := ConnectClient(t, wsUrl)
+	laptop, laptopConnectMsg := ConnectClient(t, wsUrl)
+	phone.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var joinMsg ClientJoinedSessionMsg
+	phone.ReadJSON(&joinMsg)
+	phone.WriteJSON(AddClientToSessionMsg{Type: "AddClientToSession", SessionID: joinMsg.SessionID, AddClientID: laptopConnectMsg.Client.ID, Trust: true})
+	phone.ReadJSON(&joinMsg)
+	laptop.ReadJSON(&joinMsg)
+
+	// Nothing is trusted until the laptop accepts
+	var pairRequestMsg PairRequestMsg
+	laptop.ReadJSON(&pairRequestMsg)
+	if pairRequestMsg.Type != "PairRequest" || pairRequestMsg.ClientID != joinMsg.SessionOwnerID {
+		t.Fatalf("Expected laptop to be asked to pair with the phone but got %v", pairRequestMsg)
+	}
+	phone.WriteJSON(PairAcceptMsg{Type: "PairAccept", RequestID: pairRequestMsg.RequestID})
+	var errMsg ErrorMsg
+	phone.ReadJSON(&errMsg)
+	if errMsg.Code != errNotTrusted {
+		t.Fatalf("Expected only the laptop to be able to accept but got %v", errMsg)
+	}
+	laptop.WriteJSON(PairAcceptMsg{Type: "PairAccept", RequestID: pairRequestMsg.RequestID})
+
+	var phoneCredential, laptopCredential TrustedDeviceCredentialMsg
+	phone.ReadJSON(&phoneCredential)
+	laptop.ReadJSON(&laptopCredential)
+	if phoneCredential.DeviceToken == "" || laptopCredential.DeviceToken == "" {
+		t.Fatalf("Expected both devices to be given credentials but got %v and %v", phoneCredential, laptopCredential)
+	}
+	var devicesMsg TrustedDevicesMsg
+	phone.ReadJSON(&devicesMsg)
+	if len(devicesMsg.Devices) != 1 || devicesMsg.Devices[0].ID != laptopCredential.DeviceID || devicesMsg.Devices[0].ClientID != laptopConnectMsg.Client.ID {
+		t.Fatalf("Expected phone to be paired with laptop but got %v", devicesMsg)
+	}
+	laptop.ReadJSON(&devicesMsg)
+	CloseWithCloseMessage(phone)
+	CloseWithCloseMessage(laptop)
+
+	// Pairings are saved as soon as they are made, so survive the server going away without shutting down
+	app.saves.Wait()
+	_, wsUrl = SetupWsServer(t, useFileStore)
+	phone, phoneConnectMsg := ConnectClient(t, wsUrl+"?trustedDeviceToken="+phoneCredential.DeviceToken)
+	defer CloseWithCloseMessage(phone)
+	if phoneConnectMsg.TrustedDeviceID != phoneCredential.DeviceID {
+		t.Fatalf("Expected phone to reconnect as its trusted device but got %v", phoneConnectMsg)
+	}
+	phone.WriteJSON(InviteTrustedDeviceMsg{Type: "InviteTrustedDevice", DeviceID: laptopCredential.DeviceID})
+	phone.ReadJSON(&errMsg)
+	if errMsg.Code != errDeviceOffline {
+		t.Fatalf("Expected laptop to be offline but got %v", errMsg)
+	}
+
+	laptop, _ = ConnectClient(t, wsUrl+"?trustedDeviceToken="+laptopCredential.DeviceToken)
+	defer CloseWithCloseMessage(laptop)
+	laptop.WriteJSON(InviteTrustedDeviceMsg{Type: "InviteTrustedDevice", DeviceID: phoneCredential.DeviceID})
+	var laptopJoinMsg, phoneAddedMsg, phoneJoinMsg ClientJoinedSessionMsg
+	laptop.ReadJSON(&laptopJoinMsg)
+	laptop.ReadJSON(&phoneAddedMsg)
+	phone.ReadJSON(&phoneJoinMsg)
+	if phoneAddedMsg.ClientID != phoneConnectMsg.Client.ID || phoneJoinMsg.SessionID != laptopJoinMsg.SessionID {
+		t.Fatalf("Expected phone to be pulled into the laptop's session but got %v and %v", phoneAddedMsg, phoneJoinMsg)
+	}
+
+	// Once revoked neither device can invite the other
+	phone.WriteJSON(RevokeTrustedDeviceMsg{Type: "RevokeTrustedDevice", DeviceID: laptopCredential.DeviceID})
+	phone.ReadJSON(&devicesMsg)
+	if len(devicesMsg.Devices) != 0 {
+		t.Fatalf("Expected pairing to be revoked but got %v", devicesMsg)
+	}
+	laptop.ReadJSON(&devicesMsg)
+	laptop.WriteJSON(InviteTrustedDeviceMsg{Type: "InviteTrustedDevice", DeviceID: phoneCredential.DeviceID})
+	laptop.ReadJSON(&errMsg)
+	if errMsg.Code != errNotTrusted {
+		t.Fatalf("Expected invite after revoking to be refused but got %v", errMsg)
+	}
+}
+
+func Test_only_session_owners_can_trust_devices(t *testing.T) {
+	testServer, wsUrl := SetupWsServer(t)
+	defer testServer.Close()
+	owner, _ := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(owner)
+	member, memberConnectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(member)
+	other, otherConnectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(other)
+
+	owner.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var joinMsg ClientJoinedSessionMsg
+	owner.ReadJSON(&joinMsg)
+	owner.WriteJSON(AddClientToSessionMsg{Type: "AddClientToSession", SessionID: joinMsg.SessionID, AddClientID: memberConnectMsg.Client.ID})
+	owner.ReadJSON(&joinMsg)
+	member.ReadJSON(&joinMsg)
+
+	member.WriteJSON(AddClientToSessionMsg{Type: "AddClientToSession", SessionID: joinMsg.SessionID, AddClientID: otherConnectMsg.Client.ID, Trust: true})
+	member.ReadJSON(&joinMsg)
+	var errMsg ErrorMsg
+	member.ReadJSON(&errMsg)
+	if errMsg.Code != errNotTrusted {
+		t.Fatalf("Expected member to be refused trusting a device but got %v", errMsg)
+	}
+}
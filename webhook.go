@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Webhook event types
+const (
+	WebhookSessionCreated = "session.created"
+	WebhookClientJoined   = "client.joined"
+	WebhookClientLeft     = "client.left"
+	WebhookFileShared     = "file.shared"
+	WebhookSessionEnded   = "session.ended"
+)
+
+var allWebhookEvents = []string{WebhookSessionCreated, WebhookClientJoined, WebhookClientLeft, WebhookFileShared, WebhookSessionEnded}
+
+// Attempts made to deliver an event before it is written to the dead-letter log
+const webhookMaxAttempts = 5
+
+// Number of events that can be waiting to be delivered to a subscription
+const webhookQueueLength = 256
+
+// How long a subscriber has to respond to a single delivery
+const webhookTimeout = 10 * time.Second
+
+var errWebhookQueueFull = errors.New("webhook queue full")
+
+// WebhookConfig - Subscription that is POSTed session lifecycle events
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// Key used to sign deliveries with HMAC-SHA256
+	Secret string `yaml:"secret"`
+	// Event types to send, every event when empty
+	Events []string `yaml:"events"`
+}
+
+// Validate - Checks the subscription can be delivered to
+func (c WebhookConfig) Validate() error {
+	webhookURL, err := url.Parse(c.URL)
+	if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+		return fmt.Errorf("url %q must be an absolute http or https url", c.URL)
+	}
+	if c.Secret == "" {
+		return fmt.Errorf("%s: secret is required", c.URL)
+	}
+	for _, event := range c.Events {
+		if !contains(allWebhookEvents, event) {
+			return fmt.Errorf("%s: unknown event %q", c.URL, event)
+		}
+	}
+	return nil
+}
+
+// WebhookEvent - Body of a webhook delivery
+type WebhookEvent struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Time      time.Time       `json:"time"`
+	SessionID string          `json:"sessionId"`
+	ClientID  string          `json:"clientId,omitempty"`
+	File      *FileRefContent `json:"file,omitempty"`
+}
+
+// deadLetter - Line of the dead-letter log, an event that could not be delivered
+type deadLetter struct {
+	Time     time.Time    `json:"time"`
+	URL      string       `json:"url"`
+	Attempts int          `json:"attempts"`
+	Error    string       `json:"error"`
+	Event    WebhookEvent `json:"event"`
+}
+
+// webhookSubscription - Configured webhook and the events waiting to be sent to it
+type webhookSubscription struct {
+	config WebhookConfig
+	queue  chan WebhookEvent
+}
+
+func (s *webhookSubscription) wants(eventType string) bool {
+	return len(s.config.Events) == 0 || contains(s.config.Events, eventType)
+}
+
+// webhookDispatcher - Delivers events to webhook subscriptions. Each subscription has its own
+// goroutine so a slow subscriber only delays its own events, which are delivered in order.
+type webhookDispatcher struct {
+	subscriptions  []*webhookSubscription
+	client         *http.Client
+	backoff        time.Duration
+	deadLetterPath string
+	logger         *slog.Logger
+	metrics        *appMetrics
+	// Cancelled to abandon retries when shutdown times out
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// Written by their own goroutine so Publish, called with the app lock held, never writes files
+	deadLetters       chan deadLetter
+	deadLettersClosed chan struct{}
+	// Guards closed
+	mu     sync.Mutex
+	closed bool
+}
+
+func newWebhookDispatcher(config *Config, logger *slog.Logger, metrics *appMetrics) *webhookDispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &webhookDispatcher{
+		client:            &http.Client{Timeout: webhookTimeout},
+		backoff:           config.WebhookRetryBackoff,
+		deadLetterPath:    config.WebhookDeadLetterPath,
+		logger:            logger,
+		metrics:           metrics,
+		ctx:               ctx,
+		cancel:            cancel,
+		deadLetters:       make(chan deadLetter, webhookQueueLength),
+		deadLettersClosed: make(chan struct{}),
+	}
+	for _, webhookConfig := range config.Webhooks {
+		subscription := &webhookSubscription{
+			config: webhookConfig,
+			queue:  make(chan WebhookEvent, webhookQueueLength),
+		}
+		d.subscriptions = append(d.subscriptions, subscription)
+		d.wg.Add(1)
+		go d.run(subscription)
+	}
+	go d.writeDeadLetters()
+	return d
+}
+
+// Publish - Queues an event for every subscription that wants it without blocking
+func (d *webhookDispatcher) Publish(event WebhookEvent) {
+	event.ID = newToken()
+	event.Time = time.Now().UTC()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	for _, subscription := range d.subscriptions {
+		if !subscription.wants(event.Type) {
+			continue
+		}
+		select {
+		case subscription.queue <- event:
+		default:
+			entry := d.newDeadLetter(subscription, event, 0, errWebhookQueueFull)
+			select {
+			case d.deadLetters <- entry:
+			default:
+				d.logDeadLetter(entry)
+			}
+		}
+	}
+}
+
+// Close - Delivers queued events, giving up on them and their retries once ctx is done
+func (d *webhookDispatcher) Close(ctx context.Context) {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		for _, subscription := range d.subscriptions {
+			close(subscription.queue)
+		}
+	}
+	d.mu.Unlock()
+	select {
+	case <-d.deadLettersClosed:
+	case <-ctx.Done():
+		d.cancel()
+		<-d.deadLettersClosed
+	}
+}
+
+func (d *webhookDispatcher) run(subscription *webhookSubscription) {
+	defer d.wg.Done()
+	for event := range subscription.queue {
+		d.deliverWithRetries(subscription, event)
+	}
+}
+
+// deliverWithRetries - Retries failed deliveries with exponential backoff
+// then writes the event to the dead-letter log
+func (d *webhookDispatcher) deliverWithRetries(subscription *webhookSubscription, event WebhookEvent) {
+	body, _ := json.Marshal(event)
+	backoff := d.backoff
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		var retry bool
+		retry, err = d.deliver(subscription, event, body)
+		if err == nil {
+			d.metrics.webhookDeliveries.WithLabelValues("delivered").Inc()
+			return
+		}
+		if !retry || attempt == webhookMaxAttempts || d.ctx.Err() != nil {
+			break
+		}
+		d.metrics.webhookDeliveries.WithLabelValues("retried").Inc()
+		d.logger.Warn("Webhook delivery failed, retrying", "url", subscription.config.URL, "eventId", event.ID, "attempt", attempt, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-d.ctx.Done():
+		}
+		backoff *= 2
+	}
+	d.deadLetters <- d.newDeadLetter(subscription, event, attempt, err)
+}
+
+// deliver - POSTs a signed event. Returns whether a failed delivery is worth retrying.
+func (d *webhookDispatcher) deliver(subscription *webhookSubscription, event WebhookEvent, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, subscription.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-QRSync-Event", event.Type)
+	req.Header.Set("X-QRSync-Delivery", event.ID)
+	req.Header.Set("X-QRSync-Timestamp", timestamp)
+	req.Header.Set("X-QRSync-Signature", signWebhook(subscription.config.Secret, timestamp, body))
+	res, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return true, nil
+	}
+	err = fmt.Errorf("subscriber responded %s", res.Status)
+	// Other client errors mean the request itself was rejected so would fail again
+	retry := res.StatusCode >= 500 || res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests
+	return retry, err
+}
+
+// newDeadLetter - Records that an event could not be delivered
+func (d *webhookDispatcher) newDeadLetter(subscription *webhookSubscription, event WebhookEvent, attempts int, deliveryErr error) deadLetter {
+	d.metrics.webhookDeliveries.WithLabelValues("dead_lettered").Inc()
+	return deadLetter{
+		Time:     time.Now().UTC(),
+		URL:      subscription.config.URL,
+		Attempts: attempts,
+		Error:    deliveryErr.Error(),
+		Event:    event,
+	}
+}
+
+// writeDeadLetters - Appends undelivered events to the dead-letter log until every subscription's
+// queue has been delivered. Events are logged instead when no dead-letter file is configured.
+func (d *webhookDispatcher) writeDeadLetters() {
+	defer close(d.deadLettersClosed)
+	go func() {
+		d.wg.Wait()
+		close(d.deadLetters)
+	}()
+	for entry := range d.deadLetters {
+		if d.deadLetterPath == "" {
+			d.logDeadLetter(entry)
+			continue
+		}
+		line, _ := json.Marshal(entry)
+		file, err := os.OpenFile(d.deadLetterPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = file.Write(append(line, '\n'))
+			file.Close()
+		}
+		if err != nil {
+			d.logger.Error("Could not write webhook dead letter", "eventId", entry.Event.ID, "err", err)
+		}
+	}
+}
+
+// logDeadLetter - Logs an undelivered event, used when it can't be written to the dead-letter log
+func (d *webhookDispatcher) logDeadLetter(entry deadLetter) {
+	d.logger.Error("Webhook event not delivered", "url", entry.URL, "eventId", entry.Event.ID, "eventType", entry.Event.Type, "attempts", entry.Attempts, "err", entry.Error)
+}
+
+// signWebhook - Signature subscribers use to check a delivery came from this server.
+// The timestamp is signed along with the body so old deliveries can't be replayed.
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
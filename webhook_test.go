@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_webhooks_are_signed_and_filtered(t *testing.T) {
+	events := make(chan WebhookEvent, 10)
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-QRSync-Signature") != signWebhook("webhook-secret", r.Header.Get("X-QRSync-Timestamp"), body) {
+			t.Errorf("Webhook signature did not match body")
+		}
+		var event WebhookEvent
+		json.Unmarshal(body, &event)
+		events <- event
+	}))
+	defer subscriber.Close()
+
+	config := DefaultConfig()
+	config.Webhooks = []WebhookConfig{{
+		URL:    subscriber.URL,
+		Secret: "webhook-secret",
+		Events: []string{WebhookSessionCreated, WebhookClientLeft},
+	}}
+	app := App{Config: config}
+	app.Init()
+	testServer := httptest.NewServer(app.MainHandler())
+	defer testServer.Close()
+	wsUrl := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/api/v1/ws"
+
+	ws, connectMsg := ConnectClient(t, wsUrl)
+	ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var joinMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&joinMsg)
+	CloseWithCloseMessage(ws)
+
+	// client.joined is filtered out so the next event is client.left
+	for _, expectedType := range []string{WebhookSessionCreated, WebhookClientLeft} {
+		select {
+		case event := <-events:
+			if event.Type != expectedType || event.SessionID != joinMsg.SessionID || event.ClientID != connectMsg.Client.ID {
+				t.Fatalf("Expected %s event for client %s but got %v", expectedType, connectMsg.Client.ID, event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s event", expectedType)
+		}
+	}
+}
+
+func Test_failed_webhooks_are_retried_then_dead_lettered(t *testing.T) {
+	attempts := make(chan int, 10)
+	attempt := 0
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempt++
+		attempts <- attempt
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer subscriber.Close()
+
+	config := DefaultConfig()
+	config.Webhooks = []WebhookConfig{{URL: subscriber.URL, Secret: "webhook-secret"}}
+	config.WebhookRetryBackoff = time.Millisecond
+	config.WebhookDeadLetterPath = filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	app := App{Config: config}
+	app.Init()
+
+	app.webhooks.Publish(WebhookEvent{Type: WebhookSessionCreated, SessionID: "1"})
+	app.webhooks.Close(context.Background())
+
+	if len(attempts) != webhookMaxAttempts {
+		t.Fatalf("Expected %d attempts but got %d", webhookMaxAttempts, len(attempts))
+	}
+	deadLetterBytes, _ := os.ReadFile(config.WebhookDeadLetterPath)
+	var entry deadLetter
+	if err := json.Unmarshal(deadLetterBytes, &entry); err != nil {
+		t.Fatalf("Expected dead letter to be written but got %q", deadLetterBytes)
+	}
+	if entry.Event.SessionID != "1" || entry.Attempts != webhookMaxAttempts || entry.URL != subscriber.URL {
+		t.Fatalf("Expected dead letter for session 1 after %d attempts but got %v", webhookMaxAttempts, entry)
+	}
+}
+
+func Test_events_past_a_full_queue_are_dead_lettered(t *testing.T) {
+	release := make(chan struct{})
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer subscriber.Close()
+
+	config := DefaultConfig()
+	config.Webhooks = []WebhookConfig{{URL: subscriber.URL, Secret: "webhook-secret"}}
+	config.WebhookDeadLetterPath = filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	app := App{Config: config}
+	app.Init()
+
+	// One event is being delivered, the queue fills up behind it and the rest overflow
+	for i := 0; i < webhookQueueLength+3; i++ {
+		app.webhooks.Publish(WebhookEvent{Type: WebhookSessionCreated, SessionID: "1"})
+	}
+	close(release)
+	app.webhooks.Close(context.Background())
+
+	deadLetterBytes, _ := os.ReadFile(config.WebhookDeadLetterPath)
+	lines := strings.Split(strings.TrimSpace(string(deadLetterBytes)), "\n")
+	var entry deadLetter
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil || entry.Error != errWebhookQueueFull.Error() || entry.Attempts != 0 {
+		t.Fatalf("Expected overflowing events to be dead lettered but got %q", deadLetterBytes)
+	}
+	if len(lines) < 2 || len(lines) > 3 {
+		t.Fatalf("Expected 2 or 3 dead letters depending on whether the first event was taken from the queue but got %d", len(lines))
+	}
+}
+
+func Test_expired_members_send_client_left(t *testing.T) {
+	events := make(chan WebhookEvent, 10)
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event WebhookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer subscriber.Close()
+
+	app := &App{}
+	_, wsUrl := StartTestApp(t, app, func(config *Config) {
+		config.Webhooks = []WebhookConfig{{URL: subscriber.URL, Secret: "webhook-secret", Events: []string{WebhookClientLeft}}}
+	})
+	ws, connectMsg := ConnectClient(t, wsUrl)
+	defer CloseWithCloseMessage(ws)
+	ws.WriteJSON(CreateSessionMsg{Type: "CreateSession"})
+	var joinMsg ClientJoinedSessionMsg
+	ws.ReadJSON(&joinMsg)
+
+	// One member has been quiet too long, the other was kept across a restart and never came back
+	app.mu.Lock()
+	client := app.ClientMap[connectMsg.Client.ID]
+	client.LastActivity = time.Now().Add(-2 * app.Config.ClientTTL)
+	app.ClientMap[client.ID] = client
+	session := app.SessionMap[joinMsg.SessionID]
+	session.ClientIDs = append(session.ClientIDs, "restored")
+	session.members["restored"] = SessionMember{TokenHash: hashDeviceToken("a"), JoinedAt: time.Now().Add(-2 * app.Config.ClientTTL)}
+	app.SessionMap[session.ID] = session
+	app.removeOldClients()
+	app.mu.Unlock()
+
+	left := map[string]bool{}
+	for len(left) < 2 {
+		select {
+		case event := <-events:
+			if event.Type != WebhookClientLeft || event.SessionID != joinMsg.SessionID {
+				t.Fatalf("Expected client.left event for session %s but got %v", joinMsg.SessionID, event)
+			}
+			left[event.ClientID] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for client.left events, got %v", left)
+		}
+	}
+	if !left[connectMsg.Client.ID] || !left["restored"] {
+		t.Fatalf("Expected both expired members to have left but got %v", left)
+	}
+}